@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// private sites are protected with HTTP basic auth or with an access code
+// entered on a login page, upload options:
+// ?basic-auth=${user}:${pwd}
+// ?access-code=${code}
+// ?private : generates access code, returned in X-Access-Code header
+// ?public : removes the protection
+// without those, re-uploaded site keeps its protection
+// passwords and access codes must have at least minAccessCodeLen characters
+// we only store bcrypt hash of the password or access code
+
+const (
+	accessModeBasicAuth  = "basic-auth"
+	accessModeAccessCode = "access-code"
+
+	siteLoginPath    = "/__instantpreviewinternal/login"
+	siteAccessCookie = "instaprev_access"
+
+	// makes guessing access codes impractical
+	minAccessCodeLen = 6
+
+	// failed logins are limited because checking bcrypt hash is slow and
+	// to slow down guessing. Limits are per ip and per site, in a window
+	siteLoginWindow             = 10 * time.Minute
+	maxSiteLoginFailuresPerIP   = 10
+	maxSiteLoginFailuresPerSite = 100
+	// to limit memory used, ips over that are limited only per site
+	maxSiteLoginTrackedIPs = 10000
+)
+
+var (
+	muSiteLoginFailures  sync.Mutex
+	siteLoginWindowStart time.Time
+	// "ip:${ip}" or "site:${name}" => number of failed logins
+	siteLoginFailures = map[string]int{}
+)
+
+func isPrivateSite(site *Site) bool {
+	return site.accessMode != ""
+}
+
+// getAccessOptions returns access mode, user and password (or access code)
+// from upload options. ok is false if there are no access options
+func getAccessOptions(r *http.Request) (mode string, user string, pwd string, ok bool, err error) {
+	q := r.URL.Query()
+	switch {
+	case q.Has("public"):
+		return "", "", "", true, nil
+	case q.Has("basic-auth"):
+		user, pwd, _ = strings.Cut(q.Get("basic-auth"), ":")
+		if user == "" || pwd == "" {
+			return "", "", "", false, fmt.Errorf("?basic-auth must be in ${user}:${password} format")
+		}
+		if len(pwd) < minAccessCodeLen {
+			return "", "", "", false, fmt.Errorf("?basic-auth password must be at least %d characters", minAccessCodeLen)
+		}
+		return accessModeBasicAuth, user, pwd, true, nil
+	case q.Has("access-code"):
+		pwd = q.Get("access-code")
+		if len(pwd) < minAccessCodeLen {
+			return "", "", "", false, fmt.Errorf("?access-code must be at least %d characters", minAccessCodeLen)
+		}
+		return accessModeAccessCode, "", pwd, true, nil
+	case q.Has("private"):
+		return accessModeAccessCode, "", generateRandomHex(6), true, nil
+	}
+	return "", "", "", false, nil
+}
+
+func setSiteAccess(site *Site, mode string, user string, pwd string) error {
+	site.accessMode = mode
+	site.accessUser = user
+	site.accessHash = ""
+	if mode == "" {
+		return nil
+	}
+	var err error
+	site.accessHash, err = hashPassword(pwd)
+	return err
+}
+
+// value of the cookie that grants access to the site. It changes
+// when the password changes, which logs out everyone
+func siteAccessCookieValue(site *Site) string {
+	mac := hmac.New(sha256.New, []byte(site.accessHash))
+	mac.Write([]byte(site.name))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func hasSiteAccessCookie(r *http.Request, site *Site) bool {
+	c, err := r.Cookie(siteAccessCookie)
+	if err != nil {
+		return false
+	}
+	exp := siteAccessCookieValue(site)
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(exp)) == 1
+}
+
+func setSiteAccessCookie(w http.ResponseWriter, r *http.Request, site *Site) {
+	c := &http.Cookie{
+		Name:     siteAccessCookie,
+		Value:    siteAccessCookieValue(site),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, c)
+}
+
+// must be called with muSiteLoginFailures locked
+func resetSiteLoginWindow() {
+	if time.Since(siteLoginWindowStart) > siteLoginWindow {
+		siteLoginWindowStart = time.Now()
+		clear(siteLoginFailures)
+	}
+}
+
+// isSiteLoginLimited returns true if there were too many failed logins
+// from this ip or to this site
+func isSiteLoginLimited(r *http.Request, site *Site) bool {
+	muSiteLoginFailures.Lock()
+	defer muSiteLoginFailures.Unlock()
+	resetSiteLoginWindow()
+	if siteLoginFailures["ip:"+getClientIP(r)] >= maxSiteLoginFailuresPerIP {
+		return true
+	}
+	return siteLoginFailures["site:"+site.name] >= maxSiteLoginFailuresPerSite
+}
+
+func recordSiteLoginFailure(r *http.Request, site *Site) {
+	muSiteLoginFailures.Lock()
+	defer muSiteLoginFailures.Unlock()
+	resetSiteLoginWindow()
+	ipKey := "ip:" + getClientIP(r)
+	if _, ok := siteLoginFailures[ipKey]; ok || len(siteLoginFailures) < maxSiteLoginTrackedIPs {
+		siteLoginFailures[ipKey]++
+	}
+	siteLoginFailures["site:"+site.name]++
+}
+
+func serveSiteLoginLimited(w http.ResponseWriter, r *http.Request, site *Site) {
+	auditSite(r, auditActionSiteLogin, auditOutcomeDenied, site, "too many failed logins")
+	w.Header().Set("Retry-After", strconv.Itoa(int(siteLoginWindow.Seconds())))
+	serveErrorStatus(w, r, http.StatusTooManyRequests, "Error: too many failed logins to site '%s', try again later\n", site.name)
+}
+
+func isValidBasicAuth(r *http.Request, site *Site) bool {
+	user, pwd, ok := r.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(site.accessUser)) != 1 {
+		return false
+	}
+	return checkPasswordHash(site.accessHash, pwd)
+}
+
+// checkSiteAccess returns true if request can access the site
+// if not, it serves login page or asks for basic auth
+func checkSiteAccess(w http.ResponseWriter, r *http.Request, site *Site) bool {
+	if !isPrivateSite(site) {
+		return true
+	}
+	// checking cookie is cheap, bcrypt is not
+	if hasSiteAccessCookie(r, site) {
+		return true
+	}
+	if site.accessMode == accessModeBasicAuth {
+		if _, _, ok := r.BasicAuth(); ok {
+			if isSiteLoginLimited(r, site) {
+				serveSiteLoginLimited(w, r, site)
+				return false
+			}
+			if isValidBasicAuth(r, site) {
+				setSiteAccessCookie(w, r, site)
+				return true
+			}
+			recordSiteLoginFailure(r, site)
+			auditSite(r, auditActionSiteLogin, auditOutcomeDenied, site, "invalid basic auth")
+		}
+	}
+	if isAuthorizedWithAPIToken(r, site, scopeReadPrivate) {
+		return true
+	}
+	logf(r.Context(), logAttrs(logSite(site.name)), "checkSiteAccess: no access to private site")
+	if site.accessMode == accessModeBasicAuth {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, site.name))
+		serveErrorStatus(w, r, http.StatusUnauthorized, "Error: site '%s' is private\n", site.name)
+		return false
+	}
+	serveSiteLoginPage(w, r)
+	return false
+}
+
+func serveSiteLoginPage(w http.ResponseWriter, r *http.Request) {
+	d, err := os.ReadFile(filepath.Join("www", "siteLogin.html"))
+	if err != nil {
+		serveInternalError(w, r, "serveSiteLoginPage: os.ReadFile() failed with '%s'\n", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", cacheControlNoCache)
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write(d)
+}
+
+// only allow redirecting to paths in the same site
+func isSafeRedirectPath(s string) bool {
+	return strings.HasPrefix(s, "/") && !strings.HasPrefix(s, "//") && !strings.HasPrefix(s, `/\`)
+}
+
+// GET  /__instantpreviewinternal/login?next=${path}
+// POST /__instantpreviewinternal/login with code=${code}&next=${path}
+func handleSiteLogin(w http.ResponseWriter, r *http.Request) {
+	site := findSiteFromHost(r.Context(), r.Host)
+	if site == nil {
+		http.NotFound(w, r)
+		return
+	}
+	next := r.FormValue("next")
+	if !isSafeRedirectPath(next) {
+		next = "/"
+	}
+	if site.accessMode != accessModeAccessCode {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+	if r.Method != http.MethodPost {
+		serveSiteLoginPage(w, r)
+		return
+	}
+	if isSiteLoginLimited(r, site) {
+		serveSiteLoginLimited(w, r, site)
+		return
+	}
+	if !checkPasswordHash(site.accessHash, r.PostFormValue("code")) {
+		recordSiteLoginFailure(r, site)
+		logf(r.Context(), logAttrs(logSite(site.name)), "handleSiteLogin: invalid access code")
+		auditSite(r, auditActionSiteLogin, auditOutcomeDenied, site, "invalid access code")
+		uri := siteLoginPath + "?error=1&next=" + url.QueryEscape(next)
+		http.Redirect(w, r, uri, http.StatusSeeOther)
+		return
+	}
+	logf(r.Context(), logAttrs(logSite(site.name)), "handleSiteLogin: logged in")
+	auditSite(r, auditActionSiteLogin, auditOutcomeOK, site, "")
+	setSiteAccessCookie(w, r, site)
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessCodeSite(t *testing.T) {
+	site := setupTestSite(t, "priv", map[string]string{"index.html": "secret"})
+	must(setSiteAccess(site, accessModeAccessCode, "", "letmein"))
+	must(saveSite(ctx(), site))
+
+	test := func(uri string, expCode int, hdrs ...string) *httptest.ResponseRecorder {
+		w := testGet(site, uri, hdrs...)
+		if w.Code != expCode {
+			t.Fatalf("uri: '%s', exp %d, got %d\n", uri, expCode, w.Code)
+		}
+		return w
+	}
+	w := test("/", 401)
+	if strings.Contains(w.Body.String(), "secret") || !strings.Contains(w.Body.String(), siteLoginPath) {
+		t.Fatalf("exp login page, got '%s'\n", w.Body.String())
+	}
+	test("/__instantpreviewinternal/api/site-info.json", 401)
+	test("/__instantpreviewinternal/main.css", 200)
+
+	login := func(code string, next string) *httptest.ResponseRecorder {
+		form := url.Values{"code": {code}, "next": {next}}
+		r := httptest.NewRequest("POST", siteLoginPath, strings.NewReader(form.Encode()))
+		r.Host = "priv.localhost"
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handleIndex(w, r)
+		return w
+	}
+	w = login("wrong", "/")
+	if len(w.Result().Cookies()) != 0 || !strings.Contains(w.Header().Get("Location"), "error=1") {
+		t.Fatalf("exp no cookie and redirect with error\n")
+	}
+	w = login("letmein", "//evil.com")
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || w.Header().Get("Location") != "/" {
+		t.Fatalf("exp cookie and redirect to '/', got %d cookies, location: '%s'\n", len(cookies), w.Header().Get("Location"))
+	}
+	cookie := cookies[0].Name + "=" + cookies[0].Value
+	w = test("/", 200, "Cookie", cookie)
+	if w.Body.String() != "secret" || !strings.HasPrefix(w.Header().Get("Cache-Control"), "private") {
+		t.Fatalf("exp private 'secret', got '%s', Cache-Control: '%s'\n", w.Body.String(), w.Header().Get("Cache-Control"))
+	}
+	test("/__instantpreviewinternal/api/site-info.json", 200, "Cookie", cookie)
+
+	// changing access code logs everyone out
+	must(setSiteAccess(site, accessModeAccessCode, "", "other"))
+	test("/", 401, "Cookie", cookie)
+}
+
+func TestBasicAuthSite(t *testing.T) {
+	site := setupTestSite(t, "priv", map[string]string{"index.html": "secret"})
+	must(setSiteAccess(site, accessModeBasicAuth, "joe", "pwd"))
+	must(saveSite(ctx(), site))
+
+	basicAuth := func(user, pwd string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pwd))
+	}
+	w := testGet(site, "/")
+	if w.Code != 401 || w.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("exp 401 with WWW-Authenticate, got %d\n", w.Code)
+	}
+	if w = testGet(site, "/", "Authorization", basicAuth("joe", "bad")); w.Code != 401 {
+		t.Fatalf("exp 401 for wrong password, got %d\n", w.Code)
+	}
+	if w = testGet(site, "/", "Authorization", basicAuth("bob", "pwd")); w.Code != 401 {
+		t.Fatalf("exp 401 for wrong user, got %d\n", w.Code)
+	}
+	if w = testGet(site, "/", "Authorization", basicAuth("joe", "pwd")); w.Code != 200 || w.Body.String() != "secret" {
+		t.Fatalf("exp 200 'secret', got %d '%s'\n", w.Code, w.Body.String())
+	}
+
+	tok, token := newAPIToken("ci", "", []string{scopeReadPrivate}, time.Time{})
+	must(metaStore.AddAPIToken(tok))
+	if w = testGet(site, "/", "Authorization", "Bearer "+token); w.Code != 200 {
+		t.Fatalf("exp 200 with read-private token, got %d\n", w.Code)
+	}
+}
+
+func TestGetAccessOptions(t *testing.T) {
+	test := func(query string, expMode string, expUser string, expPwd string, expOk bool) {
+		r := httptest.NewRequest("POST", "/upload?"+query, nil)
+		mode, user, pwd, ok, _ := getAccessOptions(r)
+		if mode != expMode || user != expUser || ok != expOk || (expPwd != "" && pwd != expPwd) {
+			t.Fatalf("query: '%s', exp '%s' '%s' '%s' %v, got '%s' '%s' '%s' %v\n", query, expMode, expUser, expPwd, expOk, mode, user, pwd, ok)
+		}
+	}
+	test("", "", "", "", false)
+	test("public", "", "", "", true)
+	test("basic-auth=joe:secret:b", accessModeBasicAuth, "joe", "secret:b", true)
+	test("basic-auth=joe", "", "", "", false)
+	test("basic-auth=joe:a", "", "", "", false)
+	test("access-code=x", "", "", "", false)
+	test("access-code=letmein", accessModeAccessCode, "", "letmein", true)
+	test("private", accessModeAccessCode, "", "", true)
+}
+
+func TestSiteLoginLimit(t *testing.T) {
+	site := setupTestSite(t, "priv", map[string]string{"index.html": "secret"})
+	must(setSiteAccess(site, accessModeAccessCode, "", "letmein"))
+	must(saveSite(ctx(), site))
+	muSiteLoginFailures.Lock()
+	clear(siteLoginFailures)
+	muSiteLoginFailures.Unlock()
+
+	login := func(code string, ip string) int {
+		form := url.Values{"code": {code}}
+		r := httptest.NewRequest("POST", siteLoginPath, strings.NewReader(form.Encode()))
+		r.Host = "priv.localhost"
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("X-Forwarded-For", ip)
+		w := httptest.NewRecorder()
+		handleIndex(w, r)
+		return w.Code
+	}
+	for i := 0; i < maxSiteLoginFailuresPerIP; i++ {
+		login("wrong", "1.1.1.1")
+	}
+	if code := login("letmein", "1.1.1.1"); code != http.StatusTooManyRequests {
+		t.Fatalf("exp %d after too many failed logins, got %d\n", http.StatusTooManyRequests, code)
+	}
+	if code := login("letmein", "2.2.2.2"); code != http.StatusSeeOther {
+		t.Fatalf("exp login from other ip to work, got %d\n", code)
+	}
+	// checking each access code is slow so we pretend many ips failed
+	muSiteLoginFailures.Lock()
+	siteLoginFailures["site:priv"] = maxSiteLoginFailuresPerSite - 1
+	muSiteLoginFailures.Unlock()
+	login("wrong", "3.3.3.3")
+	if code := login("letmein", "2.2.2.2"); code != http.StatusTooManyRequests {
+		t.Fatalf("exp %d after too many failed logins to site, got %d\n", http.StatusTooManyRequests, code)
+	}
+}
+
+// access options are only applied when upload succeeds
+func TestFailedUploadKeepsAccess(t *testing.T) {
+	site := setupTestSite(t, "foo", map[string]string{"index.html": "hello"})
+	pwdHash, err := hashPassword("pwd")
+	must(err)
+	site.isPremium = true
+	site.uploadPasswordHash = pwdHash
+	must(saveSite(ctx(), site))
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	must(mw.WriteField("foo", "bar"))
+	must(mw.Close())
+	r := httptest.NewRequest("POST", "/upload?private", &body)
+	r.Host = "foo.localhost"
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer pwd")
+	w := httptest.NewRecorder()
+	handleIndex(w, r)
+	if w.Code != http.StatusBadRequest || w.Header().Get("X-Access-Code") != "" {
+		t.Fatalf("exp %d without access code, got %d\n", http.StatusBadRequest, w.Code)
+	}
+	if isPrivateSite(getSite("foo")) {
+		t.Fatalf("exp site to stay public after failed upload\n")
+	}
+}
@@ -0,0 +1,616 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// admin api for managing premium sites at runtime
+// authenticated with SITES_PASSWORD, sent as "Authorization: Bearer ${pwd}"
+// or with admin session cookie and CSRF token, see adminsession.go
+// POST /__instantpreviewinternal/api/admin/premium/create?name=${name} with password=${pwd} in the body
+// POST /__instantpreviewinternal/api/admin/premium/rename?name=${name}&new-name=${newName}
+// POST /__instantpreviewinternal/api/admin/premium/delete?name=${name}
+// POST /__instantpreviewinternal/api/admin/premium/set-password?name=${name} with password=${pwd} in the body
+// POST /__instantpreviewinternal/api/admin/sites/delete?name=${name}&name=${name2}
+// POST /__instantpreviewinternal/api/admin/sites/set-expiry?name=${name}&expires=${date or duration from now}
+// POST /__instantpreviewinternal/api/admin/sites/set-expiry?name=${name}&extend=${duration, can be negative}
+// POST /__instantpreviewinternal/api/admin/sites/set-spa?name=${name}&spa=${true or false}
+// POST /__instantpreviewinternal/api/admin/sites/make-premium?name=${name} with password=${pwd} in the body
+// POST /__instantpreviewinternal/api/admin/sites/deploys?name=${name}
+// sites/ actions apply to all sites given with name=
+// POST /__instantpreviewinternal/api/admin/tokens/create?name=${name}&site=${site}&scopes=upload,delete&expires=${date or duration}
+// POST /__instantpreviewinternal/api/admin/tokens/list
+// POST /__instantpreviewinternal/api/admin/tokens/revoke?id=${id}
+// POST /__instantpreviewinternal/api/admin/audit/query, see audit.go
+
+const adminAPIPrefix = "/__instantpreviewinternal/api/admin/"
+
+var (
+	// serializes admin changes to sites
+	muAdmin sync.Mutex
+
+	// site names are sub-domains and directory names
+	rxSiteName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+)
+
+func isValidSiteName(name string) bool {
+	return rxSiteName.MatchString(name) && name != "www"
+}
+
+func isAdminRequest(r *http.Request) bool {
+	if !isAdminEnabled() {
+		return false
+	}
+	pwd, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return hasAdminSessionWithCSRF(r)
+	}
+	return subtle.ConstantTimeCompare([]byte(pwd), []byte(sitesPassword)) == 1
+}
+
+type premiumSiteResult struct {
+	Name      string
+	URL       string
+	FileCount int
+	TotalSize int64
+}
+
+func servePremiumSiteResult(w http.ResponseWriter, r *http.Request, site *Site) {
+	v := &premiumSiteResult{
+		Name:      site.name,
+		URL:       siteURL(r, site),
+		FileCount: len(site.files),
+		TotalSize: site.totalSize,
+	}
+	serveJSON(w, r, v)
+}
+
+// returns premium site with name from ?name= or serves an error
+func getPremiumSiteArg(w http.ResponseWriter, r *http.Request) *Site {
+	name := strings.ToLower(r.FormValue("name"))
+	site := getSite(name)
+	if site == nil || !site.isPremium {
+		serveErrorStatus(w, r, http.StatusNotFound, "Error: no premium site '%s'\n", name)
+		return nil
+	}
+	auditAdminSite(r, site.name, false)
+	return site
+}
+
+// see requestIDKey
+const adminAuditKey contextKey = 1
+
+// adminAudit collects sites an admin api call acted on, for audit log
+type adminAudit struct {
+	siteNames []string
+	failed    map[string]bool
+}
+
+// auditAdminSite records that admin api call acted on site name.
+// failed is for bulk actions that fail for some sites
+func auditAdminSite(r *http.Request, name string, failed bool) {
+	a, ok := r.Context().Value(adminAuditKey).(*adminAudit)
+	if !ok {
+		return
+	}
+	if _, seen := a.failed[name]; !seen {
+		a.siteNames = append(a.siteNames, name)
+	}
+	a.failed[name] = a.failed[name] || failed
+}
+
+// admin api endpoints that don't change anything, not recorded in audit log
+var adminReadOnlyEndpoints = []string{"sites/deploys", "tokens/list", "audit/query"}
+
+func handleAdminAPI(w http.ResponseWriter, r *http.Request) {
+	endpoint := strings.TrimPrefix(r.URL.Path, adminAPIPrefix)
+	if !isAdminRequest(r) {
+		auditSite(r, auditActionAdmin, auditOutcomeDenied, nil, endpoint)
+		serveErrorStatus(w, r, http.StatusUnauthorized, "Error: not authorized\n")
+		return
+	}
+	if r.Method != http.MethodPost {
+		serveErrorStatus(w, r, http.StatusMethodNotAllowed, "Error: must be POST\n")
+		return
+	}
+	muAdmin.Lock()
+	defer muAdmin.Unlock()
+
+	if !stringInSlice(adminReadOnlyEndpoints, endpoint) {
+		rec := &statusRecorder{ResponseWriter: w}
+		w = rec
+		audit := &adminAudit{failed: map[string]bool{}}
+		r = r.WithContext(context.WithValue(r.Context(), adminAuditKey, audit))
+		defer func() {
+			names := audit.siteNames
+			if len(names) == 0 {
+				names = []string{""}
+			}
+			for _, name := range names {
+				outcome := auditOutcomeOK
+				if rec.status >= 400 || audit.failed[name] {
+					outcome = auditOutcomeFailed
+				}
+				auditLog(r, &auditEvent{
+					Action:   auditActionAdmin,
+					Outcome:  outcome,
+					SiteName: name,
+					Detail:   endpoint,
+				})
+			}
+		}()
+	}
+
+	switch endpoint {
+	case "premium/create":
+		handleAdminCreatePremiumSite(w, r)
+	case "premium/rename":
+		handleAdminRenamePremiumSite(w, r)
+	case "premium/delete":
+		handleAdminDeletePremiumSite(w, r)
+	case "premium/set-password":
+		handleAdminSetPremiumSitePassword(w, r)
+	case "sites/delete":
+		handleAdminDeleteSites(w, r)
+	case "sites/set-expiry":
+		handleAdminSetSitesExpiry(w, r)
+	case "sites/set-spa":
+		handleAdminSetSitesSPA(w, r)
+	case "sites/make-premium":
+		handleAdminMakeSitesPremium(w, r)
+	case "sites/deploys":
+		handleAdminSiteDeploys(w, r)
+	case "tokens/create":
+		handleAdminCreateAPIToken(w, r)
+	case "tokens/list":
+		handleAdminListAPITokens(w, r)
+	case "tokens/revoke":
+		handleAdminRevokeAPIToken(w, r)
+	case "audit/query":
+		handleAdminQueryAuditLog(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func handleAdminCreatePremiumSite(w http.ResponseWriter, r *http.Request) {
+	name := strings.ToLower(r.FormValue("name"))
+	// in the body so that it doesn't end up in logs
+	pwd := r.PostFormValue("password")
+	if !isValidSiteName(name) {
+		serveBadRequestError(w, r, "Error: invalid site name '%s'\n", name)
+		return
+	}
+	if pwd == "" {
+		serveBadRequestError(w, r, "Error: missing password\n")
+		return
+	}
+	if getSite(name) != nil {
+		serveErrorStatus(w, r, http.StatusConflict, "Error: site '%s' already exists\n", name)
+		return
+	}
+	auditAdminSite(r, name, false)
+	site, err := createPremiumSite(r.Context(), name, pwd, false)
+	if err != nil {
+		serveInternalError(w, r, "handleAdminCreatePremiumSite: createPremiumSite('%s') failed with '%s'\n", name, err)
+		return
+	}
+	logf(r.Context(), logAttrs(logSite(name)), "handleAdminCreatePremiumSite: created")
+	servePremiumSiteResult(w, r, site)
+}
+
+func handleAdminRenamePremiumSite(w http.ResponseWriter, r *http.Request) {
+	site := getPremiumSiteArg(w, r)
+	if site == nil {
+		return
+	}
+	newName := strings.ToLower(r.FormValue("new-name"))
+	if !isValidSiteName(newName) {
+		serveBadRequestError(w, r, "Error: invalid site name '%s'\n", newName)
+		return
+	}
+	if getSite(newName) != nil {
+		serveErrorStatus(w, r, http.StatusConflict, "Error: site '%s' already exists\n", newName)
+		return
+	}
+	auditAdminSite(r, newName, false)
+	newSite, err := renamePremiumSite(r.Context(), site, newName)
+	if err != nil {
+		serveInternalError(w, r, "handleAdminRenamePremiumSite: renamePremiumSite('%s', '%s') failed with '%s'\n", site.name, newName, err)
+		return
+	}
+	logf(r.Context(), logAttrs(logSite(site.name)), "handleAdminRenamePremiumSite: renamed to '%s'", newName)
+	servePremiumSiteResult(w, r, newSite)
+}
+
+func handleAdminDeletePremiumSite(w http.ResponseWriter, r *http.Request) {
+	site := getPremiumSiteArg(w, r)
+	if site == nil {
+		return
+	}
+	// it would be re-created at next start
+	if site.fromEnv {
+		serveErrorStatus(w, r, http.StatusConflict, "Error: site '%s' is defined in INSTA_PREV_SITES, remove it from there first\n", site.name)
+		return
+	}
+	_, err := metaStore.DeleteSite(site.name)
+	if err != nil {
+		serveInternalError(w, r, "handleAdminDeletePremiumSite: metaStore.DeleteSite('%s') failed with '%s'\n", site.name, err)
+		return
+	}
+	deleteSiteFiles(site)
+	logf(r.Context(), logAttrs(logSite(site.name)), "handleAdminDeletePremiumSite: deleted")
+	servePremiumSiteResult(w, r, site)
+}
+
+func handleAdminSetPremiumSitePassword(w http.ResponseWriter, r *http.Request) {
+	site := getPremiumSiteArg(w, r)
+	if site == nil {
+		return
+	}
+	pwd := r.PostFormValue("password")
+	if pwd == "" {
+		serveBadRequestError(w, r, "Error: missing password\n")
+		return
+	}
+	pwdHash, err := hashPassword(pwd)
+	if err != nil {
+		serveInternalError(w, r, "handleAdminSetPremiumSitePassword: hashPassword() failed with '%s'\n", err)
+		return
+	}
+	// cached site is used by other requests
+	newSite := &Site{}
+	*newSite = *site
+	newSite.uploadPasswordHash = pwdHash
+	if err := saveSite(r.Context(), newSite); err != nil {
+		serveInternalError(w, r, "handleAdminSetPremiumSitePassword: saveSite('%s') failed with '%s'\n", site.name, err)
+		return
+	}
+	logf(r.Context(), logAttrs(logSite(site.name)), "handleAdminSetPremiumSitePassword: changed password")
+	servePremiumSiteResult(w, r, newSite)
+}
+
+type adminSiteResult struct {
+	Name      string
+	URL       string
+	IsPremium bool
+	IsSPA     bool
+	ExpiresOn time.Time `json:",omitzero"`
+	// set if the action failed for this site
+	Error string `json:",omitempty"`
+}
+
+func newAdminSiteResult(r *http.Request, site *Site) *adminSiteResult {
+	res := &adminSiteResult{
+		Name:      site.name,
+		URL:       siteURL(r, site),
+		IsPremium: site.isPremium,
+		IsSPA:     site.isSPA,
+	}
+	if !site.isPremium {
+		res.ExpiresOn = siteExpiresOn(site)
+	}
+	return res
+}
+
+func newAdminSiteError(r *http.Request, site *Site, err error) *adminSiteResult {
+	auditAdminSite(r, site.name, true)
+	res := newAdminSiteResult(r, site)
+	res.Error = err.Error()
+	return res
+}
+
+// returns sites with names from ?name= (can be repeated) or serves an error
+func getSitesArg(w http.ResponseWriter, r *http.Request) []*Site {
+	r.ParseForm()
+	names := r.Form["name"]
+	if len(names) == 0 {
+		serveBadRequestError(w, r, "Error: missing name\n")
+		return nil
+	}
+	var res []*Site
+	for _, name := range names {
+		site := getSite(strings.ToLower(name))
+		if site == nil {
+			serveErrorStatus(w, r, http.StatusNotFound, "Error: no site '%s'\n", name)
+			return nil
+		}
+		res = append(res, site)
+	}
+	for _, site := range res {
+		auditAdminSite(r, site.name, false)
+	}
+	return res
+}
+
+// sites/ actions don't stop at the first site that fails, the result
+// for each site has Error set if the action failed for that site
+
+func handleAdminDeleteSites(w http.ResponseWriter, r *http.Request) {
+	sites := getSitesArg(w, r)
+	if sites == nil {
+		return
+	}
+	var res []*adminSiteResult
+	for _, site := range sites {
+		if site.fromEnv {
+			err := fmt.Errorf("site '%s' is defined in INSTA_PREV_SITES, remove it from there first", site.name)
+			res = append(res, newAdminSiteError(r, site, err))
+			continue
+		}
+		deleted, err := metaStore.DeleteSite(site.name)
+		if err != nil {
+			logErrorf(r.Context(), logAttrs(logSite(site.name), logErr(err)), "handleAdminDeleteSites: metaStore.DeleteSite() failed")
+			res = append(res, newAdminSiteError(r, site, err))
+			continue
+		}
+		if deleted {
+			deleteSiteFiles(site)
+		}
+		logf(r.Context(), logAttrs(logSite(site.name)), "handleAdminDeleteSites: deleted")
+		res = append(res, newAdminSiteResult(r, site))
+	}
+	serveJSON(w, r, res)
+}
+
+func handleAdminSetSitesExpiry(w http.ResponseWriter, r *http.Request) {
+	sites := getSitesArg(w, r)
+	if sites == nil {
+		return
+	}
+	var expiresOn time.Time
+	var extend time.Duration
+	if s := r.FormValue("extend"); s != "" {
+		var err error
+		extend, err = time.ParseDuration(s)
+		if err != nil {
+			serveBadRequestError(w, r, "Error: invalid extend '%s', must be duration like 2h or -30m\n", s)
+			return
+		}
+	} else {
+		var ok bool
+		expiresOn, ok = parseExpiration(r.FormValue("expires"))
+		if !ok || expiresOn.IsZero() {
+			serveBadRequestError(w, r, "Error: invalid expires '%s', must be a date like 2030-01-31 or duration like 24h\n", r.FormValue("expires"))
+			return
+		}
+	}
+	var res []*adminSiteResult
+	for _, site := range sites {
+		if site.isPremium {
+			res = append(res, newAdminSiteError(r, site, fmt.Errorf("premium site '%s' doesn't expire", site.name)))
+			continue
+		}
+		// cached site is used by other requests
+		newSite := &Site{}
+		*newSite = *site
+		if extend != 0 {
+			newSite.expiresOn = siteExpiresOn(site).Add(extend)
+		} else {
+			newSite.expiresOn = expiresOn
+		}
+		if err := saveSite(r.Context(), newSite); err != nil {
+			res = append(res, newAdminSiteError(r, site, err))
+			continue
+		}
+		logf(r.Context(), logAttrs(logSite(site.name)), "handleAdminSetSitesExpiry: expires on %s", newSite.expiresOn.Format(time.RFC3339))
+		res = append(res, newAdminSiteResult(r, newSite))
+	}
+	serveJSON(w, r, res)
+}
+
+func handleAdminSetSitesSPA(w http.ResponseWriter, r *http.Request) {
+	sites := getSitesArg(w, r)
+	if sites == nil {
+		return
+	}
+	isSPA, err := strconv.ParseBool(r.FormValue("spa"))
+	if err != nil {
+		serveBadRequestError(w, r, "Error: invalid spa '%s', must be true or false\n", r.FormValue("spa"))
+		return
+	}
+	var res []*adminSiteResult
+	for _, site := range sites {
+		// cached site is used by other requests
+		newSite := &Site{}
+		*newSite = *site
+		newSite.isSPA = isSPA
+		if err := saveSite(r.Context(), newSite); err != nil {
+			res = append(res, newAdminSiteError(r, site, err))
+			continue
+		}
+		res = append(res, newAdminSiteResult(r, newSite))
+	}
+	serveJSON(w, r, res)
+}
+
+func handleAdminMakeSitesPremium(w http.ResponseWriter, r *http.Request) {
+	sites := getSitesArg(w, r)
+	if sites == nil {
+		return
+	}
+	pwd := r.PostFormValue("password")
+	if pwd == "" {
+		serveBadRequestError(w, r, "Error: missing password\n")
+		return
+	}
+	var res []*adminSiteResult
+	for _, site := range sites {
+		if !site.isPremium {
+			newSite, err := makeSitePremium(r.Context(), site, pwd)
+			if err != nil {
+				logErrorf(r.Context(), logAttrs(logSite(site.name), logErr(err)), "handleAdminMakeSitesPremium: makeSitePremium() failed")
+				res = append(res, newAdminSiteError(r, site, err))
+				continue
+			}
+			logf(r.Context(), logAttrs(logSite(site.name)), "handleAdminMakeSitesPremium: made premium")
+			site = newSite
+		}
+		res = append(res, newAdminSiteResult(r, site))
+	}
+	serveJSON(w, r, res)
+}
+
+func handleAdminSiteDeploys(w http.ResponseWriter, r *http.Request) {
+	sites := getSitesArg(w, r)
+	if sites == nil {
+		return
+	}
+	res := []*deployInfo{}
+	for _, site := range sites {
+		deploys, err := metaStore.ListDeploys(site.name)
+		if err != nil {
+			serveInternalError(w, r, "handleAdminSiteDeploys: metaStore.ListDeploys('%s') failed with '%s'\n", site.name, err)
+			return
+		}
+		res = append(res, deploys...)
+	}
+	serveJSON(w, r, res)
+}
+
+// renamePremiumSite updates metaStore and moves files of the site
+func renamePremiumSite(ctx context.Context, site *Site, newName string) (*Site, error) {
+	newSite := &Site{}
+	*newSite = *site
+	newSite.name = newName
+	// new name is not in INSTA_PREV_SITES
+	newSite.fromEnv = false
+	newSite.dir = filepath.Join(getPremiumSitesDir(), newName)
+	newSite.storageID = ""
+	newSite.storage = newSiteStorage(newSite)
+
+	// so that views counted under the old name are not lost
+	flushSiteViewsFor(site.name)
+	newSite.updatedOn = time.Now()
+	// metaStore is updated first because it's easier to undo than moving files
+	if err := metaStore.RenameSite(site.name, siteToMeta(newSite)); err != nil {
+		return nil, err
+	}
+	if err := moveSiteFiles(ctx, site, newSite); err != nil {
+		if err2 := metaStore.RenameSite(newName, siteToMeta(site)); err2 != nil {
+			logErrorf(ctx, logAttrs(logSite(site.name), logErr(err2)), "renamePremiumSite: undoing metaStore.RenameSite() to '%s' failed", newName)
+		}
+		return nil, err
+	}
+	buildSiteFilesIndex(newSite)
+	loadSiteConfig(ctx, newSite)
+	muSites.Lock()
+	newSite.checkedOn = time.Now()
+	sites[newSite.name] = newSite
+	muSites.Unlock()
+	uncacheSite(site.name)
+	closeSiteStorage(site, newSite)
+	return newSite, nil
+}
+
+// moveSiteFiles moves files of src to storage of dst, which has a different
+// dir or storage prefix
+func moveSiteFiles(ctx context.Context, src *Site, dst *Site) error {
+	removeSiteCompressedCache(ctx, src)
+	switch storage := src.storage.(type) {
+	case *diskStorage:
+		if src.dir == dst.dir {
+			// e.g. when premium sites dir is the same as data dir
+			return nil
+		}
+		err := os.Rename(src.dir, dst.dir)
+		if os.IsNotExist(err) {
+			// site without files
+			return nil
+		}
+		if err == nil {
+			return nil
+		}
+		// e.g. data dir and premium sites dir are on different disks
+		logf(ctx, logAttrs(logSite(src.name), logPath(src.dir), logErr(err)), "moveSiteFiles: os.Rename() to '%s' failed, copying", dst.dir)
+	case *zipStorage:
+		if src.dir == dst.dir {
+			dst.storage = src.storage
+			return nil
+		}
+		// the archive stays open for src until closeSiteStorage
+		err := os.Rename(storage.zipPath, siteZipPath(dst))
+		if err != nil {
+			return err
+		}
+		if err = openSiteZip(ctx, dst); err != nil {
+			os.Rename(siteZipPath(dst), storage.zipPath)
+			return err
+		}
+		return nil
+	}
+	err := copySiteFiles(src, dst)
+	if err != nil {
+		// src is unchanged
+		if err2 := dst.storage.RemoveAll(); err2 != nil {
+			logf(ctx, logAttrs(logSite(dst.name), logErr(err2)), "moveSiteFiles: dst.storage.RemoveAll() failed")
+		}
+		return err
+	}
+	// files are already in dst, so we don't fail the move
+	if err = src.storage.RemoveAll(); err != nil {
+		logf(ctx, logAttrs(logSite(src.name), logErr(err)), "moveSiteFiles: src.storage.RemoveAll() failed")
+	}
+	return nil
+}
+
+// closeSiteStorage closes storage of src after moveSiteFiles, when dst
+// replaced src in the cache, so that requests in flight can finish
+func closeSiteStorage(src *Site, dst *Site) {
+	if storage, ok := src.storage.(*zipStorage); ok && src.storage != dst.storage {
+		storage.archive.release()
+	}
+}
+
+// makeSitePremium converts temporary site to premium site, which doesn't expire
+// and is stored in premium sites dir
+func makeSitePremium(ctx context.Context, site *Site, pwd string) (*Site, error) {
+	pwdHash, err := hashPassword(pwd)
+	if err != nil {
+		return nil, err
+	}
+	newSite := &Site{}
+	*newSite = *site
+	newSite.isPremium = true
+	newSite.uploadPasswordHash = pwdHash
+	newSite.expiresOn = time.Time{}
+	newSite.dir = filepath.Join(getPremiumSitesDir(), site.name)
+	newSite.storageID = ""
+	newSite.storage = newSiteStorage(newSite)
+	if err = moveSiteFiles(ctx, site, newSite); err != nil {
+		return nil, err
+	}
+	buildSiteFilesIndex(newSite)
+	loadSiteConfig(ctx, newSite)
+	if err = saveSite(ctx, newSite); err != nil {
+		return nil, err
+	}
+	closeSiteStorage(site, newSite)
+	return newSite, nil
+}
+
+// copySiteFiles copies files of the site to storage of dst
+func copySiteFiles(src *Site, dst *Site) error {
+	for _, f := range src.files {
+		rc, _, err := openSiteFile(src, f)
+		if err != nil {
+			return fmt.Errorf("openSiteFile('%s') failed with '%w'", f.Path, err)
+		}
+		_, err = writeSiteFile(dst, f.Path, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("writeSiteFile('%s') failed with '%w'", f.Path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminPost(uri string, pwd string) *httptest.ResponseRecorder {
+	return adminPostForm(uri, nil, pwd)
+}
+
+// secrets like passwords are sent in the body
+func adminPostForm(uri string, form url.Values, pwd string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", adminAPIPrefix+uri, strings.NewReader(form.Encode()))
+	r.Host = "localhost"
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if pwd != "" {
+		r.Header.Set("Authorization", "Bearer "+pwd)
+	}
+	w := httptest.NewRecorder()
+	handleIndex(w, r)
+	return w
+}
+
+func TestAdminPremiumSites(t *testing.T) {
+	setupTestSite(t, "temp", map[string]string{"index.html": "hello"})
+	premiumSitesDirCached = t.TempDir()
+	sitesPassword = "admin"
+	defer func() {
+		sitesPassword = ""
+	}()
+
+	test := func(uri string, pwd string, expCode int) {
+		w := adminPost(uri, pwd)
+		if w.Code != expCode {
+			t.Fatalf("uri: '%s', exp %d, got %d, body: '%s'\n", uri, expCode, w.Code, w.Body.String())
+		}
+	}
+	testWithPassword := func(uri string, sitePwd string, expCode int) {
+		w := adminPostForm(uri, url.Values{"password": {sitePwd}}, "admin")
+		if w.Code != expCode {
+			t.Fatalf("uri: '%s', exp %d, got %d, body: '%s'\n", uri, expCode, w.Code, w.Body.String())
+		}
+	}
+	test("premium/create?name=foo", "", 401)
+	test("premium/create?name=foo", "wrong", 401)
+	testWithPassword("premium/create?name=Foo.bar", "x", 400)
+	testWithPassword("premium/create?name=temp", "x", 409)
+	// password in url is not accepted
+	test("premium/create?name=foo&password=x", "admin", 400)
+	testWithPassword("premium/create?name=foo", "x", 200)
+
+	site := getSite("foo")
+	if site == nil || !site.isPremium || !checkPasswordHash(site.uploadPasswordHash, "x") {
+		t.Fatalf("exp premium site 'foo'\n")
+	}
+	_, err := writeSiteFile(site, "index.html", strings.NewReader("hello"))
+	must(err)
+	site.files = append(site.files, &siteFile{Path: "index.html", Size: 5})
+	must(saveSite(ctx(), site))
+
+	test("premium/set-password?name=foo&password=y", "admin", 400)
+	testWithPassword("premium/set-password?name=foo", "y", 200)
+	if !checkPasswordHash(getSite("foo").uploadPasswordHash, "y") {
+		t.Fatalf("exp password to change\n")
+	}
+	test("premium/rename?name=temp&new-name=bar", "admin", 404)
+	test("premium/rename?name=foo&new-name=bar", "admin", 200)
+	if getSite("foo") != nil {
+		t.Fatalf("exp site 'foo' to be renamed\n")
+	}
+	site = getSite("bar")
+	if site == nil || !checkPasswordHash(site.uploadPasswordHash, "y") {
+		t.Fatalf("exp site 'bar' with password 'y'\n")
+	}
+	d, err := readSiteFile(site, findSiteFile(site, "index.html"))
+	if err != nil || string(d) != "hello" {
+		t.Fatalf("exp 'hello' in renamed site, got '%s', err: '%v'\n", d, err)
+	}
+	test("premium/delete?name=bar", "admin", 200)
+	if getSite("bar") != nil {
+		t.Fatalf("exp site 'bar' to be deleted\n")
+	}
+}
+
+func TestAdminSiteActions(t *testing.T) {
+	setupTestSite(t, "foo", map[string]string{"index.html": "hello"})
+	bar := &Site{name: "bar", storage: newMemStorage(), createdOn: time.Now()}
+	must(saveSite(ctx(), bar))
+	must(metaStore.AddDeploy(&deployInfo{SiteName: "bar", IP: "1.2.3.4", UserAgent: "curl"}))
+	premiumSitesDirCached = t.TempDir()
+	sitesPassword = "admin"
+	defer func() {
+		sitesPassword = ""
+	}()
+
+	test := func(uri string, expCode int) string {
+		w := adminPost(uri, "admin")
+		if w.Code != expCode {
+			t.Fatalf("uri: '%s', exp %d, got %d, body: '%s'\n", uri, expCode, w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+	prev := getSite("foo")
+	test("sites/set-spa?name=foo&name=bar&spa=true", 200)
+	if !getSite("foo").isSPA || !getSite("bar").isSPA {
+		t.Fatalf("exp both sites to be spa\n")
+	}
+	if prev.isSPA {
+		t.Fatalf("exp site used by other requests not to change\n")
+	}
+	test("sites/set-spa?name=foo&name=missing&spa=false", 404)
+
+	exp := siteExpiresOn(getSite("foo")).Add(2 * time.Hour)
+	test("sites/set-expiry?name=foo&extend=2h", 200)
+	if got := siteExpiresOn(getSite("foo")); !got.Equal(exp) {
+		t.Fatalf("exp expiry %s, got %s\n", exp, got)
+	}
+	test("sites/set-expiry?name=foo&expires=-1h", 400)
+	test("sites/set-expiry?name=foo&extend=-5h", 200)
+	if n := expireSites(); n != 1 || getSite("foo") != nil {
+		t.Fatalf("exp site 'foo' to expire, expired %d\n", n)
+	}
+
+	if body := test("sites/deploys?name=bar", 200); !strings.Contains(body, "1.2.3.4") || !strings.Contains(body, "curl") {
+		t.Fatalf("exp deploy info, got '%s'\n", body)
+	}
+	test("sites/make-premium?name=bar", 400)
+	test("sites/make-premium?name=bar&password=x", 400)
+	if w := adminPostForm("sites/make-premium?name=bar", url.Values{"password": {"x"}}, "admin"); w.Code != 200 {
+		t.Fatalf("exp 200 for make-premium, got %d, body: '%s'\n", w.Code, w.Body.String())
+	}
+	site := getSite("bar")
+	if !site.isPremium || !checkPasswordHash(site.uploadPasswordHash, "x") {
+		t.Fatalf("exp 'bar' to be premium\n")
+	}
+	baz := &Site{name: "baz", storage: newMemStorage(), createdOn: time.Now()}
+	must(saveSite(ctx(), baz))
+	exp = siteExpiresOn(baz).Add(2 * time.Hour)
+	// premium site is skipped, other sites get the new expiry
+	var expiryRes []*adminSiteResult
+	must(json.Unmarshal([]byte(test("sites/set-expiry?name=bar&name=baz&extend=2h", 200)), &expiryRes))
+	if len(expiryRes) != 2 || expiryRes[0].Error == "" || expiryRes[1].Error != "" {
+		t.Fatalf("exp error only for premium site, got %d results\n", len(expiryRes))
+	}
+	if got := siteExpiresOn(getSite("baz")); !got.Equal(exp) {
+		t.Fatalf("exp expiry %s, got %s\n", exp, got)
+	}
+	env := &Site{name: "env", storage: newMemStorage(), isPremium: true, fromEnv: true}
+	must(saveSite(ctx(), env))
+	// one site failing doesn't stop the action for other sites
+	body := test("sites/delete?name=env&name=bar", 200)
+	var res []*adminSiteResult
+	must(json.Unmarshal([]byte(body), &res))
+	if len(res) != 2 || res[0].Error == "" || res[1].Error != "" {
+		t.Fatalf("exp error only for 'env', got '%s'\n", body)
+	}
+	if getSite("bar") != nil || getSite("env") == nil {
+		t.Fatalf("exp 'bar' to be deleted and 'env' to be kept\n")
+	}
+}
+
+// files of a zip site being read while it's renamed can still be read
+func TestRenameZipPremiumSite(t *testing.T) {
+	setupTestSite(t, "temp", map[string]string{"index.html": "hello"})
+	premiumSitesDirCached = t.TempDir()
+	site := openTestSiteZip(t, map[string]string{"index.html": "<html></html>"})
+	site.name = "foo"
+	site.isPremium = true
+	site.keepZip = true
+	buildSiteFilesIndex(site)
+	must(saveSite(ctx(), site))
+	must(metaStore.AddDeploy(&deployInfo{SiteName: "foo"}))
+
+	f, err := site.storage.Open("index.html")
+	must(err)
+	defer f.Close()
+	newSite, err := renamePremiumSite(ctx(), site, "bar")
+	must(err)
+	d, err := io.ReadAll(f)
+	if err != nil || string(d) != "<html></html>" {
+		t.Fatalf("exp to read file opened before rename, got '%s', err: '%v'\n", d, err)
+	}
+	d, err = readSiteFile(newSite, findSiteFile(newSite, "index.html"))
+	if err != nil || string(d) != "<html></html>" {
+		t.Fatalf("exp file in renamed site, got '%s', err: '%v'\n", d, err)
+	}
+	if deploys, _ := metaStore.ListDeploys("bar"); len(deploys) != 1 {
+		t.Fatalf("exp deploys to be kept, got %d\n", len(deploys))
+	}
+}
+
+// when moving files fails, the rename is undone in metaStore
+func TestRenamePremiumSiteMoveFails(t *testing.T) {
+	setupTestSite(t, "temp", map[string]string{"index.html": "hello"})
+	premiumSitesDirCached = t.TempDir()
+	site := openTestSiteZip(t, map[string]string{"index.html": "<html></html>"})
+	site.name = "foo"
+	site.isPremium = true
+	site.keepZip = true
+	buildSiteFilesIndex(site)
+	must(saveSite(ctx(), site))
+	must(metaStore.AddDeploy(&deployInfo{SiteName: "foo"}))
+	// the zip can't be moved over a non-empty directory
+	must(os.MkdirAll(filepath.Join(premiumSitesDirCached, "bar.zip", "x"), 0755))
+
+	if _, err := renamePremiumSite(ctx(), site, "bar"); err == nil {
+		t.Fatalf("exp rename to fail\n")
+	}
+	if m, _ := metaStore.GetSite("bar"); m != nil {
+		t.Fatalf("exp no 'bar' in metaStore\n")
+	}
+	if m, _ := metaStore.GetSite("foo"); m == nil {
+		t.Fatalf("exp 'foo' in metaStore\n")
+	}
+	if deploys, _ := metaStore.ListDeploys("foo"); len(deploys) != 1 {
+		t.Fatalf("exp deploys to be kept, got %d\n", len(deploys))
+	}
+	d, err := readSiteFile(site, findSiteFile(site, "index.html"))
+	if err != nil || string(d) != "<html></html>" {
+		t.Fatalf("exp file in site, got '%s', err: '%v'\n", d, err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// admin console (/sites) uses a session cookie, set after logging in
+// with SITES_PASSWORD at /sites/login. If SITES_PASSWORD is not set,
+// admin console is disabled
+// session cookie is signed so that all instances can verify it and
+// it's invalidated by changing SITES_PASSWORD
+// requests that change things must also send CSRF token (from a cookie
+// readable by JavaScript) in X-CSRF-Token header or csrf form value
+
+const (
+	adminLoginPath  = "/sites/login"
+	adminLogoutPath = "/sites/logout"
+
+	adminSessionCookie   = "instaprev_admin"
+	adminCSRFCookie      = "instaprev_csrf"
+	adminSessionDuration = 24 * time.Hour
+)
+
+func isAdminEnabled() bool {
+	return sitesPassword != ""
+}
+
+func adminSessionMAC(s string) string {
+	// key derived from password so that changing it logs out everyone
+	key := sha256.Sum256([]byte("instaprev admin session\x00" + sitesPassword))
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// session is "${expires}.${nonce}.${signature}"
+func newAdminSession() string {
+	expires := time.Now().Add(adminSessionDuration).Unix()
+	s := fmt.Sprintf("%d.%s", expires, generateRandomHex(16))
+	return s + "." + adminSessionMAC(s)
+}
+
+func isValidAdminSession(session string) bool {
+	idx := strings.LastIndex(session, ".")
+	if idx < 0 {
+		return false
+	}
+	s, sig := session[:idx], session[idx+1:]
+	if subtle.ConstantTimeCompare([]byte(sig), []byte(adminSessionMAC(s))) != 1 {
+		return false
+	}
+	expiresStr, _, _ := strings.Cut(s, ".")
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	return err == nil && time.Now().Unix() < expires
+}
+
+func adminCSRFToken(session string) string {
+	return adminSessionMAC("csrf:" + session)
+}
+
+// returns session from the cookie or "" if not logged in
+func getAdminSession(r *http.Request) string {
+	if !isAdminEnabled() {
+		return ""
+	}
+	c, err := r.Cookie(adminSessionCookie)
+	if err != nil || !isValidAdminSession(c.Value) {
+		return ""
+	}
+	return c.Value
+}
+
+func hasAdminSession(r *http.Request) bool {
+	return getAdminSession(r) != ""
+}
+
+// hasAdminSessionWithCSRF is for requests that change things
+func hasAdminSessionWithCSRF(r *http.Request) bool {
+	session := getAdminSession(r)
+	if session == "" {
+		return false
+	}
+	token := r.Header.Get("X-CSRF-Token")
+	if token == "" {
+		token = r.PostFormValue("csrf")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminCSRFToken(session))) == 1
+}
+
+func setAdminSessionCookies(w http.ResponseWriter, r *http.Request, session string, maxAge int) {
+	c := &http.Cookie{
+		Name:     adminSessionCookie,
+		Value:    session,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteStrictMode,
+	}
+	http.SetCookie(w, c)
+	csrf := ""
+	if session != "" {
+		csrf = adminCSRFToken(session)
+	}
+	// must be readable by JavaScript
+	c = &http.Cookie{
+		Name:     adminCSRFCookie,
+		Value:    csrf,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteStrictMode,
+	}
+	http.SetCookie(w, c)
+}
+
+// GET  /sites/login
+// POST /sites/login with password=${pwd}
+func handleAdminLogin(w http.ResponseWriter, r *http.Request) {
+	if !isAdminEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Cache-Control", cacheControlNoCache)
+		http.ServeFile(w, r, filepath.Join("www", "adminLogin.html"))
+		return
+	}
+	pwd := r.PostFormValue("password")
+	if subtle.ConstantTimeCompare([]byte(pwd), []byte(sitesPassword)) != 1 {
+		logf(r.Context(), logAttrs(slog.String("ip", getClientIP(r))), "handleAdminLogin: invalid password")
+		auditSite(r, auditActionAdminLogin, auditOutcomeDenied, nil, "")
+		http.Redirect(w, r, adminLoginPath+"?error=1", http.StatusSeeOther)
+		return
+	}
+	logf(r.Context(), logAttrs(slog.String("ip", getClientIP(r))), "handleAdminLogin: logged in")
+	auditSite(r, auditActionAdminLogin, auditOutcomeOK, nil, "")
+	setAdminSessionCookies(w, r, newAdminSession(), int(adminSessionDuration.Seconds()))
+	http.Redirect(w, r, "/sites", http.StatusSeeOther)
+}
+
+// POST /sites/logout
+func handleAdminLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		serveErrorStatus(w, r, http.StatusMethodNotAllowed, "Error: must be POST\n")
+		return
+	}
+	setAdminSessionCookies(w, r, "", -1)
+	http.Redirect(w, r, adminLoginPath, http.StatusSeeOther)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func mainRequest(method string, uri string, body string, cookies []*http.Cookie, hdrs ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, uri, strings.NewReader(body))
+	r.Host = "localhost"
+	if body != "" {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	for i := 0; i < len(hdrs); i += 2 {
+		r.Header.Set(hdrs[i], hdrs[i+1])
+	}
+	w := httptest.NewRecorder()
+	handleIndex(w, r)
+	return w
+}
+
+func TestAdminSession(t *testing.T) {
+	setupTestSite(t, "foo", map[string]string{"index.html": "hello"})
+	sitesPassword = ""
+
+	test := func(w *httptest.ResponseRecorder, expCode int) {
+		t.Helper()
+		if w.Code != expCode {
+			t.Fatalf("exp %d, got %d, body: '%s'\n", expCode, w.Code, w.Body.String())
+		}
+	}
+	// disabled without SITES_PASSWORD
+	test(mainRequest("GET", "/sites", "", nil), 404)
+	test(mainRequest("GET", "/sites/login", "", nil), 404)
+	test(mainRequest("GET", "/__instantpreviewinternal/api/sites.json?pwd=", "", nil), 401)
+
+	sitesPassword = "admin"
+	defer func() {
+		sitesPassword = ""
+	}()
+	test(mainRequest("GET", "/sites?pwd=admin", "", nil), 303)
+	test(mainRequest("GET", "/__instantpreviewinternal/api/sites.json?pwd=admin", "", nil), 401)
+
+	w := mainRequest("POST", "/sites/login", "password=wrong", nil)
+	if len(w.Result().Cookies()) != 0 || !strings.Contains(w.Header().Get("Location"), "error=1") {
+		t.Fatalf("exp no cookies and redirect with error\n")
+	}
+	w = mainRequest("POST", "/sites/login", url.Values{"password": {"admin"}}.Encode(), nil)
+	cookies := w.Result().Cookies()
+	if w.Code != 303 || len(cookies) != 2 {
+		t.Fatalf("exp redirect with 2 cookies, got %d and %d cookies\n", w.Code, len(cookies))
+	}
+	if !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteStrictMode {
+		t.Fatalf("exp http-only, strict session cookie\n")
+	}
+	csrf := cookies[1].Value
+	test(mainRequest("GET", "/sites", "", cookies), 200)
+	w = mainRequest("GET", "/__instantpreviewinternal/api/sites.json", "", cookies)
+	test(w, 200)
+	if !strings.Contains(w.Body.String(), `"foo"`) {
+		t.Fatalf("exp site 'foo' in '%s'\n", w.Body.String())
+	}
+
+	// changing things requires CSRF token
+	uri := adminAPIPrefix + "premium/create?name=bar"
+	test(mainRequest("POST", uri, "password=x", cookies), 401)
+	test(mainRequest("POST", uri, "password=x", cookies, "X-CSRF-Token", "bad"), 401)
+	test(mainRequest("POST", uri, "password=x", cookies, "X-CSRF-Token", csrf), 200)
+
+	// changing password invalidates sessions
+	sitesPassword = "admin2"
+	test(mainRequest("GET", "/sites", "", cookies), 303)
+}
+
+func TestAdminSessionValidation(t *testing.T) {
+	sitesPassword = "admin"
+	defer func() {
+		sitesPassword = ""
+	}()
+	session := newAdminSession()
+	if !isValidAdminSession(session) {
+		t.Fatalf("exp session '%s' to be valid\n", session)
+	}
+	expires, rest, _ := strings.Cut(session, ".")
+	for _, s := range []string{"", "x", rest, "1" + expires + "." + rest, "1." + rest} {
+		if isValidAdminSession(s) {
+			t.Fatalf("exp session '%s' to be invalid\n", s)
+		}
+	}
+}
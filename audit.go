@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// audit log is an append-only file with one JSON event per line
+// records uploads, deletes, failed logins, admin actions and expirations
+// it's in the state dir so that it survives restarts
+// when it grows over maxAuditLogSize it's renamed to audit.log.1, replacing the previous one
+// POST /__instantpreviewinternal/api/admin/audit/query?action=${action}&site=${name}&ip=${ip}&outcome=${outcome}&since=${date or duration}&until=${date}&limit=${n}
+
+const (
+	auditActionUpload     = "upload"
+	auditActionDelete     = "delete"
+	auditActionExpire     = "expire"
+	auditActionSiteLogin  = "site-login"
+	auditActionAdminLogin = "admin-login"
+	auditActionAdmin      = "admin"
+
+	auditOutcomeOK     = "ok"
+	auditOutcomeDenied = "denied"
+	auditOutcomeFailed = "failed"
+
+	auditQueryDefaultLimit = 100
+)
+
+var (
+	muAudit sync.Mutex
+	// unauthenticated requests are logged so the size must be capped
+	// var for tests
+	maxAuditLogSize int64 = 16 * 1024 * 1024
+	// for tests
+	auditLogPathCached string
+)
+
+type auditEvent struct {
+	Time      time.Time
+	Action    string
+	Outcome   string
+	SiteName  string `json:",omitempty"`
+	IP        string `json:",omitempty"`
+	UserAgent string `json:",omitempty"`
+	FileCount int    `json:",omitempty"`
+	TotalSize int64  `json:",omitempty"`
+	// e.g. why it failed or admin api endpoint. Must not contain secrets
+	Detail string `json:",omitempty"`
+}
+
+func getAuditLogPath() string {
+	if auditLogPathCached != "" {
+		return auditLogPathCached
+	}
+	return filepath.Join(getStateDir(), "audit.log")
+}
+
+// audit log files, oldest first
+func getAuditLogPaths() []string {
+	path := getAuditLogPath()
+	return []string{path + ".1", path}
+}
+
+// rotateAuditLogIfNeeded renames audit log if adding n bytes would make it too big
+func rotateAuditLogIfNeeded(path string, n int) {
+	st, err := os.Stat(path)
+	if err != nil || st.Size()+int64(n) <= maxAuditLogSize {
+		return
+	}
+	if err = os.Rename(path, path+".1"); err != nil {
+		logf(ctx(), logAttrs(logPath(path), logErr(err)), "rotateAuditLogIfNeeded: os.Rename() failed")
+	}
+}
+
+// auditLog appends event to the audit log. r is nil for events
+// not caused by a request, like expiring sites
+func auditLog(r *http.Request, e *auditEvent) {
+	e.Time = time.Now()
+	if r != nil {
+		e.IP = getClientIP(r)
+		e.UserAgent = r.UserAgent()
+	}
+	d, err := json.Marshal(e)
+	must(err)
+	d = append(d, '\n')
+
+	muAudit.Lock()
+	defer muAudit.Unlock()
+	path := getAuditLogPath()
+	rotateAuditLogIfNeeded(path, len(d))
+	// O_APPEND so that many instances can write to the same file
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		logf(ctx(), logAttrs(logPath(path), logErr(err)), "auditLog: os.OpenFile() failed")
+		return
+	}
+	_, err = f.Write(d)
+	err2 := f.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		logf(ctx(), logAttrs(logPath(path), logErr(err)), "auditLog: writing failed")
+	}
+}
+
+func auditSite(r *http.Request, action string, outcome string, site *Site, detail string) {
+	e := &auditEvent{
+		Action:  action,
+		Outcome: outcome,
+		Detail:  detail,
+	}
+	if site != nil {
+		e.SiteName = site.name
+		e.FileCount = len(site.files)
+		e.TotalSize = site.totalSize
+	}
+	auditLog(r, e)
+}
+
+type auditFilter struct {
+	Action  string
+	Site    string
+	IP      string
+	Outcome string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+func (f *auditFilter) matches(e *auditEvent) bool {
+	switch {
+	case f.Action != "" && e.Action != f.Action:
+		return false
+	case f.Site != "" && e.SiteName != f.Site:
+		return false
+	case f.IP != "" && e.IP != f.IP:
+		return false
+	case f.Outcome != "" && e.Outcome != f.Outcome:
+		return false
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// queryAuditLog returns events matching the filter, most recent first
+func queryAuditLog(filter *auditFilter) ([]*auditEvent, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = auditQueryDefaultLimit
+	}
+	var res []*auditEvent
+	for _, path := range getAuditLogPaths() {
+		var err error
+		res, err = scanAuditLog(path, filter, limit, res)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(res) > limit {
+		res = res[len(res)-limit:]
+	}
+	slices.Reverse(res)
+	return res, nil
+}
+
+// scanAuditLog appends events from path matching the filter to res,
+// keeping at least limit most recent
+func scanAuditLog(path string, filter *auditFilter, limit int, res []*auditEvent) ([]*auditEvent, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return res, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var e auditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// e.g. partially written line
+			continue
+		}
+		if !filter.matches(&e) {
+			continue
+		}
+		res = append(res, &e)
+		// only keep the most recent
+		if len(res) > 2*limit {
+			res = slices.Clone(res[len(res)-limit:])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func handleAdminQueryAuditLog(w http.ResponseWriter, r *http.Request) {
+	filter := &auditFilter{
+		Action:  r.FormValue("action"),
+		Site:    strings.ToLower(r.FormValue("site")),
+		IP:      r.FormValue("ip"),
+		Outcome: r.FormValue("outcome"),
+	}
+	if s := r.FormValue("since"); s != "" {
+		var ok bool
+		filter.Since, ok = parseAuditTime(s)
+		if !ok {
+			serveBadRequestError(w, r, "Error: invalid since '%s', must be a date like 2030-01-31 or duration like 24h\n", s)
+			return
+		}
+	}
+	if s := r.FormValue("until"); s != "" {
+		var ok bool
+		filter.Until, ok = parseAuditTime(s)
+		if !ok {
+			serveBadRequestError(w, r, "Error: invalid until '%s', must be a date like 2030-01-31 or duration like 24h\n", s)
+			return
+		}
+	}
+	if s := r.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			serveBadRequestError(w, r, "Error: invalid limit '%s'\n", s)
+			return
+		}
+		filter.Limit = n
+	}
+	events, err := queryAuditLog(filter)
+	if err != nil {
+		serveInternalError(w, r, "handleAdminQueryAuditLog: queryAuditLog() failed with '%s'\n", err)
+		return
+	}
+	if events == nil {
+		events = []*auditEvent{}
+	}
+	serveJSON(w, r, events)
+}
+
+// parses time in RFC3339 or "2006-01-02" format or duration in the past e.g. "24h" means 24 hours ago
+func parseAuditTime(s string) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, true
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, true
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return time.Now().Add(-d), true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	site := setupTestSite(t, "foo", map[string]string{"index.html": "hello"})
+	r := httptest.NewRequest("POST", "/upload", nil)
+	r.Header.Set("User-Agent", "curl")
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+	auditSite(r, auditActionUpload, auditOutcomeOK, site, "")
+	auditSite(r, auditActionUpload, auditOutcomeDenied, site, "invalid password")
+	auditSite(nil, auditActionExpire, auditOutcomeOK, site, "")
+
+	d, err := os.ReadFile(getAuditLogPath())
+	must(err)
+	lines := strings.Split(strings.TrimSpace(string(d)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("exp 3 lines, got %d\n", len(lines))
+	}
+	var e auditEvent
+	must(json.Unmarshal([]byte(lines[0]), &e))
+	if e.SiteName != "foo" || e.IP != "1.2.3.4" || e.UserAgent != "curl" || e.FileCount != 1 {
+		t.Fatalf("unexpected event: %+v\n", e)
+	}
+
+	test := func(filter *auditFilter, exp ...string) {
+		t.Helper()
+		events, err := queryAuditLog(filter)
+		must(err)
+		var got []string
+		for _, e := range events {
+			got = append(got, e.Action+":"+e.Outcome)
+		}
+		if strings.Join(got, " ") != strings.Join(exp, " ") {
+			t.Fatalf("filter: %+v, exp %v, got %v\n", filter, exp, got)
+		}
+	}
+	test(&auditFilter{}, "expire:ok", "upload:denied", "upload:ok")
+	test(&auditFilter{Limit: 1}, "expire:ok")
+	test(&auditFilter{Action: auditActionUpload}, "upload:denied", "upload:ok")
+	test(&auditFilter{Outcome: auditOutcomeDenied}, "upload:denied")
+	test(&auditFilter{IP: "1.2.3.4", Limit: 1}, "upload:denied")
+	test(&auditFilter{Site: "bar"})
+	test(&auditFilter{Since: time.Now().Add(time.Hour)})
+}
+
+func TestAuditAdminAPI(t *testing.T) {
+	setupTestSite(t, "foo", map[string]string{"index.html": "hello"})
+	sitesPassword = "admin"
+	defer func() {
+		sitesPassword = ""
+	}()
+	adminPost("sites/set-spa?name=foo&spa=true", "wrong")
+	adminPost("sites/set-spa?name=foo&spa=true", "admin")
+	adminPost("sites/set-spa?name=foo&spa=maybe", "admin")
+	adminPost("audit/query", "admin")
+
+	w := adminPost("audit/query?action=admin&site=foo", "admin")
+	if w.Code != 200 {
+		t.Fatalf("exp 200, got %d\n", w.Code)
+	}
+	var events []*auditEvent
+	must(json.Unmarshal(w.Body.Bytes(), &events))
+	if len(events) != 2 || events[0].Outcome != auditOutcomeFailed || events[1].Outcome != auditOutcomeOK || events[1].Detail != "sites/set-spa" {
+		t.Fatalf("exp failed and ok set-spa events, got %d\n", len(events))
+	}
+	events, _ = queryAuditLog(&auditFilter{Outcome: auditOutcomeDenied})
+	if len(events) != 1 {
+		t.Fatalf("exp 1 denied event, got %d\n", len(events))
+	}
+	if w = adminPost("audit/query?since=yesterday", "admin"); w.Code != 400 {
+		t.Fatalf("exp 400 for invalid since, got %d\n", w.Code)
+	}
+}
+
+func TestAuditAdminSiteNames(t *testing.T) {
+	setupTestSite(t, "foo", map[string]string{"index.html": "hello"})
+	sitesPassword = "admin"
+	defer func() {
+		sitesPassword = ""
+	}()
+	_, err := createPremiumSite(ctx(), "prem", "pwd", false)
+	must(err)
+	adminPost("tokens/create?name=ci&site=prem&scopes=upload", "admin")
+	events, _ := queryAuditLog(&auditFilter{Action: auditActionAdmin})
+	if len(events) != 1 || events[0].SiteName != "prem" || events[0].Outcome != auditOutcomeOK {
+		t.Fatalf("exp tokens/create event for 'prem', got %d events\n", len(events))
+	}
+
+	site := getSite("prem")
+	newSite := &Site{}
+	*newSite = *site
+	newSite.fromEnv = true
+	must(saveSite(ctx(), newSite))
+	adminPost("sites/delete?name=foo&name=prem", "admin")
+	events, _ = queryAuditLog(&auditFilter{Action: auditActionAdmin, Limit: 2})
+	if len(events) != 2 || events[0].SiteName != "prem" || events[0].Outcome != auditOutcomeFailed || events[1].SiteName != "foo" || events[1].Outcome != auditOutcomeOK {
+		t.Fatalf("exp failed delete of 'prem' and ok delete of 'foo', got %d events\n", len(events))
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	setupTestSite(t, "foo", map[string]string{"index.html": "hello"})
+	prev := maxAuditLogSize
+	maxAuditLogSize = 300
+	defer func() {
+		maxAuditLogSize = prev
+	}()
+	for i := 0; i < 10; i++ {
+		auditSite(nil, auditActionExpire, auditOutcomeOK, nil, strconv.Itoa(i))
+	}
+	for _, path := range getAuditLogPaths() {
+		st, err := os.Stat(path)
+		must(err)
+		if st.Size() > maxAuditLogSize {
+			t.Fatalf("exp '%s' to be at most %d bytes, got %d\n", path, maxAuditLogSize, st.Size())
+		}
+	}
+	events, err := queryAuditLog(&auditFilter{Limit: 3})
+	must(err)
+	if len(events) != 3 || events[0].Detail != "9" || events[2].Detail != "7" {
+		t.Fatalf("exp 3 most recent events, got %d events\n", len(events))
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// upload passwords of premium sites are stored as bcrypt hashes
+
+// query parameters with secrets, never logged
+var secretQueryParams = []string{"password", "token", "access-code", "basic-auth"}
+
+func hashPassword(pwd string) (string, error) {
+	d, err := bcrypt.GenerateFromPassword([]byte(pwd), bcrypt.DefaultCost)
+	return string(d), err
+}
+
+// checkPasswordHash compares in constant time
+func checkPasswordHash(pwdHash string, pwd string) bool {
+	if pwdHash == "" || pwd == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(pwdHash), []byte(pwd)) == nil
+}
+
+// getUploadPassword returns password sent with the upload as:
+// Authorization: Bearer ${pwd}
+// Authorization: Basic (any user name and ${pwd} as password)
+// ?password=${pwd}
+func getUploadPassword(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if pwd, ok := strings.CutPrefix(auth, "Bearer "); ok {
+		return strings.TrimSpace(pwd)
+	}
+	if _, pwd, ok := r.BasicAuth(); ok {
+		return pwd
+	}
+	return r.URL.Query().Get("password")
+}
+
+func isValidUploadPassword(site *Site, r *http.Request) bool {
+	return checkPasswordHash(site.uploadPasswordHash, getUploadPassword(r))
+}
+
+// redactURL returns url for logging, with values of secret query parameters removed
+func redactURL(u *url.URL) string {
+	q := u.Query()
+	changed := false
+	for _, name := range secretQueryParams {
+		if q.Has(name) {
+			q.Set(name, "REDACTED")
+			changed = true
+		}
+	}
+	if !changed {
+		return u.String()
+	}
+	u2 := *u
+	u2.RawQuery = q.Encode()
+	return u2.String()
+}
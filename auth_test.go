@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetUploadPassword(t *testing.T) {
+	test := func(uri string, auth string, exp string) {
+		r := httptest.NewRequest("PUT", uri, nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		if got := getUploadPassword(r); got != exp {
+			t.Fatalf("uri: '%s', auth: '%s', exp: '%s', got: '%s'\n", uri, auth, exp, got)
+		}
+	}
+	test("/upload?password=secret", "", "secret")
+	// password must be an exact query parameter
+	test("/upload?secret", "", "")
+	test("/upload?x=secretx", "", "")
+	test("/upload", "Bearer secret", "secret")
+	// "user:secret"
+	test("/upload", "Basic dXNlcjpzZWNyZXQ=", "secret")
+}
+
+func TestCheckPasswordHash(t *testing.T) {
+	pwdHash, err := hashPassword("secret")
+	must(err)
+	if !checkPasswordHash(pwdHash, "secret") {
+		t.Fatalf("exp 'secret' to match\n")
+	}
+	for _, pwd := range []string{"", "secre", "secret2", pwdHash} {
+		if checkPasswordHash(pwdHash, pwd) {
+			t.Fatalf("exp '%s' to not match\n", pwd)
+		}
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	test := func(uri string, exp string) {
+		r := httptest.NewRequest("GET", uri, nil)
+		if got := redactURL(r.URL); got != exp {
+			t.Fatalf("uri: '%s', exp: '%s', got: '%s'\n", uri, exp, got)
+		}
+	}
+	test("/upload?spa", "/upload?spa")
+	test("/upload?password=secret&spa", "/upload?password=REDACTED&spa=")
+	test("/upload?token=abc", "/upload?token=REDACTED")
+}
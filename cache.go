@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	cacheControlNoCache   = "no-cache"
+	cacheControlImmutable = "public, max-age=31536000, immutable"
+	cacheControlShort     = "public, max-age=60"
+	// for our own assets like main.js
+	cacheControlInternal = "public, max-age=3600"
+)
+
+// matches file names with content hash added by bundlers
+// e.g. main.3f2a9c1b.js or index-BkQ2x9aZ.css
+var rxHashedFileName = regexp.MustCompile(`[.-]([A-Za-z0-9_]{8,32})\.[A-Za-z0-9]+$`)
+
+func isHashedFileName(path string) bool {
+	m := rxHashedFileName.FindStringSubmatch(path)
+	if m == nil {
+		return false
+	}
+	// a hash has digits, unlike e.g. "component" in my-component.js
+	return strings.ContainsAny(m[1], "0123456789")
+}
+
+func isHTMLFile(path string) bool {
+	ext := getExt(path)
+	return ext == "html" || ext == "htm"
+}
+
+// default Cache-Control for a file: html must be re-validated,
+// hashed assets never change
+func defaultCacheControl(path string) string {
+	if isHTMLFile(path) {
+		return cacheControlNoCache
+	}
+	if isHashedFileName(path) {
+		return cacheControlImmutable
+	}
+	return cacheControlShort
+}
+
+// returns value of ?cache= upload option which overrides
+// default Cache-Control for all files in the site
+func getCacheControlOption(r *http.Request) string {
+	return strings.TrimSpace(r.URL.Query().Get("cache"))
+}
+
+func sha1HexOfSiteFile(site *Site, sf *siteFile) (string, error) {
+	f, _, err := openSiteFile(site, sf)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha1.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// calculate ETag from content of files, done when publishing the site
+func calcSiteFilesETags(ctx context.Context, site *Site) {
+	for _, f := range site.files {
+		if f.etag != "" {
+			continue
+		}
+		sha1Hex, err := sha1HexOfSiteFile(site, f)
+		if err != nil {
+			logf(ctx, logAttrs(logSite(site.name), logPath(f.Path), logErr(err)), "calcSiteFilesETags: sha1HexOfSiteFile() failed")
+			continue
+		}
+		f.etag = `"` + sha1Hex[:16] + `"`
+	}
+}
+
+// ETag of a compressed version of the file must be different from uncompressed
+func etagForEncoding(etag string, enc string) string {
+	if etag == "" || enc == "" {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + enc + `"`
+}
+
+// set ETag and Cache-Control unless Cache-Control was already set by _headers
+func setSiteFileCacheHeaders(w http.ResponseWriter, site *Site, f *siteFile) {
+	cc := site.cacheControl
+	if cc == "" {
+		cc = defaultCacheControl(f.Path)
+	}
+	setCacheHeaders(w, site, f.etag, cc)
+}
+
+// set ETag and Cache-Control cc unless Cache-Control was already set by _headers
+func setCacheHeaders(w http.ResponseWriter, site *Site, etag string, cc string) {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if w.Header().Get("Cache-Control") != "" {
+		return
+	}
+	if isPrivateSite(site) {
+		// must not be cached by shared caches like CDNs
+		if strings.Contains(cc, "public") {
+			cc = strings.Replace(cc, "public", "private", 1)
+		} else if !strings.Contains(cc, "private") {
+			cc = "private, " + cc
+		}
+	}
+	w.Header().Set("Cache-Control", cc)
+}
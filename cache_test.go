@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsHashedFileName(t *testing.T) {
+	test := func(path string, exp bool) {
+		if got := isHashedFileName(path); got != exp {
+			t.Fatalf("path: '%s', exp: %v, got: %v\n", path, exp, got)
+		}
+	}
+	test("main.3f2a9c1b.js", true)
+	test("assets/index-BkQ2x9aZ.css", true)
+	test("my-component.js", false)
+	test("main.js", false)
+	test("index.html", false)
+}
+
+// creates a published site with files from name => content map
+func setupTestSite(t *testing.T, name string, files map[string]string) *Site {
+	silenceLogs(t)
+	dataDirCached = t.TempDir()
+	auditLogPathCached = filepath.Join(dataDirCached, "audit.log")
+	site := &Site{
+		name:      name,
+		storage:   newMemStorage(),
+		createdOn: time.Now(),
+	}
+	for path, content := range files {
+		_, err := writeSiteFile(site, path, strings.NewReader(content))
+		must(err)
+		f := &siteFile{
+			Path: path,
+			Size: int64(len(content)),
+		}
+		site.files = append(site.files, f)
+	}
+	buildSiteFilesIndex(site)
+	calcSiteFilesETags(ctx(), site)
+	loadSiteConfig(ctx(), site)
+	sites = map[string]*Site{}
+	metaStore = newMemMetadataStore()
+	must(saveSite(ctx(), site))
+	return site
+}
+
+func testGet(site *Site, uri string, hdrs ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", uri, nil)
+	r.Host = site.name + ".localhost"
+	for i := 0; i < len(hdrs); i += 2 {
+		r.Header.Set(hdrs[i], hdrs[i+1])
+	}
+	w := httptest.NewRecorder()
+	handleIndex(w, r)
+	return w
+}
+
+func TestConditionalRequests(t *testing.T) {
+	site := setupTestSite(t, "etagtest", map[string]string{
+		"index.html":             "<html>index</html>",
+		"assets/app.3f2a9c1b.js": strings.Repeat("console.log('hello');\n", 100),
+		"_headers":               "/custom.txt\n  Cache-Control: private\n",
+		"custom.txt":             "custom",
+	})
+
+	w := testGet(site, "/")
+	etag := w.Header().Get("ETag")
+	if w.Code != 200 || etag == "" {
+		t.Fatalf("exp 200 with ETag, got %d, ETag: '%s'\n", w.Code, etag)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != cacheControlNoCache {
+		t.Fatalf("exp Cache-Control '%s', got '%s'\n", cacheControlNoCache, cc)
+	}
+	w = testGet(site, "/", "If-None-Match", etag)
+	if w.Code != 304 {
+		t.Fatalf("exp 304, got %d\n", w.Code)
+	}
+	w = testGet(site, "/", "If-None-Match", `"stale"`)
+	if w.Code != 200 {
+		t.Fatalf("exp 200, got %d\n", w.Code)
+	}
+
+	// compressed response has a different ETag
+	w = testGet(site, "/assets/app.3f2a9c1b.js", "Accept-Encoding", "gzip")
+	etagGz := w.Header().Get("ETag")
+	if w.Header().Get("Content-Encoding") != "gzip" || etagGz == "" {
+		t.Fatalf("exp gzip response with ETag, got headers: %v\n", w.Header())
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != cacheControlImmutable {
+		t.Fatalf("exp Cache-Control '%s', got '%s'\n", cacheControlImmutable, cc)
+	}
+	w = testGet(site, "/assets/app.3f2a9c1b.js", "Accept-Encoding", "gzip", "If-None-Match", etagGz)
+	if w.Code != 304 {
+		t.Fatalf("exp 304, got %d\n", w.Code)
+	}
+	w = testGet(site, "/assets/app.3f2a9c1b.js", "If-None-Match", etagGz)
+	if w.Code != 200 {
+		t.Fatalf("exp 200 for uncompressed with ETag of compressed, got %d\n", w.Code)
+	}
+
+	// _headers overrides default Cache-Control
+	w = testGet(site, "/custom.txt")
+	if cc := w.Header().Get("Cache-Control"); cc != "private" {
+		t.Fatalf("exp Cache-Control 'private', got '%s'\n", cc)
+	}
+}
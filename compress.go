@@ -0,0 +1,237 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	// smaller files are not worth compressing
+	minCompressSize = 512
+)
+
+var (
+	muCompress sync.Mutex
+	// compressions in progress by path of compressed file, closed when done
+	// so that a file is compressed only once and other files don't wait for it
+	compressing = map[string]chan struct{}{}
+)
+
+// text formats that benefit from compression
+var compressibleExt = []string{
+	"html",
+	"htm",
+	"css",
+	"js",
+	"mjs",
+	"json",
+	"map",
+	"xml",
+	"svg",
+	"txt",
+	"md",
+	"csv",
+	"wasm",
+}
+
+func isCompressibleFile(path string) bool {
+	ext := getExt(path)
+	for _, s := range compressibleExt {
+		if ext == s {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsEncoding returns true if Accept-Encoding header lists enc
+// and doesn't disable it with q=0
+func acceptsEncoding(r *http.Request, enc string) bool {
+	for _, s := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(s, ";")
+		if !strings.EqualFold(strings.TrimSpace(parts[0]), enc) {
+			continue
+		}
+		for _, p := range parts[1:] {
+			p = strings.TrimSpace(p)
+			if !strings.HasPrefix(p, "q=") {
+				continue
+			}
+			q, err := strconv.ParseFloat(p[2:], 64)
+			if err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compressed versions of files are cached in a per-site directory
+// outside of site.dir so that they don't show up as site files
+func siteCompressedCacheDir(site *Site) string {
+	return filepath.Join(getDataDir(), "_compressed", siteStorageName(site))
+}
+
+func removeSiteCompressedCache(ctx context.Context, site *Site) {
+	dir := siteCompressedCacheDir(site)
+	if err := os.RemoveAll(dir); err != nil {
+		logf(ctx, logAttrs(logSite(site.name), logPath(dir), logErr(err)), "removeSiteCompressedCache: os.RemoveAll() failed")
+	}
+}
+
+func compressSiteFile(site *Site, f *siteFile, dstPath string, enc string) error {
+	src, _, err := openSiteFile(site, f)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	err = os.MkdirAll(filepath.Dir(dstPath), 0755)
+	if err != nil {
+		return err
+	}
+	// write to temp file so that a partially written file is never served
+	tmpPath := dstPath + ".tmp"
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	// the request waits for compression so we don't use the slowest levels
+	var w io.WriteCloser
+	if enc == "br" {
+		w = brotli.NewWriterLevel(dst, brotli.DefaultCompression)
+	} else {
+		w, _ = gzip.NewWriterLevel(dst, gzip.DefaultCompression)
+	}
+	_, err = io.Copy(w, src)
+	err2 := w.Close()
+	err3 := dst.Close()
+	if err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = err3
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, dstPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// ensureCompressedFile creates compressed file at path unless it already exists
+func ensureCompressedFile(ctx context.Context, site *Site, f *siteFile, path string, enc string) error {
+	for {
+		muCompress.Lock()
+		if pathExists(path) {
+			muCompress.Unlock()
+			return nil
+		}
+		done, inProgress := compressing[path]
+		if !inProgress {
+			done = make(chan struct{})
+			compressing[path] = done
+		}
+		muCompress.Unlock()
+		if inProgress {
+			// if it failed, we'll try ourselves
+			<-done
+			continue
+		}
+		err := compressSiteFile(site, f, path, enc)
+		muCompress.Lock()
+		delete(compressing, path)
+		close(done)
+		muCompress.Unlock()
+		if err == nil {
+			logf(ctx, logAttrs(logSite(site.name), logPath(f.Path)), "ensureCompressedFile: compressed as '%s'", path)
+		}
+		return err
+	}
+}
+
+// openCompressedFile opens a compressed version of the file with a given
+// encoding. Uses uploaded .br / .gz file if present, otherwise compresses
+// and caches the result
+func openCompressedFile(ctx context.Context, site *Site, f *siteFile, enc string) (io.ReadSeekCloser, time.Time, error) {
+	ext := ".gz"
+	if enc == "br" {
+		ext = ".br"
+	}
+	if precompressed := findSiteFile(site, f.Path+ext); precompressed != nil {
+		return openSiteFile(site, precompressed)
+	}
+	path := filepath.Join(siteCompressedCacheDir(site), f.Path+ext)
+	if err := ensureCompressedFile(ctx, site, f, path, enc); err != nil {
+		return nil, time.Time{}, err
+	}
+	fc, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	st, err := fc.Stat()
+	if err != nil {
+		fc.Close()
+		return nil, time.Time{}, err
+	}
+	return fc, st.ModTime(), nil
+}
+
+// serveSiteFileCompressed serves brotli or gzip compressed version of the file
+// if client accepts it. Returns false if nothing was served
+func serveSiteFileCompressed(w http.ResponseWriter, r *http.Request, site *Site, f *siteFile, status int) bool {
+	if !isCompressibleFile(f.Path) {
+		return false
+	}
+	// compressed response differs by Accept-Encoding, even if we don't compress this one
+	w.Header().Add("Vary", "Accept-Encoding")
+	if f.Size < minCompressSize {
+		return false
+	}
+	enc := ""
+	if acceptsEncoding(r, "br") {
+		enc = "br"
+	} else if acceptsEncoding(r, "gzip") {
+		enc = "gzip"
+	} else {
+		return false
+	}
+	fc, modTime, err := openCompressedFile(r.Context(), site, f, enc)
+	if err != nil {
+		logf(r.Context(), logAttrs(logSite(site.name), logPath(f.Path), logErr(err)), "serveSiteFileCompressed: openCompressedFile() failed")
+		return false
+	}
+	defer fc.Close()
+	// must be set because http.ServeContent would sniff compressed data
+	ct := mime.TypeByExtension(filepath.Ext(f.Path))
+	if ct == "" {
+		ct = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Encoding", enc)
+	if etag := w.Header().Get("ETag"); etag != "" {
+		w.Header().Set("ETag", etagForEncoding(etag, enc))
+	}
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		if r.Method != http.MethodHead {
+			io.Copy(w, fc)
+		}
+		return true
+	}
+	http.ServeContent(w, r, f.Path, modTime, fc)
+	return true
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	test := func(hdr string, enc string, exp bool) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", hdr)
+		got := acceptsEncoding(r, enc)
+		if got != exp {
+			t.Fatalf("Accept-Encoding: '%s', enc: '%s', exp: %v, got: %v\n", hdr, enc, exp, got)
+		}
+	}
+	test("gzip, deflate, br", "br", true)
+	test("gzip, deflate, br", "gzip", true)
+	test("gzip;q=0.5", "gzip", true)
+	test("gzip;q=0, br", "gzip", false)
+	test("GZIP", "gzip", true)
+	test("", "gzip", false)
+	test("identity", "br", false)
+}
+
+func compressString(enc string, s string) string {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	if enc == "br" {
+		w = brotli.NewWriter(&buf)
+	} else {
+		w = gzip.NewWriter(&buf)
+	}
+	io.WriteString(w, s)
+	must(w.Close())
+	return buf.String()
+}
+
+func TestServePrecompressedFile(t *testing.T) {
+	js := strings.Repeat("console.log('hello');\n", 100)
+	jsBr := compressString("br", js)
+	jsGz := compressString("gzip", js)
+	site := setupTestSite(t, "precompressed", map[string]string{
+		"index.html": "<html></html>",
+		"app.js":     js,
+		"app.js.br":  jsBr,
+		"app.js.gz":  jsGz,
+	})
+	test := func(acceptEncoding string, expEnc string, expBody string) {
+		w := testGet(site, "/app.js", "Accept-Encoding", acceptEncoding)
+		if got := w.Header().Get("Content-Encoding"); got != expEnc {
+			t.Fatalf("Accept-Encoding: '%s', exp Content-Encoding '%s' got '%s'\n", acceptEncoding, expEnc, got)
+		}
+		if w.Body.String() != expBody {
+			t.Fatalf("Accept-Encoding: '%s', body is not the expected file\n", acceptEncoding)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.Contains(ct, "javascript") {
+			t.Fatalf("exp javascript Content-Type, got '%s'\n", ct)
+		}
+	}
+	test("gzip, br", "br", jsBr)
+	test("gzip", "gzip", jsGz)
+	test("", "", js)
+	// uploaded siblings are used, nothing is compressed on the fly
+	if pathExists(siteCompressedCacheDir(site)) {
+		t.Fatalf("exp no compressed cache dir for precompressed files\n")
+	}
+}
+
+func TestServeCompressedFileCache(t *testing.T) {
+	css := strings.Repeat("body { color: red; }\n", 100)
+	site := setupTestSite(t, "compresscache", map[string]string{
+		"index.html": "<html></html>",
+		"style.css":  css,
+		"small.css":  "body {}",
+	})
+	w := testGet(site, "/style.css", "Accept-Encoding", "gzip")
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("exp Content-Encoding 'gzip' got '%s'\n", got)
+	}
+	gr, err := gzip.NewReader(w.Body)
+	must(err)
+	d, err := io.ReadAll(gr)
+	must(err)
+	if string(d) != css {
+		t.Fatalf("decompressed body doesn't match the file\n")
+	}
+
+	path := filepath.Join(siteCompressedCacheDir(site), "style.css.gz")
+	if !pathExists(path) {
+		t.Fatalf("exp compressed file cached at '%s'\n", path)
+	}
+	// next request is served from the cache
+	cached := compressString("gzip", "from cache")
+	must(os.WriteFile(path, []byte(cached), 0644))
+	w = testGet(site, "/style.css", "Accept-Encoding", "gzip")
+	if w.Body.String() != cached {
+		t.Fatalf("exp response from the cached file\n")
+	}
+
+	w = testGet(site, "/small.css", "Accept-Encoding", "gzip")
+	if got := w.Header().Get("Content-Encoding"); got != "" {
+		t.Fatalf("exp small file not to be compressed, got Content-Encoding '%s'\n", got)
+	}
+}
+
+func TestEnsureCompressedFileConcurrent(t *testing.T) {
+	site := setupTestSite(t, "compressconcurrent", map[string]string{
+		"app.js": strings.Repeat("console.log('hello');\n", 1000),
+	})
+	f := findSiteFile(site, "app.js")
+	path := filepath.Join(siteCompressedCacheDir(site), "app.js.br")
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = ensureCompressedFile(ctx(), site, f, path, "br")
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		must(err)
+	}
+	if !pathExists(path) || len(compressing) != 0 {
+		t.Fatalf("exp compressed file and no compressions in progress\n")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type dirListingEntry struct {
+	Name    string
+	URL     string
+	IsDir   bool
+	SizeStr string
+}
+
+// returns true if toFind is a directory with files in the site
+// "" is the root directory
+func isSiteDir(site *Site, toFind string) bool {
+	dir := strings.Trim(toFind, "/")
+	return dir == "" || site.dirs[dir]
+}
+
+// immediate children of dir, directories first
+func getDirListingEntries(site *Site, dir string) []*dirListingEntry {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	var res []*dirListingEntry
+	seenDirs := map[string]bool{}
+	for _, f := range site.files {
+		if !strings.HasPrefix(f.Path, prefix) {
+			continue
+		}
+		rest := f.Path[len(prefix):]
+		if idx := strings.Index(rest, "/"); idx >= 0 {
+			name := rest[:idx]
+			if seenDirs[name] {
+				continue
+			}
+			seenDirs[name] = true
+			e := &dirListingEntry{
+				Name:  name + "/",
+				URL:   url.PathEscape(name) + "/",
+				IsDir: true,
+			}
+			res = append(res, e)
+			continue
+		}
+		e := &dirListingEntry{
+			Name:    rest,
+			URL:     url.PathEscape(rest),
+			SizeStr: formatSize(f.Size),
+		}
+		res = append(res, e)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		e1, e2 := res[i], res[j]
+		if e1.IsDir != e2.IsDir {
+			return e1.IsDir
+		}
+		return strings.ToLower(e1.Name) < strings.ToLower(e2.Name)
+	})
+	return res
+}
+
+// serveDirListing renders a listing of files in a directory of the site
+// used in auto-index mode for directories without index.html
+func serveDirListing(w http.ResponseWriter, r *http.Request, site *Site, toFind string) {
+	dir := strings.Trim(toFind, "/")
+	// relative links in the listing only work if url ends with "/"
+	if dir != "" && !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+	logf(r.Context(), logAttrs(logSite(site.name), logPath(dir)), "serveDirListing")
+	tmpl, err := template.ParseFiles(filepath.Join("www", "dirListing.html"))
+	if err != nil {
+		serveInternalError(w, r, "serveDirListing: template.ParseFiles() failed with '%s'\n", err)
+		return
+	}
+	v := struct {
+		Dir     string
+		Entries []*dirListingEntry
+	}{
+		Dir:     dir,
+		Entries: getDirListingEntries(site, dir),
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", cacheControlNoCache)
+	err = tmpl.Execute(w, v)
+	if err != nil {
+		logf(r.Context(), logAttrs(logErr(err)), "serveDirListing: tmpl.Execute() failed")
+	}
+}
+
+// toggle auto-index mode
+// GET /__instantpreviewinternal/api/toggle-autoindex
+func handleAPIToggleAutoIndex(w http.ResponseWriter, r *http.Request, site *Site) {
+	// cached site is used by other requests
+	newSite := &Site{}
+	*newSite = *site
+	newSite.autoIndex = !site.autoIndex
+	saveSite(r.Context(), newSite)
+
+	redirectURL := r.Header.Get("referer")
+	if redirectURL == "" {
+		redirectURL = "/_dir"
+	}
+	http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
+}
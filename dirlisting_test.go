@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGetDirListingEntries(t *testing.T) {
+	site := &Site{}
+	for _, path := range []string{"index.html", "docs/b.txt", "docs/A.txt", "docs/sub/c.txt", "docs/sub/deep/d.txt"} {
+		site.files = append(site.files, &siteFile{Path: path})
+	}
+	buildSiteFilesIndex(site)
+	if !isSiteDir(site, "docs/sub/deep/") || isSiteDir(site, "docs/b.txt") || isSiteDir(site, "nope") {
+		t.Fatalf("unexpected dirs: %v\n", site.dirs)
+	}
+	entries := getDirListingEntries(site, "docs")
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Name)
+	}
+	exp := []string{"sub/", "A.txt", "b.txt"}
+	if len(got) != len(exp) {
+		t.Fatalf("exp: %v, got: %v\n", exp, got)
+	}
+	for i := range exp {
+		if got[i] != exp[i] {
+			t.Fatalf("exp: %v, got: %v\n", exp, got)
+		}
+	}
+}
+
+func TestToggleAutoIndexChangesCopy(t *testing.T) {
+	site := setupTestSite(t, "toggleindex", map[string]string{"docs/a.txt": "a"})
+	testGet(site, "/__instantpreviewinternal/api/toggle-autoindex")
+	// requests in flight might be using the cached site
+	if site.autoIndex {
+		t.Fatalf("exp cached site not to change\n")
+	}
+	if got := getSite("toggleindex"); !got.autoIndex {
+		t.Fatalf("exp auto-index to be on\n")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// a path pattern from Netlify-compatible _headers file
+// and headers to set for paths matching it
+type headerRule struct {
+	pattern string
+	headers http.Header
+}
+
+// matchPathPattern matches url path against Netlify-style pattern
+// "*" as the last segment matches the rest of the path (can be empty)
+// ":name" matches a single path segment
+// returns values of placeholders, "splat" is the value matched by "*"
+func matchPathPattern(pattern string, path string) (map[string]string, bool) {
+	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(pathParts) == 1 && pathParts[0] == "" {
+		pathParts = nil
+	}
+	if len(patternParts) == 1 && patternParts[0] == "" {
+		patternParts = nil
+	}
+	var res map[string]string
+	set := func(k, v string) {
+		if res == nil {
+			res = map[string]string{}
+		}
+		res[k] = v
+	}
+	for i, p := range patternParts {
+		if p == "*" && i == len(patternParts)-1 {
+			set("splat", strings.Join(pathParts[i:], "/"))
+			return res, true
+		}
+		if i >= len(pathParts) {
+			return nil, false
+		}
+		if strings.HasPrefix(p, ":") && len(p) > 1 {
+			set(p[1:], pathParts[i])
+			continue
+		}
+		if p != pathParts[i] {
+			return nil, false
+		}
+	}
+	if len(patternParts) != len(pathParts) {
+		return nil, false
+	}
+	return res, true
+}
+
+// parseHeadersFile parses Netlify-compatible _headers file:
+//
+//	/path/*
+//	  Header-Name: value
+//
+// returns rules and a description of each invalid line
+func parseHeadersFile(d []byte) ([]*headerRule, []string) {
+	var rules []*headerRule
+	var errors []string
+	var curr *headerRule
+	addError := func(lineNo int, format string, args ...interface{}) {
+		s := fmt.Sprintf("_headers: line %d: ", lineNo) + fmt.Sprintf(format, args...)
+		errors = append(errors, s)
+	}
+	d = normalizeNewlines(d)
+	lines := strings.Split(string(d), "\n")
+	for i, l := range lines {
+		lineNo := i + 1
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		if strings.HasPrefix(l, "/") {
+			curr = &headerRule{
+				pattern: l,
+				headers: http.Header{},
+			}
+			rules = append(rules, curr)
+			continue
+		}
+		if curr == nil {
+			addError(lineNo, "header '%s' before path pattern", l)
+			continue
+		}
+		idx := strings.Index(l, ":")
+		if idx <= 0 {
+			addError(lineNo, "invalid header '%s', expected 'Name: value'", l)
+			continue
+		}
+		name := strings.TrimSpace(l[:idx])
+		val := strings.TrimSpace(l[idx+1:])
+		if strings.ContainsAny(name, " \t") {
+			addError(lineNo, "invalid header name '%s'", name)
+			continue
+		}
+		curr.headers.Add(name, val)
+	}
+
+	// skip rules without headers
+	var res []*headerRule
+	for _, rule := range rules {
+		if len(rule.headers) == 0 {
+			errors = append(errors, fmt.Sprintf("_headers: path '%s' has no headers", rule.pattern))
+			continue
+		}
+		res = append(res, rule)
+	}
+	return res, errors
+}
+
+// set headers from site's _headers file that match path
+func applySiteHeaders(w http.ResponseWriter, site *Site, path string) {
+	for _, rule := range site.headers {
+		if _, ok := matchPathPattern(rule.pattern, path); !ok {
+			continue
+		}
+		for name, vals := range rule.headers {
+			w.Header()[name] = append([]string(nil), vals...)
+		}
+	}
+}
+
+func loadHeadersConfig(site *Site) []string {
+	site.headers = nil
+	f := findSiteFile(site, "_headers")
+	if f == nil {
+		return nil
+	}
+	d, err := readSiteFile(site, f)
+	if err != nil {
+		return []string{fmt.Sprintf("_headers: failed to read: %s", err)}
+	}
+	var errors []string
+	site.headers, errors = parseHeadersFile(d)
+	return errors
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMatchPathPattern(t *testing.T) {
+	test := func(pattern, path string, expMatch bool, expSplat string) {
+		vals, ok := matchPathPattern(pattern, path)
+		if ok != expMatch {
+			t.Fatalf("pattern: '%s', path: '%s', exp match: %v, got: %v\n", pattern, path, expMatch, ok)
+		}
+		if vals["splat"] != expSplat {
+			t.Fatalf("pattern: '%s', path: '%s', exp splat: '%s', got: '%s'\n", pattern, path, expSplat, vals["splat"])
+		}
+	}
+	test("/*", "/", true, "")
+	test("/*", "/foo/bar.js", true, "foo/bar.js")
+	test("/", "/", true, "")
+	test("/", "/foo", false, "")
+	test("/foo", "/foo/", true, "")
+	test("/foo/*", "/foo", true, "")
+	test("/foo/*", "/bar/x", false, "")
+	test("/blog/:year/*", "/blog/2022/a/b", true, "a/b")
+	test("/blog/:year", "/blog", false, "")
+
+	vals, _ := matchPathPattern("/blog/:year/:slug", "/blog/2022/hello")
+	if vals["year"] != "2022" || vals["slug"] != "hello" {
+		t.Fatalf("unexpected placeholders: %v\n", vals)
+	}
+}
+
+func TestParseHeadersFile(t *testing.T) {
+	s := `# comment
+/*
+  X-Frame-Options: DENY
+  Cache-Control: no-cache
+X-Bad
+/empty
+/wasm/*
+  Cross-Origin-Opener-Policy: same-origin
+`
+	rules, errors := parseHeadersFile([]byte(s))
+	if len(rules) != 2 {
+		t.Fatalf("exp 2 rules, got %d\n", len(rules))
+	}
+	if len(errors) != 2 {
+		t.Fatalf("exp 2 errors, got %v\n", errors)
+	}
+	if rules[0].headers.Get("Cache-Control") != "no-cache" {
+		t.Fatalf("unexpected headers: %v\n", rules[0].headers)
+	}
+	if rules[1].pattern != "/wasm/*" {
+		t.Fatalf("unexpected pattern: '%s'\n", rules[1].pattern)
+	}
+}
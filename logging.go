@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// logging uses log/slog
+// LOG_FORMAT=json for JSON output, text by default
+// LOG_LEVEL=debug|info|warn|error, info by default
+// each request gets an id (from X-Request-ID header or random),
+// logged as request_id with every line logged with r.Context()
+// slog.Attr args are logged as attributes, not formatted into the message,
+// e.g. logf(ctx, logAttrs(logSite(name), logErr(err)), "saveSite: metaStore.PutSite() failed")
+
+type contextKey int
+
+const requestIDKey contextKey = 0
+
+var (
+	logLevel = new(slog.LevelVar)
+	logger   = slog.New(slog.NewTextHandler(stdoutWriter{}, &slog.HandlerOptions{Level: logLevel}))
+
+	// we accept request ids from proxies if they look sane
+	rxRequestID = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+)
+
+// writes to current os.Stdout, which tests can redirect
+type stdoutWriter struct{}
+
+func (stdoutWriter) Write(d []byte) (int, error) {
+	return os.Stdout.Write(d)
+}
+
+func initLogging() {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), "json") {
+		logger = slog.New(slog.NewJSONHandler(stdoutWriter{}, opts))
+	} else {
+		logger = slog.New(slog.NewTextHandler(stdoutWriter{}, opts))
+	}
+	if s := os.Getenv("LOG_LEVEL"); s != "" {
+		if err := logLevel.UnmarshalText([]byte(s)); err != nil {
+			logf(ctx(), logAttrs(slog.String("level", s)), "initLogging: invalid LOG_LEVEL")
+		}
+	}
+}
+
+func logAt(ctx context.Context, level slog.Level, attrs []slog.Attr, format string, args ...interface{}) {
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	if id := getRequestID(ctx); id != "" {
+		attrs = append([]slog.Attr{slog.String("request_id", id)}, attrs...)
+	}
+	s := format
+	if len(args) > 0 {
+		s = fmt.Sprintf(format, args...)
+	}
+	logger.LogAttrs(ctx, level, s, attrs...)
+}
+
+// attributes logged by many functions, so that they're named the same
+
+func logSite(name string) slog.Attr {
+	return slog.String("site", name)
+}
+
+// path of a file in a site or on disk
+func logPath(path string) slog.Attr {
+	return slog.String("path", path)
+}
+
+func logErr(err error) slog.Attr {
+	return slog.Any("error", err)
+}
+
+// logAttrs returns attributes for logf, logDebugf and logErrorf
+func logAttrs(attrs ...slog.Attr) []slog.Attr {
+	return attrs
+}
+
+func logf(ctx context.Context, attrs []slog.Attr, format string, args ...interface{}) {
+	logAt(ctx, slog.LevelInfo, attrs, format, args...)
+}
+
+// for per-request details, not shown by default
+func logDebugf(ctx context.Context, attrs []slog.Attr, format string, args ...interface{}) {
+	logAt(ctx, slog.LevelDebug, attrs, format, args...)
+}
+
+func logErrorf(ctx context.Context, attrs []slog.Attr, format string, args ...interface{}) {
+	logAt(ctx, slog.LevelError, attrs, format, args...)
+}
+
+func getRequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// withRequestID adds request id to request's context and X-Request-ID response header
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !rxRequestID.MatchString(id) {
+			id = generateRandomHex(8)
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithRequestID(t *testing.T) {
+	var gotID string
+	h := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotID = getRequestID(r.Context())
+	}))
+	test := func(hdr string, expSame bool) {
+		r := httptest.NewRequest("GET", "/", nil)
+		if hdr != "" {
+			r.Header.Set("X-Request-ID", hdr)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if gotID == "" || w.Header().Get("X-Request-ID") != gotID {
+			t.Fatalf("exp request id in context and header, got '%s' and '%s'\n", gotID, w.Header().Get("X-Request-ID"))
+		}
+		if (gotID == hdr) != expSame {
+			t.Fatalf("hdr: '%s', got id '%s'\n", hdr, gotID)
+		}
+	}
+	test("", false)
+	test("abc-123", true)
+	test("bad id\nwith newline", false)
+}
+
+func TestLogLevels(t *testing.T) {
+	var buf bytes.Buffer
+	prev := logger
+	logger = slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: logLevel}))
+	defer func() {
+		logger = prev
+	}()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logDebugf(r.Context(), nil, "debug line")
+		logf(r.Context(), logAttrs(logSite("foo"), logErr(errors.New("oops"))), "info %d", 1)
+	})).ServeHTTP(httptest.NewRecorder(), r)
+
+	var v struct {
+		Level     string
+		Msg       string
+		RequestID string `json:"request_id"`
+		Site      string
+		Error     string
+	}
+	must(json.Unmarshal(buf.Bytes(), &v))
+	if v.Level != "INFO" || v.Msg != "info 1" || v.RequestID == "" {
+		t.Fatalf("exp only info line with request id, got '%s'\n", buf.String())
+	}
+	if v.Site != "foo" || v.Error != "oops" {
+		t.Fatalf("exp site and error attributes, got '%s'\n", buf.String())
+	}
+}
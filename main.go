@@ -2,14 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/fs"
+	"mime"
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
 	"runtime/debug"
 	"strings"
@@ -25,8 +28,8 @@ const (
 type siteFile struct {
 	Path       string
 	Size       int64
-	pathOnDisk string
 	pathInForm string
+	etag       string // hash of content, calculated when publishing
 }
 
 // describes a single website
@@ -35,16 +38,88 @@ type Site struct {
 	// where files are stored
 	// ${dataDir}/${name} for temporary sites
 	// ${premiumDataDir}/${premiumName} for premium sites
-	dir       string
+	dir string
+	// files of the site, on disk in dir or in ${dir}.zip, see keepZipFile
+	storage   siteStorage
 	createdOn time.Time
+	// when last saved in metaStore and when this instance last checked it's
+	// still current, see getSite
+	updatedOn time.Time
+	checkedOn time.Time
+	// when temporary site expires, if zero it's createdOn + timeTwoHours
+	expiresOn time.Time
 	totalSize int64
 	files     []*siteFile
 	isSPA     bool
 	isPremium bool
+	// premium site defined in INSTA_PREV_SITES, see importPremiumSites
+	fromEnv bool
 
 	// premium sites are hosted on their own subdomains
-	// and need a password to upload
-	uploadPassword string
+	// and need a password to upload, we only store its bcrypt hash
+	uploadPasswordHash string
+
+	// private sites need basic auth or access code, one of accessMode* values
+	accessMode string
+	// user name for basic auth
+	accessUser string
+	// bcrypt hash of basic auth password or access code
+	accessHash string
+
+	// rules from _headers file
+	headers []*headerRule
+	// rules from _redirects file
+	redirects []*redirectRule
+	// proxy rules provided with ?proxy= when uploading
+	proxyOptions []string
+	// what to serve for missing paths, one of notFound* values
+	notFound string
+	// overrides default Cache-Control for all files, from ?cache= upload option
+	cacheControl string
+	// show listing of files for directories without index.html
+	autoIndex bool
+	// serve files from uploaded zip file instead of unpacking it
+	keepZip bool
+	// set when files were re-uploaded to a new location, see useNewSiteStorage
+	storageID string
+
+	// index of files by Path, built by buildSiteFilesIndex when publishing
+	filesByPath map[string]*siteFile
+	// all directories that have files, e.g. "foo" and "foo/bar" for "foo/bar/x.txt"
+	dirs map[string]bool
+}
+
+// must be called after changing site.files
+func buildSiteFilesIndex(site *Site) {
+	m := make(map[string]*siteFile, len(site.files))
+	dirs := map[string]bool{}
+	for _, f := range site.files {
+		// if there are multiple files with the same path we use first
+		if _, ok := m[f.Path]; !ok {
+			m[f.Path] = f
+		}
+		for dir := path.Dir(f.Path); dir != "." && !dirs[dir]; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	site.filesByPath = m
+	site.dirs = dirs
+}
+
+func findSiteFile(site *Site, path string) *siteFile {
+	return site.filesByPath[path]
+}
+
+// loadSiteConfig parses configuration files (_headers, _redirects) uploaded with the site
+// returns list of problems with configuration files
+func loadSiteConfig(ctx context.Context, site *Site) []string {
+	var errors []string
+	errors = append(errors, loadHeadersConfig(site)...)
+	errors = append(errors, loadRedirectsConfig(site)...)
+	for _, s := range errors {
+		logf(ctx, logAttrs(logSite(site.name)), "loadSiteConfig: %s", s)
+	}
+	return errors
 }
 
 func siteURL(r *http.Request, s *Site) string {
@@ -63,11 +138,12 @@ func siteURL(r *http.Request, s *Site) string {
 
 var (
 	flgHTTPPort           = 5550
-	sites                 []*Site
-	muSites               sync.Mutex
+	sites                 = map[string]*Site{} // site.name => site
+	muSites               sync.RWMutex
 	dataDirCached         string
 	premiumSitesDirCached string
-	sitesPassword         string // preotects /sites url
+	stateDirCached        string
+	sitesPassword         string // protects /sites url and admin api
 )
 
 func getSiteFilesFromDir(dir string) ([]*siteFile, int64) {
@@ -81,11 +157,10 @@ func getSiteFilesFromDir(dir string) ([]*siteFile, int64) {
 		if err != nil {
 			return err
 		}
-		name := path[len(dir)+1:]
+		name := filepath.ToSlash(path[len(dir)+1:])
 		site := &siteFile{
 			Path:       name,
 			Size:       i.Size(),
-			pathOnDisk: path,
 			pathInForm: name,
 		}
 		res = append(res, site)
@@ -95,63 +170,197 @@ func getSiteFilesFromDir(dir string) ([]*siteFile, int64) {
 	return res, totalSize
 }
 
-// for now we store premium sites in an env variable INSTA_PREV_SITES
-// in the format:
+type premiumSiteDef struct {
+	name string
+	pwd  string
+}
+
+// parses premium site definitions in the format:
 // site1,password1
 // site2,password2
-func parsePremiumSites() {
-	logf(ctx(), "parsePremiumsSites:\n")
-
-	parseSites := func(d []byte) {
-		d = normalizeNewlines(d)
-		s := string(d)
-		lines := strings.Split(s, "\n")
-		for _, l := range lines {
-			l = strings.TrimSpace(l)
-			if l == "" {
-				continue
-			}
-			parts := strings.Split(l, ",")
-			if len(parts) != 2 {
-				logf(ctx(), "parsePremiumsSites: invalid line '%s'\n", l)
-				continue
+func parsePremiumSiteDefs(d []byte) []premiumSiteDef {
+	var res []premiumSiteDef
+	d = normalizeNewlines(d)
+	lines := strings.Split(string(d), "\n")
+	for _, l := range lines {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		parts := strings.Split(l, ",")
+		if len(parts) != 2 {
+			logf(ctx(), nil, "parsePremiumSiteDefs: invalid line '%s'", l)
+			continue
+		}
+		// TODO: sanitize name to be url and dir name compatible
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		pwd := strings.TrimSpace(parts[1])
+		if len(name) == 0 || len(pwd) == 0 {
+			logf(ctx(), nil, "parsePremiumSiteDefs: invalid line '%s'", l)
+			continue
+		}
+		res = append(res, premiumSiteDef{name: name, pwd: pwd})
+	}
+	return res
+}
+
+// createPremiumSite adds a premium site to metaStore, with files
+// already in its storage
+func createPremiumSite(ctx context.Context, name string, pwd string, fromEnv bool) (*Site, error) {
+	pwdHash, err := hashPassword(pwd)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(getPremiumSitesDir(), name)
+	site := &Site{
+		name:               name,
+		uploadPasswordHash: pwdHash,
+		dir:                dir,
+		createdOn:          time.Now(),
+		isPremium:          true,
+		fromEnv:            fromEnv,
+		isSPA:              true,
+	}
+	site.storage = newSiteStorage(site)
+	files, totalSize, err := listStorageFiles(site.storage)
+	if err != nil {
+		logf(ctx, logAttrs(logSite(name), logErr(err)), "createPremiumSite: listStorageFiles() failed")
+	}
+	site.files = files
+	site.totalSize = totalSize
+	st, err := os.Lstat(dir)
+	if err == nil {
+		site.createdOn = st.ModTime()
+	}
+	// site uploaded with ?keepzip
+	if pathExists(siteZipPath(site)) {
+		site.keepZip = true
+		openSiteZip(ctx, site)
+	}
+	buildSiteFilesIndex(site)
+	calcSiteFilesETags(ctx, site)
+	loadSiteConfig(ctx, site)
+	logf(ctx, logAttrs(logSite(name)), "createPremiumSite: %d files, totalSize: %s", len(site.files), formatSize(site.totalSize))
+	return site, saveSite(ctx, site)
+}
+
+// premium sites are stored in metaStore. Sites defined in env variable
+// INSTA_PREV_SITES or /etc/secrets/premium_sites.txt are added to metaStore
+// and their passwords are updated if changed
+func importPremiumSites() {
+	d := []byte(os.Getenv("INSTA_PREV_SITES"))
+	// this is on render.com
+	d2, err := os.ReadFile("/etc/secrets/premium_sites.txt")
+	if err == nil {
+		logf(ctx(), nil, "importPremiumSites: parsing from /etc/secrets/premium_sites.txt")
+		d = append(append(d, '\n'), d2...)
+	}
+	importPremiumSiteDefs(parsePremiumSiteDefs(d))
+}
+
+// sites removed from the env are not deleted because that would delete
+// their files. They become regular premium sites, managed with admin api
+func importPremiumSiteDefs(defs []premiumSiteDef) {
+	nImported := 0
+	inEnv := map[string]bool{}
+	for _, def := range defs {
+		inEnv[def.name] = true
+		m, err := metaStore.GetSite(def.name)
+		if err != nil {
+			logf(ctx(), logAttrs(logSite(def.name), logErr(err)), "importPremiumSites: metaStore.GetSite() failed")
+			continue
+		}
+		if m == nil {
+			if _, err = createPremiumSite(ctx(), def.name, def.pwd, true); err == nil {
+				nImported++
 			}
-			// TODO: sanitize name to be url and dir name compatible
-			name := strings.ToLower(strings.TrimSpace(parts[0]))
-			pwd := strings.TrimSpace(parts[1])
-			if len(name) == 0 || len(pwd) == 0 {
-				logf(ctx(), "parsePremiumsSites: invalid line '%s'\n", l)
+			continue
+		}
+		if !m.IsPremium {
+			logf(ctx(), logAttrs(logSite(def.name)), "importPremiumSites: is a temporary site")
+			continue
+		}
+		// hashing is slow so we only do it if password changed
+		pwdChanged := !checkPasswordHash(m.UploadPasswordHash, def.pwd)
+		if !pwdChanged && m.FromEnv {
+			continue
+		}
+		if pwdChanged {
+			m.UploadPasswordHash, err = hashPassword(def.pwd)
+			if err != nil {
+				logf(ctx(), logAttrs(logSite(def.name), logErr(err)), "importPremiumSites: hashPassword() failed")
 				continue
 			}
-			dir := filepath.Join(getPremiumSitesDir(), name)
-			files, totalSize := getSiteFilesFromDir(dir)
-			site := &Site{
-				name:           name,
-				uploadPassword: pwd,
-				dir:            dir,
-				createdOn:      time.Now(),
-				isPremium:      true,
-				totalSize:      totalSize,
-				files:          files,
-				isSPA:          true,
-			}
-			st, err := os.Lstat(dir)
-			if err == nil {
-				site.createdOn = st.ModTime()
-			}
-			logf(ctx(), "parsePremiumsSites: name: %s, upload password: %s, %d files, totalSize: %s\n", name, pwd, len(site.files), formatSize(site.totalSize))
-			sites = append(sites, site)
+			m.UploadPassword = ""
+			logf(ctx(), logAttrs(logSite(def.name)), "importPremiumSites: updated password")
+		}
+		m.FromEnv = true
+		m.UpdatedOn = time.Now()
+		if err = metaStore.PutSite(m); err != nil {
+			logf(ctx(), logAttrs(logSite(def.name), logErr(err)), "importPremiumSites: metaStore.PutSite() failed")
+		}
+	}
+	metas, err := metaStore.ListSites()
+	if err != nil {
+		logf(ctx(), logAttrs(logErr(err)), "importPremiumSites: metaStore.ListSites() failed")
+	}
+	for _, m := range metas {
+		if !m.FromEnv || inEnv[m.Name] {
+			continue
+		}
+		m.FromEnv = false
+		m.UpdatedOn = time.Now()
+		if err = metaStore.PutSite(m); err != nil {
+			logf(ctx(), logAttrs(logSite(m.Name), logErr(err)), "importPremiumSites: metaStore.PutSite() failed")
+			continue
 		}
+		logf(ctx(), logAttrs(logSite(m.Name)), "importPremiumSites: no longer in env, kept as a premium site")
 	}
+	logf(ctx(), nil, "importPremiumSites: imported %d sites", nImported)
+}
 
-	parseSites([]byte(os.Getenv("INSTA_PREV_SITES")))
-	// this is on render.com
-	d, err := os.ReadFile("/etc/secrets/premium_sites.txt")
-	if err == nil {
-		logf(ctx(), "parsePremiumSites: parsing from /etc/secrets/premium_sites.txt\n")
-		parseSites(d)
+// openMetadataStore switches metaStore to SQLite database
+func openMetadataStore() {
+	path := getMetadataDBPath()
+	store, err := openSQLiteMetadataStore(path)
+	must(err)
+	metaStore = store
+	logf(ctx(), nil, "openMetadataStore: using '%s'", path)
+	upgradeUploadPasswords()
+	if s3Bucket != nil {
+		return
+	}
+	deleteStaleSites()
+}
+
+// files of temporary sites on local disk were deleted by getDataDir()
+// the database can be shared with other instances, which have their own
+// data dir, so we only delete sites whose files were in our data dir
+func deleteStaleSites() {
+	dataDir, err := filepath.Abs(getDataDir())
+	if err != nil {
+		logf(ctx(), logAttrs(logErr(err)), "deleteStaleSites: filepath.Abs() failed")
+		return
+	}
+	metas, err := metaStore.ListSites()
+	if err != nil {
+		logf(ctx(), logAttrs(logErr(err)), "deleteStaleSites: metaStore.ListSites() failed")
+		return
+	}
+	nDeleted := 0
+	for _, m := range metas {
+		if m.IsPremium {
+			continue
+		}
+		dir, err := filepath.Abs(m.Dir)
+		if err != nil || filepath.Dir(dir) != dataDir {
+			continue
+		}
+		if deleted, _ := metaStore.DeleteSite(m.Name); deleted {
+			nDeleted++
+		}
 	}
-	logf(ctx(), "parsePremiumSites: loaded %d sites\n", len(sites))
+	logf(ctx(), nil, "deleteStaleSites: deleted %d sites", nDeleted)
 }
 
 func getPremiumSitesDir() string {
@@ -167,6 +376,22 @@ func getPremiumSitesDir() string {
 	return premiumSitesDirCached
 }
 
+// getStateDir returns directory for files that must survive restarts,
+// like the database. Unlike getDataDir() it's not deleted at startup
+func getStateDir() string {
+	if stateDirCached != "" {
+		return stateDirCached
+	}
+	// on render.com
+	if dirExists("/var/data") {
+		stateDirCached = "/var/data"
+	} else {
+		stateDirCached = "state"
+		must(os.MkdirAll(stateDirCached, 0755))
+	}
+	return stateDirCached
+}
+
 func getDataDir() string {
 	if dataDirCached != "" {
 		return dataDirCached
@@ -184,7 +409,7 @@ func serveJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
 		serveInternalError(w, r, "serveJSON: json.Marshal() failed with '%s'\n", err)
 		return
 	}
-	//logf(r.Context(), "serveJSON:\n%s\n", string(d))
+	//logf(r.Context(), nil, "serveJSON:\n%s\n", string(d))
 	var zeroTime time.Time
 	http.ServeContent(w, r, "foo.json", zeroTime, bytes.NewReader(d))
 }
@@ -193,13 +418,19 @@ func serveErrorStatus(w http.ResponseWriter, r *http.Request, status int, s stri
 	if len(args) > 0 {
 		s = fmt.Sprintf(s, args...)
 	}
-	logf(r.Context(), s)
-	w.Header().Set("Content-Type", "text/plain")
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(s)))
-	w.WriteHeader(http.StatusBadRequest)
 	if !strings.HasSuffix(s, "\n") {
 		s = s + "\n"
 	}
+	// messages for the client end with a newline, log lines don't
+	msg := strings.TrimSuffix(s, "\n")
+	if status >= 500 {
+		logErrorf(r.Context(), nil, "%s", msg)
+	} else {
+		logf(r.Context(), nil, "%s", msg)
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(s)))
+	w.WriteHeader(status)
 	io.WriteString(w, s)
 }
 
@@ -217,14 +448,22 @@ func servePlainText(w http.ResponseWriter, r *http.Request, s string) {
 }
 
 type siteFilesResult struct {
-	Files []*siteFile
-	IsSPA bool
+	Files       []*siteFile
+	IsSPA       bool
+	IsAutoIndex bool
+	NotFound    string
+	Views       int64
+	Analytics   *siteAnalytics
 }
 
 // toggle SPA mode
 // GET /__instantpreviewinternal/api/toggle-spa
 func handleAPIToggleSpa(w http.ResponseWriter, r *http.Request, site *Site) {
-	site.isSPA = !site.isSPA
+	// cached site is used by other requests
+	newSite := &Site{}
+	*newSite = *site
+	newSite.isSPA = !site.isSPA
+	saveSite(r.Context(), newSite)
 
 	redirectURL := r.Header.Get("referer")
 	if redirectURL == "" {
@@ -235,26 +474,31 @@ func handleAPIToggleSpa(w http.ResponseWriter, r *http.Request, site *Site) {
 
 // GET /__instantpreviewinternal/api/site-info.json?name=${name}
 func handleAPISiteFiles(w http.ResponseWriter, r *http.Request, site *Site) {
-	logf(ctx(), "handleAPISiteFiles: '%s', site: %s, %d files, premium?: %v\n", r.URL.Path, site.name, len(site.files), site.isPremium)
+	logDebugf(r.Context(), logAttrs(logSite(site.name)), "handleAPISiteFiles: '%s', %d files, premium?: %v", r.URL.Path, len(site.files), site.isPremium)
 	v := &siteFilesResult{
-		Files: site.files,
-		IsSPA: site.isSPA,
+		Files:       site.files,
+		IsSPA:       site.isSPA,
+		IsAutoIndex: site.autoIndex,
+		NotFound:    site.notFound,
+		Analytics:   getSiteAnalytics(r.Context(), site),
 	}
+	v.Views = v.Analytics.Views
 	serveJSON(w, r, v)
 }
 
 // GET /__instantpreviewinternal/api/summary.json
 func handleAPISummary(w http.ResponseWriter, r *http.Request) {
-	logf(r.Context(), "handleAPISummary: '%s'\n", r.URL)
+	logf(r.Context(), nil, "handleAPISummary: '%s'", r.URL)
+	siteStats, err := metaStore.GetSiteStats()
+	if err != nil {
+		serveInternalError(w, r, "handleAPISummary: metaStore.GetSiteStats() failed with '%s'\n", err)
+		return
+	}
 	sitesCount := 0
 	sitesSize := int64(0)
-	{
-		muSites.Lock()
-		sitesCount = len(sites)
-		for _, site := range sites {
-			sitesSize += site.totalSize
-		}
-		muSites.Unlock()
+	for _, st := range siteStats {
+		sitesCount += int(st.Count)
+		sitesSize += st.TotalSize
 	}
 	summary := struct {
 		SitesCount   int
@@ -270,46 +514,57 @@ func handleAPISummary(w http.ResponseWriter, r *http.Request) {
 
 // GET /__instantpreviewinternal/api/sites.json
 func handleAPISites(w http.ResponseWriter, r *http.Request) {
-	pwd := r.URL.Query().Get("pwd")
-	logf(r.Context(), "handleAPISites: '%s', pwd: '%s'\n", r.URL, pwd)
-	if pwd != sitesPassword {
-		logf(r.Context(), "handleAPISites: password in url doesn't match sitesPassword\n")
-		http.NotFound(w, r)
+	if !hasAdminSession(r) && !isAdminRequest(r) {
+		serveErrorStatus(w, r, http.StatusUnauthorized, "Error: not authorized\n")
 		return
 	}
-	var v []interface{}
-	muSites.Lock()
-	for _, site := range sites {
+	lastDeploys, err := metaStore.ListLastDeploys()
+	if err != nil {
+		logf(r.Context(), logAttrs(logErr(err)), "handleAPISites: metaStore.ListLastDeploys() failed")
+	}
+	v := []interface{}{}
+	for _, site := range getSitesSorted() {
 		si := struct {
-			Name      string
-			FileCount int
-			TotalSize int64
-			IsSPA     bool
-			IsPremium bool
-			URL       string
+			Name       string
+			FileCount  int
+			TotalSize  int64
+			IsSPA      bool
+			IsPremium  bool
+			IsPrivate  bool
+			URL        string
+			CreatedOn  time.Time
+			ExpiresOn  time.Time   `json:",omitzero"`
+			LastDeploy *deployInfo `json:",omitempty"`
 		}{
 			Name:      site.name,
 			FileCount: len(site.files),
 			TotalSize: site.totalSize,
 			IsSPA:     site.isSPA,
 			IsPremium: site.isPremium,
+			IsPrivate: isPrivateSite(site),
 			URL:       siteURL(r, site),
+			CreatedOn: site.createdOn,
+		}
+		if !site.isPremium {
+			si.ExpiresOn = siteExpiresOn(site)
 		}
+		si.LastDeploy = lastDeploys[site.name]
 		v = append(v, si)
 	}
-	muSites.Unlock()
 	serveJSON(w, r, v)
 }
 
 // GET /sites
 func handleSites(w http.ResponseWriter, r *http.Request) {
-	pwd := r.URL.Query().Get("pwd")
-	logf(r.Context(), "handleAPISites: '%s', pwd: '%s'\n", r.URL, pwd)
-	if pwd != sitesPassword {
-		logf(r.Context(), "handleAPISites: password in url doesn't match sitesPassword\n")
+	if !isAdminEnabled() {
 		http.NotFound(w, r)
 		return
 	}
+	if !hasAdminSession(r) {
+		http.Redirect(w, r, adminLoginPath, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Cache-Control", cacheControlNoCache)
 	filePath := filepath.Join("www", "listSites.html")
 	http.ServeFile(w, r, filePath)
 }
@@ -317,23 +572,8 @@ func handleSites(w http.ResponseWriter, r *http.Request) {
 func expireSitesLoop() {
 	for {
 		time.Sleep(time.Hour)
-		var newSites []*Site
-		muSites.Lock()
-		nExpired := 0
-		for _, site := range sites {
-			elapsed := time.Since(site.createdOn)
-			// premium sites do not expire
-			if site.isPremium || elapsed < timeTwoHours {
-				newSites = append(newSites, site)
-			} else {
-				os.RemoveAll(site.dir)
-				logf(ctx(), "expired site '%s' and deleted directory '%s'\n", site.name, site.dir)
-				nExpired++
-			}
-		}
-		sites = newSites
-		muSites.Unlock()
-		logf(ctx(), "expireSitesLoop: expired %d sites\n", nExpired)
+		nExpired := expireSites()
+		logf(ctx(), nil, "expireSitesLoop: expired %d sites", nExpired)
 	}
 }
 
@@ -342,34 +582,104 @@ func servePathInSite(w http.ResponseWriter, r *http.Request, site *Site, path st
 	if realPath == "" {
 		// TODO: maybe also add query params etc.
 		newURL := path + "/"
-		logf(r.Context(), "servePathInSite: redirecting '%s' to '%s'\n", path, newURL)
+		logf(r.Context(), logAttrs(logSite(site.name), logPath(path)), "servePathInSite: redirecting to '%s'", newURL)
 		http.Redirect(w, r, newURL, http.StatusTemporaryRedirect) // 307
 		return
 	}
 	toFind := strings.TrimPrefix(realPath, "/")
-	logf(r.Context(), "servePathInSite: toFind: '%s'\n", toFind)
+	logDebugf(r.Context(), logAttrs(logSite(site.name)), "servePathInSite: toFind: '%s'", toFind)
 
 	// in SPA mode or with custom 404.html this is a special url that shows files
 	if toFind == "_dir" {
 		path := filepath.Join("www", "listSiteFiles.html")
-		logf(r.Context(), "servePathInSite: serving '%s'\n", path)
+		logDebugf(r.Context(), logAttrs(logSite(site.name), logPath(path)), "servePathInSite: serving")
 		http.ServeFile(w, r, path)
 		return
 	}
 
-	var fileIndex *siteFile
-	var file404 *siteFile
+	status := http.StatusOK
+	rule, target := findRedirect(site, toFind)
+	if rule != nil {
+		if isProxyRule(rule) {
+			proxyToUpstream(w, r, target)
+			return
+		}
+		if isRedirectStatus(rule.status) {
+			if r.URL.RawQuery != "" && !strings.Contains(target, "?") {
+				target += "?" + r.URL.RawQuery
+			}
+			logf(r.Context(), logAttrs(logSite(site.name), logPath(path)), "servePathInSite: redirecting to '%s' with status %d", target, rule.status)
+			http.Redirect(w, r, target, rule.status)
+			return
+		}
+		// rewrite: serve target without changing the url
+		logf(r.Context(), logAttrs(logSite(site.name), logPath(path)), "servePathInSite: rewriting to '%s' with status %d", target, rule.status)
+		if idx := strings.Index(target, "?"); idx >= 0 {
+			target = target[:idx]
+		}
+		toFind = strings.TrimPrefix(target, "/")
+		status = rule.status
+	}
 
-	for _, f := range site.files {
-		if f.Path == "index.html" {
-			fileIndex = f
-			continue
+	logDebugf(r.Context(), logAttrs(logSite(site.name), logPath(path)), "servePathInSite: rest: '%s', toFind: '%s'", realPath, toFind)
+	file := findFileForPath(site, toFind)
+	if file == nil && site.autoIndex && isSiteDir(site, toFind) {
+		serveDirListing(w, r, site, toFind)
+		return
+	}
+	if file == nil {
+		serveNotFoundInSite(w, r, site, path, toFind)
+		return
+	}
+	logDebugf(r.Context(), logAttrs(logSite(site.name), logPath(file.Path)), "servePathInSite: serving")
+	applySiteHeaders(w, site, path)
+	countSiteView(r, site, file)
+	serveSiteFile(w, r, site, file, status)
+}
+
+// serveSiteFile serves a file from the site, compressed if possible
+func serveSiteFile(w http.ResponseWriter, r *http.Request, site *Site, file *siteFile, status int) {
+	if canShowViewer(r, site, file) {
+		// the same url serves the viewer when navigating to it and the file otherwise
+		w.Header().Add("Vary", "Sec-Fetch-Dest")
+		if wantsViewer(r) {
+			// viewer page changes with our templates, unlike the file
+			setCacheHeaders(w, site, etagForEncoding(file.etag, "view"), cacheControlNoCache)
+			serveViewer(w, r, site, file, status)
+			return
 		}
-		if f.Path == "404.html" {
-			file404 = f
+	}
+	setSiteFileCacheHeaders(w, site, file)
+	if isMarkdownFile(file.Path) && !isRawRequested(r) {
+		// render when navigating to it, fetch() etc. get the file as-is
+		w.Header().Add("Vary", "Sec-Fetch-Dest")
+		if wantsViewer(r) {
+			serveMarkdown(w, r, site, file, status)
+			return
 		}
 	}
+	if serveSiteFileCompressed(w, r, site, file, status) {
+		return
+	}
+	rc, modTime, err := openSiteFile(site, file)
+	if err != nil {
+		serveInternalError(w, r, "serveSiteFile: openSiteFile('%s') failed with '%s'\n", file.Path, err)
+		return
+	}
+	defer rc.Close()
+	if status != http.StatusOK {
+		serveContentWithStatus(w, r, file.Path, rc, status)
+		return
+	}
+	http.ServeContent(w, r, file.Path, modTime, rc)
+}
 
+// findFileForPath finds a file in the site for a path in the url
+// also serves clean urls i.e. "foo" matches "foo.html" and "foo/index.html"
+func findFileForPath(site *Site, toFind string) *siteFile {
+	// README.md is an index for a directory without index.html
+	readme := path.Join(toFind, "README.md")
+	readme2 := path.Join(toFind, "readme.md")
 	if toFind == "" {
 		if len(site.files) == 1 {
 			toFind = site.files[0].Path
@@ -377,43 +687,41 @@ func servePathInSite(w http.ResponseWriter, r *http.Request, site *Site, path st
 			toFind = "index.html"
 		}
 	}
-
-	logf(r.Context(), "servePathInSite: path: '%s', rest: '%s', toFind: '%s', hasIndex: %v, has404: %v\n", path, realPath, toFind, fileIndex != nil, file404 != nil)
 	toFind2 := toFind + ".html"       // also serve clean urls with ".html" stripped off
 	toFind3 := toFind + "/index.html" // also match file "foo/index.html" for "foo" url
 	if strings.HasSuffix(toFind, "/") {
 		// or match foo/index.html file for foo/ url
 		toFind3 = toFind + "index.html"
 	}
-	findFileByPath := func() *siteFile {
-		for _, f := range site.files {
-			switch f.Path {
-			case toFind, toFind2, toFind3:
-				return f
-			}
+	for _, path := range []string{toFind, toFind2, toFind3, readme, readme2} {
+		if f := findSiteFile(site, path); f != nil {
+			return f
 		}
-		return nil
 	}
+	return nil
+}
 
-	file := findFileByPath()
-	if file == nil {
-		if site.isSPA && fileIndex != nil {
-			logf(r.Context(), "serving index.html because '%s' not found and isSPA\n", toFind)
-			file = fileIndex
-		} else if file404 != nil {
-			logf(r.Context(), "serving 404.html because '%s' not found\n", toFind)
-			file = fileIndex
-		}
-	}
-	if file != nil {
-		logf(r.Context(), "servePathInSite: serving '%s'\n", file.pathOnDisk)
-		http.ServeFile(w, r, file.pathOnDisk)
+// http.ServeFile always responds with 200, this allows e.g. serving a page with 404 status
+func serveFileWithStatus(w http.ResponseWriter, r *http.Request, path string, status int) {
+	f, err := os.Open(path)
+	if err != nil {
+		serveInternalError(w, r, "serveFileWithStatus: os.Open('%s') failed with '%s'\n", path, err)
 		return
 	}
+	defer f.Close()
+	serveContentWithStatus(w, r, path, f, status)
+}
 
-	path404 := filepath.Join("www", "listSiteFiles.html")
-	logf(r.Context(), "servePathInSite: serving listSiteFiles.html because '%s' doesn't exist\n", toFind)
-	http.ServeFile(w, r, path404)
+func serveContentWithStatus(w http.ResponseWriter, r *http.Request, name string, content io.Reader, status int) {
+	ct := mime.TypeByExtension(filepath.Ext(name))
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ct)
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		io.Copy(w, content)
+	}
 }
 
 // return true if is main website i.e. localhost or foo.bar
@@ -432,23 +740,73 @@ func isMain(r *http.Request) bool {
 func handleIndex(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		if p := recover(); p != nil {
-			logf(ctx(), "handleIndex: caught panic serving URL '%s'\n", r.URL)
+			uri := redactURL(r.URL)
+			logErrorf(r.Context(), nil, "handleIndex: caught panic serving URL '%s'", uri)
 			stack := debug.Stack()
-			serveErrorStatus(w, r, http.StatusInternalServerError, "Error: panic serving '%s' with:\n%s\n%s\n", r.URL, p, string(stack))
+			serveErrorStatus(w, r, http.StatusInternalServerError, "Error: panic serving '%s' with:\n%s\n%s\n", uri, p, string(stack))
 			os.Stderr.Write(stack)
 		}
 	}()
 
+	if strings.HasPrefix(r.URL.Path, adminAPIPrefix) {
+		handleAdminAPI(w, r)
+		return
+	}
+
+	if r.URL.Path == siteLoginPath {
+		handleSiteLogin(w, r)
+		return
+	}
+	if isMain(r) && r.URL.Path == adminLoginPath {
+		handleAdminLogin(w, r)
+		return
+	}
+	if isMain(r) && r.URL.Path == adminLogoutPath {
+		handleAdminLogout(w, r)
+		return
+	}
+
+	if r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodDelete {
+		// e.g. POST /api/login on a site that proxies /api/* to its backend
+		if site := findSiteFromHost(r.Context(), r.Host); site != nil {
+			if target, ok := findProxyTarget(site, r); ok {
+				if checkSiteAccess(w, r, site) {
+					proxyToUpstream(w, r, target)
+				}
+				return
+			}
+		}
+	}
 	if r.Method == http.MethodPost || r.Method == http.MethodPut {
 		handleUpload(w, r)
 		return
 	}
+	if r.Method == http.MethodDelete {
+		handleDeleteSite(w, r)
+		return
+	}
 
 	path := r.URL.Path
 
-	site := findSiteFromHost(r.Host)
+	if path == "/__instantpreviewinternal/main.js" {
+		filePath := filepath.Join("www", "main.js")
+		w.Header().Set("Cache-Control", cacheControlInternal)
+		http.ServeFile(w, r, filePath)
+		return
+	}
+	if path == "/__instantpreviewinternal/main.css" {
+		filePath := filepath.Join("www", "main.css")
+		w.Header().Set("Cache-Control", cacheControlInternal)
+		http.ServeFile(w, r, filePath)
+		return
+	}
+
+	site := findSiteFromHost(r.Context(), r.Host)
 
 	if site != nil {
+		if !checkSiteAccess(w, r, site) {
+			return
+		}
 		// handle those before regular files
 		if path == "/__instantpreviewinternal/api/site-info.json" {
 			handleAPISiteFiles(w, r, site)
@@ -458,17 +816,14 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 			handleAPIToggleSpa(w, r, site)
 			return
 		}
-	}
-
-	if path == "/__instantpreviewinternal/main.js" {
-		filePath := filepath.Join("www", "main.js")
-		http.ServeFile(w, r, filePath)
-		return
-	}
-	if path == "/__instantpreviewinternal/main.css" {
-		filePath := filepath.Join("www", "main.css")
-		http.ServeFile(w, r, filePath)
-		return
+		if path == "/__instantpreviewinternal/api/toggle-autoindex" {
+			handleAPIToggleAutoIndex(w, r, site)
+			return
+		}
+		if path == "/__instantpreviewinternal/api/set-not-found" {
+			handleAPISetNotFound(w, r, site)
+			return
+		}
 	}
 
 	if site != nil {
@@ -499,6 +854,11 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if path == "/metrics" {
+		handleMetrics(w, r)
+		return
+	}
+
 	if path == "/ping" || path == "/ping.txt" {
 		servePlainText(w, r, "pong")
 		return
@@ -511,7 +871,7 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 
 	dir := "www"
 	uriPath := path
-	logf(r.Context(), "serveFile: dir: '%s', uriPath: '%s'\n", dir, uriPath)
+	logDebugf(r.Context(), logAttrs(logPath(uriPath)), "serveFile: dir: '%s'", dir)
 	fileName := strings.TrimPrefix(uriPath, "/")
 	if fileName == "" {
 		fileName = "index.html"
@@ -527,7 +887,7 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	logf(r.Context(), "handleIndex: '%s' not found\n", r.URL)
+	logf(r.Context(), nil, "handleIndex: '%s' not found", r.URL)
 	http.NotFound(w, r)
 }
 
@@ -539,7 +899,7 @@ func doRunServer() {
 	}
 	mux := &http.ServeMux{}
 	mux.HandleFunc("/", handleIndex)
-	var handler http.Handler = mux
+	var handler http.Handler = withRequestID(withMetrics(mux))
 	httpSrv := &http.Server{
 		ReadTimeout:  120 * time.Second,
 		WriteTimeout: 120 * time.Second,
@@ -550,8 +910,14 @@ func doRunServer() {
 	ctx := ctx()
 
 	sitesPassword = os.Getenv("SITES_PASSWORD")
-	logf(ctx, "Starting server on http://%s, data dir: '%s', premium data dir: '%s', /sites password: '%s'\n", httpAddr, getDataDir(), getPremiumSitesDir(), sitesPassword)
-	parsePremiumSites()
+	parseProxyAllowedHosts()
+	parseS3Config()
+	parseRequireUploadToken()
+	parseMetricsToken()
+	logf(ctx, nil, "Starting server on http://%s, data dir: '%s', premium data dir: '%s', state dir: '%s', admin enabled?: %v", httpAddr, getDataDir(), getPremiumSitesDir(), getStateDir(), isAdminEnabled())
+	openMetadataStore()
+	importPremiumSites()
+	go siteViewsLoop()
 
 	chServerClosed := make(chan bool, 1)
 	go func() {
@@ -561,7 +927,7 @@ func doRunServer() {
 			err = nil
 		}
 		must(err)
-		logf(ctx, "HTTP server shutdown gracefully\n")
+		logf(ctx, nil, "HTTP server shutdown gracefully")
 		chServerClosed <- true
 	}()
 
@@ -571,7 +937,7 @@ func doRunServer() {
 	signal.Notify(c, os.Interrupt /* SIGINT */, syscall.SIGTERM)
 
 	sig := <-c
-	logf(ctx, "Got signal %s\n", sig)
+	logf(ctx, nil, "Got signal %s", sig)
 
 	if httpSrv != nil {
 		// Shutdown() needs a non-nil context
@@ -597,6 +963,7 @@ func main() {
 	}
 
 	if flgRun {
+		initLogging()
 		doRunServer()
 		return
 	}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// logf writes to stdout which is too noisy in tests and benchmarks
+func silenceLogs(tb testing.TB) {
+	stdout := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	tb.Cleanup(func() {
+		os.Stdout = stdout
+	})
+}
+
+// sets up nSites sites with nFiles files each, all backed by the same storage
+func setupBenchSites(b *testing.B, nSites int, nFiles int) {
+	storage := newMemStorage()
+	var files []*siteFile
+	for j := 0; j < nFiles; j++ {
+		f := &siteFile{
+			Path: fmt.Sprintf("dir%d/file%d.html", j%10, j),
+		}
+		w, _ := storage.Create(f.Path)
+		io.WriteString(w, "<html>hello</html>")
+		must(w.Close())
+		files = append(files, f)
+	}
+	sites = map[string]*Site{}
+	metaStore = newMemMetadataStore()
+	for i := 0; i < nSites; i++ {
+		site := &Site{
+			name:    fmt.Sprintf("site%d", i),
+			storage: storage,
+		}
+		site.files = append(site.files, files...)
+		buildSiteFilesIndex(site)
+		must(saveSite(ctx(), site))
+	}
+}
+
+func benchmarkServePathInSite(b *testing.B, nSites int, nFiles int) {
+	setupBenchSites(b, nSites, nFiles)
+	silenceLogs(b)
+
+	host := fmt.Sprintf("site%d.localhost", nSites-1)
+	last := nFiles - 1
+	uri := fmt.Sprintf("/dir%d/file%d", last%10, last)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := httptest.NewRequest("GET", uri, nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		handleIndex(w, r)
+		if w.Code != 200 {
+			b.Fatalf("exp 200, got %d\n", w.Code)
+		}
+	}
+}
+
+func BenchmarkServePathInSite10Sites10Files(b *testing.B) {
+	benchmarkServePathInSite(b, 10, 10)
+}
+
+func BenchmarkServePathInSite10Sites10000Files(b *testing.B) {
+	benchmarkServePathInSite(b, 10, 10000)
+}
+
+func BenchmarkServePathInSite10000Sites10Files(b *testing.B) {
+	benchmarkServePathInSite(b, 10000, 10)
+}
+
+func BenchmarkServePathInSite1000Sites1000Files(b *testing.B) {
+	benchmarkServePathInSite(b, 1000, 1000)
+}
+
+func TestParsePremiumSiteDefs(t *testing.T) {
+	silenceLogs(t)
+	defs := parsePremiumSiteDefs([]byte("Foo, pwd1\r\n\ninvalid\nbar,pwd2,x\nbaz,pwd3\n"))
+	if len(defs) != 2 {
+		t.Fatalf("exp 2 sites, got %d\n", len(defs))
+	}
+	if defs[0].name != "foo" || defs[0].pwd != "pwd1" || defs[1].name != "baz" {
+		t.Fatalf("exp foo/pwd1 and baz, got %+v\n", defs)
+	}
+}
+
+func TestImportPremiumSiteDefs(t *testing.T) {
+	setupTestSite(t, "temp", map[string]string{"index.html": "hello"})
+	premiumSitesDirCached = t.TempDir()
+
+	importPremiumSiteDefs([]premiumSiteDef{{name: "foo", pwd: "a"}})
+	m, _ := metaStore.GetSite("foo")
+	if m == nil || !m.IsPremium || !m.FromEnv || !checkPasswordHash(m.UploadPasswordHash, "a") {
+		t.Fatalf("exp premium site 'foo' from env with password 'a', got %+v\n", m)
+	}
+	// password changed in env
+	importPremiumSiteDefs([]premiumSiteDef{{name: "foo", pwd: "b"}})
+	m, _ = metaStore.GetSite("foo")
+	if !checkPasswordHash(m.UploadPasswordHash, "b") {
+		t.Fatalf("exp password of 'foo' to change\n")
+	}
+	// temporary site with the same name is not changed
+	importPremiumSiteDefs([]premiumSiteDef{{name: "foo", pwd: "b"}, {name: "temp", pwd: "c"}})
+	if m, _ = metaStore.GetSite("temp"); m.IsPremium || m.FromEnv {
+		t.Fatalf("exp 'temp' to remain a temporary site\n")
+	}
+	// removed from env
+	importPremiumSiteDefs(nil)
+	m, _ = metaStore.GetSite("foo")
+	if m == nil || !m.IsPremium || m.FromEnv {
+		t.Fatalf("exp 'foo' to be kept as a premium site, got %+v\n", m)
+	}
+}
+
+func TestDeleteStaleSites(t *testing.T) {
+	setupTestSite(t, "temp", map[string]string{"index.html": "hello"})
+	otherDir := filepath.Join(t.TempDir(), "data")
+	for _, m := range []*siteMeta{
+		{Name: "mine", Dir: filepath.Join(getDataDir(), "mine")},
+		{Name: "other", Dir: filepath.Join(otherDir, "other")},
+		{Name: "premium", Dir: filepath.Join(getDataDir(), "premium"), IsPremium: true},
+	} {
+		must(metaStore.PutSite(m))
+	}
+	deleteStaleSites()
+	test := func(name string, expExists bool) {
+		m, _ := metaStore.GetSite(name)
+		if (m != nil) != expExists {
+			t.Fatalf("site '%s': exp exists %v, got %v\n", name, expExists, m != nil)
+		}
+	}
+	test("mine", false)
+	test("other", true)
+	test("premium", true)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/gomarkdown/markdown"
+	"github.com/gomarkdown/markdown/ast"
+	mdhtml "github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+func isMarkdownFile(path string) bool {
+	ext := getExt(path)
+	return ext == "md" || ext == "markdown"
+}
+
+// ?raw=1 serves the file as-is instead of rendering it
+func isRawRequested(r *http.Request) bool {
+	v := r.URL.Query().Get("raw")
+	return v != "" && v != "0"
+}
+
+// rawFileURL returns url that serves the file as-is
+func rawFileURL(path string) string {
+	u := &url.URL{Path: "/" + path, RawQuery: "raw=1"}
+	return u.String()
+}
+
+// highlightCode writes code as html with syntax highlighting
+// lang can be a language name or file name; if empty, we try to guess it
+func highlightCode(w io.Writer, code string, lang string, lineNumbers bool) error {
+	var lexer chroma.Lexer
+	if lang != "" {
+		lexer = lexers.Get(lang)
+	}
+	if lexer == nil {
+		lexer = lexers.Analyse(code)
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	lexer = chroma.Coalesce(lexer)
+	it, err := lexer.Tokenise(nil, code)
+	if err != nil {
+		return err
+	}
+	style := styles.Get("github")
+	formatter := chromahtml.New(chromahtml.WithClasses(false), chromahtml.TabWidth(4), chromahtml.WithLineNumbers(lineNumbers))
+	return formatter.Format(w, style, it)
+}
+
+// render code blocks with syntax highlighting
+func markdownRenderHook(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	cb, ok := node.(*ast.CodeBlock)
+	if !ok {
+		return ast.GoToNext, false
+	}
+	lang := strings.TrimSpace(string(cb.Info))
+	if err := highlightCode(w, string(cb.Literal), lang, false); err != nil {
+		return ast.GoToNext, false
+	}
+	return ast.GoToNext, true
+}
+
+// rewriteRelativeURL makes a relative link in markdown file absolute so that
+// it works regardless of the url the file is served at (e.g. README.md served as "/docs")
+func rewriteRelativeURL(dest string, mdFilePath string) string {
+	if dest == "" || strings.HasPrefix(dest, "#") || strings.HasPrefix(dest, "/") {
+		return dest
+	}
+	u, err := url.Parse(dest)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return dest
+	}
+	dir := path.Dir("/" + mdFilePath)
+	u.Path = path.Join(dir, u.Path)
+	if strings.HasSuffix(dest, "/") && !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u.String()
+}
+
+func rewriteMarkdownLinks(doc ast.Node, mdFilePath string) {
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+		switch v := node.(type) {
+		case *ast.Link:
+			v.Destination = []byte(rewriteRelativeURL(string(v.Destination), mdFilePath))
+		case *ast.Image:
+			v.Destination = []byte(rewriteRelativeURL(string(v.Destination), mdFilePath))
+		}
+		return ast.GoToNext
+	})
+}
+
+func markdownToHTML(md []byte, mdFilePath string) []byte {
+	md = normalizeNewlines(md)
+	extensions := parser.CommonExtensions | parser.AutoHeadingIDs | parser.Footnotes
+	p := parser.NewWithExtensions(extensions)
+	doc := p.Parse(md)
+	rewriteMarkdownLinks(doc, mdFilePath)
+	opts := mdhtml.RendererOptions{
+		Flags:          mdhtml.CommonFlags | mdhtml.HrefTargetBlank,
+		RenderNodeHook: markdownRenderHook,
+	}
+	renderer := mdhtml.NewRenderer(opts)
+	return markdown.Render(doc, renderer)
+}
+
+// serveMarkdown renders .md file as html page
+func serveMarkdown(w http.ResponseWriter, r *http.Request, site *Site, file *siteFile, status int) {
+	md, err := readSiteFile(site, file)
+	if err != nil {
+		serveInternalError(w, r, "serveMarkdown: readSiteFile('%s') failed with '%s'\n", file.Path, err)
+		return
+	}
+	tmpl, err := template.ParseFiles(filepath.Join("www", "markdown.html"))
+	if err != nil {
+		serveInternalError(w, r, "serveMarkdown: template.ParseFiles() failed with '%s'\n", err)
+		return
+	}
+	v := struct {
+		Title   string
+		RawURL  string
+		Content template.HTML
+	}{
+		Title:   file.Path,
+		RawURL:  rawFileURL(file.Path),
+		Content: template.HTML(markdownToHTML(md, file.Path)),
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, v)
+	if err != nil {
+		serveInternalError(w, r, "serveMarkdown: tmpl.Execute() failed with '%s'\n", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("ETag", etagForEncoding(file.etag, "md"))
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		w.Write(buf.Bytes())
+		return
+	}
+	var zeroTime time.Time
+	http.ServeContent(w, r, file.Path, zeroTime, bytes.NewReader(buf.Bytes()))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRewriteRelativeURL(t *testing.T) {
+	test := func(dest string, mdPath string, exp string) {
+		got := rewriteRelativeURL(dest, mdPath)
+		if got != exp {
+			t.Fatalf("dest: '%s', md: '%s', exp: '%s', got: '%s'\n", dest, mdPath, exp, got)
+		}
+	}
+	test("guide.md", "README.md", "/guide.md")
+	test("guide.md", "docs/README.md", "/docs/guide.md")
+	test("../img/a.png", "docs/README.md", "/img/a.png")
+	test("sub/", "docs/README.md", "/docs/sub/")
+	test("guide.md#intro", "docs/README.md", "/docs/guide.md#intro")
+	test("#intro", "docs/README.md", "#intro")
+	test("/abs.md", "docs/README.md", "/abs.md")
+	test("https://example.com/a", "docs/README.md", "https://example.com/a")
+	test("mailto:me@example.com", "README.md", "mailto:me@example.com")
+}
+
+func TestRawFileURL(t *testing.T) {
+	test := func(path string, exp string) {
+		got := rawFileURL(path)
+		if got != exp {
+			t.Fatalf("path: '%s', exp: '%s', got: '%s'\n", path, exp, got)
+		}
+	}
+	test("README.md", "/README.md?raw=1")
+	test("docs/my notes.md", "/docs/my%20notes.md?raw=1")
+	test("a#b?c%d.md", "/a%23b%3Fc%25d.md?raw=1")
+}
+
+// markdown is only rendered when browser navigates to it
+func TestServeMarkdown(t *testing.T) {
+	site := setupTestSite(t, "foo", map[string]string{"README.md": "# hello"})
+	test := func(uri string, expHTML bool, hdrs ...string) {
+		w := testGet(site, uri, hdrs...)
+		isHTML := strings.HasPrefix(w.Header().Get("Content-Type"), "text/html")
+		if w.Code != http.StatusOK || isHTML != expHTML {
+			t.Fatalf("uri: '%s', exp html: %v, got %d '%s'\n", uri, expHTML, w.Code, w.Header().Get("Content-Type"))
+		}
+		// raw file is always served as-is
+		if !strings.Contains(uri, "raw=1") && !slices.Contains(w.Header().Values("Vary"), "Sec-Fetch-Dest") {
+			t.Fatalf("uri: '%s', exp Vary: Sec-Fetch-Dest, got '%v'\n", uri, w.Header().Values("Vary"))
+		}
+	}
+	test("/README.md", true, "Sec-Fetch-Dest", "document")
+	test("/README.md", false)
+	test("/README.md", false, "Sec-Fetch-Dest", "empty")
+	test("/README.md?raw=1", false, "Sec-Fetch-Dest", "document")
+}
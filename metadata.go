@@ -0,0 +1,728 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// information about sites is kept in a metadataStore so that many instances
+// of the server can share it (together with shared file storage, see s3.go)
+// sites map is a per-instance cache of sites loaded from the store
+
+// how long a cached site is used before checking if it changed in the store
+const siteCacheTTL = 5 * time.Second
+
+type siteFileMeta struct {
+	Path string
+	Size int64
+	ETag string `json:",omitempty"`
+}
+
+// siteMeta is what we persist about a site
+type siteMeta struct {
+	Name      string
+	Dir       string
+	CreatedOn time.Time
+	UpdatedOn time.Time // changes with every update, used to invalidate cache
+	ExpiresOn time.Time `json:",omitzero"`
+	IsSPA     bool
+	IsPremium bool
+	FromEnv   bool `json:",omitempty"`
+	// bcrypt hash
+	UploadPasswordHash string `json:",omitempty"`
+	// plain text password stored by older versions, see upgradeUploadPasswords
+	UploadPassword string   `json:",omitempty"`
+	ProxyOptions   []string `json:",omitempty"`
+	NotFound       string   `json:",omitempty"`
+	CacheControl   string   `json:",omitempty"`
+	AutoIndex      bool     `json:",omitempty"`
+	KeepZip        bool     `json:",omitempty"`
+	StorageID      string   `json:",omitempty"`
+	AccessMode     string   `json:",omitempty"`
+	AccessUser     string   `json:",omitempty"`
+	AccessHash     string   `json:",omitempty"`
+	TotalSize      int64
+	Files          []*siteFileMeta
+}
+
+type metadataStore interface {
+	// PutSite creates or updates a site
+	PutSite(m *siteMeta) error
+	// GetSite returns nil if site doesn't exist
+	GetSite(name string) (*siteMeta, error)
+	ListSites() ([]*siteMeta, error)
+	// DeleteSite returns true if the site was deleted by this call.
+	// When many instances try to delete (expire) the same site only one
+	// gets true and should delete site files
+	DeleteSite(name string) (bool, error)
+	// RenameSite replaces site oldName with m, which has a different name
+	// owner token, deploys, analytics and api tokens move to the new name
+	RenameSite(oldName string, m *siteMeta) error
+	// GetSiteStats returns stats of premium (true) and temporary (false) sites
+	GetSiteStats() (map[bool]*siteStats, error)
+
+	// owner token allows re-uploading a temporary site, we only store its hash
+	SetOwnerTokenHash(name string, tokenHash string) error
+	// GetOwnerTokenHash returns "" if site has no owner token
+	GetOwnerTokenHash(name string) (string, error)
+
+	AddDeploy(d *deployInfo) error
+	// ListDeploys returns deploys of a site, most recent first
+	ListDeploys(name string) ([]*deployInfo, error)
+	// ListLastDeploys returns the most recent deploy of every site, by site name
+	ListLastDeploys() (map[string]*deployInfo, error)
+
+	AddSiteViews(name string, n int64) error
+	GetSiteViews(name string) (int64, error)
+	// visitors are identified by hashed ip address, see visitorHash
+	// only first maxSiteVisitors visitors of a site are stored
+	AddSiteVisitors(name string, visitorHashes []string) error
+	GetSiteVisitorCount(name string) (int64, error)
+	// GetVisitorSalt returns salt for visitorHash for a given period, set to
+	// newSalt by the first caller so that all instances use the same salt.
+	// Salts of earlier periods are deleted
+	GetVisitorSalt(period int64, newSalt string) (string, error)
+	// counters are e.g. views of a path, kind is one of siteCounter* values
+	// new keys are ignored once a site has maxSiteCounterKeys keys of a kind
+	AddSiteCounters(name string, counters []*siteCounter) error
+	// ListTopSiteCounters returns limit counters of a kind with highest counts
+	ListTopSiteCounters(name string, kind string, limit int) ([]*siteCounter, error)
+
+	AddAPIToken(t *apiToken) error
+	// GetAPIToken returns nil if there's no token with this hash
+	GetAPIToken(tokenHash string) (*apiToken, error)
+	ListAPITokens() ([]*apiToken, error)
+	SetAPITokenLastUsed(id string, lastUsedOn time.Time) error
+	// RevokeAPIToken returns false if there's no token with this id
+	RevokeAPIToken(id string, revokedOn time.Time) (bool, error)
+}
+
+// siteStats is the number and total size of files of sites of one kind
+type siteStats struct {
+	Count     int64
+	TotalSize int64
+}
+
+// deployInfo records an upload of a site
+type deployInfo struct {
+	SiteName  string
+	CreatedOn time.Time
+	FileCount int
+	TotalSize int64
+	IP        string
+	UserAgent string
+}
+
+var metaStore metadataStore = newMemMetadataStore()
+
+// memMetadataStore keeps sites in memory, which limits us to a single instance
+type memMetadataStore struct {
+	mu sync.Mutex
+	// site name => json-serialized siteMeta, so that callers don't share data
+	sites       map[string][]byte
+	ownerTokens map[string]string
+	deploys     []*deployInfo
+	views       map[string]int64
+	visitors    map[string]map[string]bool
+	counters    map[string]map[[2]string]int64 // site name => kind, key => count
+	salts       map[int64]string
+	apiTokens   []*apiToken
+}
+
+func newMemMetadataStore() *memMetadataStore {
+	return &memMetadataStore{
+		sites:       map[string][]byte{},
+		ownerTokens: map[string]string{},
+		views:       map[string]int64{},
+		visitors:    map[string]map[string]bool{},
+		counters:    map[string]map[[2]string]int64{},
+		salts:       map[int64]string{},
+	}
+}
+
+func (s *memMetadataStore) PutSite(m *siteMeta) error {
+	d, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.sites[m.Name] = d
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memMetadataStore) GetSite(name string) (*siteMeta, error) {
+	s.mu.Lock()
+	d := s.sites[name]
+	s.mu.Unlock()
+	if d == nil {
+		return nil, nil
+	}
+	var m siteMeta
+	err := json.Unmarshal(d, &m)
+	return &m, err
+}
+
+func (s *memMetadataStore) ListSites() ([]*siteMeta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []*siteMeta
+	for _, d := range s.sites {
+		var m siteMeta
+		if err := json.Unmarshal(d, &m); err != nil {
+			return nil, err
+		}
+		res = append(res, &m)
+	}
+	return res, nil
+}
+
+func (s *memMetadataStore) DeleteSite(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sites[name] == nil {
+		return false, nil
+	}
+	delete(s.sites, name)
+	delete(s.ownerTokens, name)
+	delete(s.views, name)
+	delete(s.visitors, name)
+	delete(s.counters, name)
+	var deploys []*deployInfo
+	for _, d := range s.deploys {
+		if d.SiteName != name {
+			deploys = append(deploys, d)
+		}
+	}
+	s.deploys = deploys
+	var tokens []*apiToken
+	for _, t := range s.apiTokens {
+		if t.SiteName != name {
+			tokens = append(tokens, t)
+		}
+	}
+	s.apiTokens = tokens
+	return true, nil
+}
+
+func (s *memMetadataStore) RenameSite(oldName string, m *siteMeta) error {
+	d, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	newName := m.Name
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sites[oldName] == nil {
+		return fmt.Errorf("site '%s' doesn't exist", oldName)
+	}
+	if s.sites[newName] != nil {
+		return fmt.Errorf("site '%s' already exists", newName)
+	}
+	delete(s.sites, oldName)
+	s.sites[newName] = d
+	if v, ok := s.ownerTokens[oldName]; ok {
+		s.ownerTokens[newName] = v
+		delete(s.ownerTokens, oldName)
+	}
+	if v, ok := s.views[oldName]; ok {
+		s.views[newName] = v
+		delete(s.views, oldName)
+	}
+	if v, ok := s.visitors[oldName]; ok {
+		s.visitors[newName] = v
+		delete(s.visitors, oldName)
+	}
+	if v, ok := s.counters[oldName]; ok {
+		s.counters[newName] = v
+		delete(s.counters, oldName)
+	}
+	for _, d := range s.deploys {
+		if d.SiteName == oldName {
+			d.SiteName = newName
+		}
+	}
+	for _, t := range s.apiTokens {
+		if t.SiteName == oldName {
+			t.SiteName = newName
+		}
+	}
+	return nil
+}
+
+func (s *memMetadataStore) SetOwnerTokenHash(name string, tokenHash string) error {
+	s.mu.Lock()
+	s.ownerTokens[name] = tokenHash
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memMetadataStore) GetOwnerTokenHash(name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ownerTokens[name], nil
+}
+
+func (s *memMetadataStore) AddDeploy(d *deployInfo) error {
+	dCopy := *d
+	s.mu.Lock()
+	s.deploys = append(s.deploys, &dCopy)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memMetadataStore) ListDeploys(name string) ([]*deployInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []*deployInfo
+	for i := len(s.deploys) - 1; i >= 0; i-- {
+		if d := s.deploys[i]; d.SiteName == name {
+			dCopy := *d
+			res = append(res, &dCopy)
+		}
+	}
+	return res, nil
+}
+
+func (s *memMetadataStore) GetSiteStats() (map[bool]*siteStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := map[bool]*siteStats{true: {}, false: {}}
+	for _, d := range s.sites {
+		var m siteMeta
+		if err := json.Unmarshal(d, &m); err != nil {
+			return nil, err
+		}
+		res[m.IsPremium].Count++
+		res[m.IsPremium].TotalSize += m.TotalSize
+	}
+	return res, nil
+}
+
+func (s *memMetadataStore) ListLastDeploys() (map[string]*deployInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := map[string]*deployInfo{}
+	for _, d := range s.deploys {
+		dCopy := *d
+		res[d.SiteName] = &dCopy
+	}
+	return res, nil
+}
+
+func (s *memMetadataStore) AddSiteViews(name string, n int64) error {
+	s.mu.Lock()
+	s.views[name] += n
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memMetadataStore) GetSiteViews(name string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.views[name], nil
+}
+
+func (s *memMetadataStore) AddSiteVisitors(name string, visitorHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.visitors[name]
+	if m == nil {
+		m = map[string]bool{}
+		s.visitors[name] = m
+	}
+	for _, h := range visitorHashes {
+		if len(m) >= maxSiteVisitors {
+			break
+		}
+		m[h] = true
+	}
+	return nil
+}
+
+func (s *memMetadataStore) GetSiteVisitorCount(name string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int64(len(s.visitors[name])), nil
+}
+
+func (s *memMetadataStore) AddSiteCounters(name string, counters []*siteCounter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.counters[name]
+	if m == nil {
+		m = map[[2]string]int64{}
+		s.counters[name] = m
+	}
+	nKeys := map[string]int{}
+	for k := range m {
+		nKeys[k[0]]++
+	}
+	for _, c := range counters {
+		k := [2]string{c.Kind, c.Key}
+		if _, ok := m[k]; !ok {
+			if nKeys[c.Kind] >= maxSiteCounterKeys {
+				continue
+			}
+			nKeys[c.Kind]++
+		}
+		m[k] += c.Count
+	}
+	return nil
+}
+
+func (s *memMetadataStore) GetVisitorSalt(period int64, newSalt string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p := range s.salts {
+		if p < period {
+			delete(s.salts, p)
+		}
+	}
+	if salt, ok := s.salts[period]; ok {
+		return salt, nil
+	}
+	s.salts[period] = newSalt
+	return newSalt, nil
+}
+
+func (s *memMetadataStore) ListTopSiteCounters(name string, kind string, limit int) ([]*siteCounter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []*siteCounter
+	for k, n := range s.counters[name] {
+		if k[0] == kind {
+			res = append(res, &siteCounter{Kind: kind, Key: k[1], Count: n})
+		}
+	}
+	sortSiteCounters(res)
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return res, nil
+}
+
+func (s *memMetadataStore) AddAPIToken(t *apiToken) error {
+	tCopy := *t
+	s.mu.Lock()
+	s.apiTokens = append(s.apiTokens, &tCopy)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memMetadataStore) GetAPIToken(tokenHash string) (*apiToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.apiTokens {
+		if t.tokenHash == tokenHash {
+			tCopy := *t
+			return &tCopy, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memMetadataStore) ListAPITokens() ([]*apiToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []*apiToken
+	for _, t := range s.apiTokens {
+		tCopy := *t
+		res = append(res, &tCopy)
+	}
+	return res, nil
+}
+
+func (s *memMetadataStore) SetAPITokenLastUsed(id string, lastUsedOn time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.apiTokens {
+		if t.ID == id {
+			t.LastUsedOn = lastUsedOn
+		}
+	}
+	return nil
+}
+
+func (s *memMetadataStore) RevokeAPIToken(id string, revokedOn time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.apiTokens {
+		if t.ID == id {
+			t.RevokedOn = revokedOn
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func siteToMeta(site *Site) *siteMeta {
+	m := &siteMeta{
+		Name:               site.name,
+		Dir:                site.dir,
+		CreatedOn:          site.createdOn,
+		UpdatedOn:          site.updatedOn,
+		ExpiresOn:          site.expiresOn,
+		IsSPA:              site.isSPA,
+		IsPremium:          site.isPremium,
+		FromEnv:            site.fromEnv,
+		UploadPasswordHash: site.uploadPasswordHash,
+		ProxyOptions:       site.proxyOptions,
+		NotFound:           site.notFound,
+		CacheControl:       site.cacheControl,
+		AutoIndex:          site.autoIndex,
+		KeepZip:            site.keepZip,
+		StorageID:          site.storageID,
+		AccessMode:         site.accessMode,
+		AccessUser:         site.accessUser,
+		AccessHash:         site.accessHash,
+		TotalSize:          site.totalSize,
+	}
+	for _, f := range site.files {
+		fm := &siteFileMeta{
+			Path: f.Path,
+			Size: f.Size,
+			ETag: f.etag,
+		}
+		m.Files = append(m.Files, fm)
+	}
+	return m
+}
+
+// siteFromMeta creates a site with information from the store
+// use loadSite to also make it ready for serving
+func siteFromMeta(m *siteMeta) *Site {
+	site := &Site{
+		name:               m.Name,
+		dir:                m.Dir,
+		createdOn:          m.CreatedOn,
+		updatedOn:          m.UpdatedOn,
+		expiresOn:          m.ExpiresOn,
+		isSPA:              m.IsSPA,
+		isPremium:          m.IsPremium,
+		fromEnv:            m.FromEnv,
+		uploadPasswordHash: m.UploadPasswordHash,
+		proxyOptions:       m.ProxyOptions,
+		notFound:           m.NotFound,
+		cacheControl:       m.CacheControl,
+		autoIndex:          m.AutoIndex,
+		keepZip:            m.KeepZip,
+		storageID:          m.StorageID,
+		accessMode:         m.AccessMode,
+		accessUser:         m.AccessUser,
+		accessHash:         m.AccessHash,
+		totalSize:          m.TotalSize,
+	}
+	for _, fm := range m.Files {
+		f := &siteFile{
+			Path:       fm.Path,
+			Size:       fm.Size,
+			pathInForm: fm.Path,
+			etag:       fm.ETag,
+		}
+		site.files = append(site.files, f)
+	}
+	return site
+}
+
+// loadSite creates a site from the store, ready for serving
+func loadSite(m *siteMeta) *Site {
+	site := siteFromMeta(m)
+	site.storage = newSiteStorage(site)
+	if site.keepZip {
+		// ?keepzip is only allowed with files on disk, see handleUpload
+		if err := openSiteZip(ctx(), site); err != nil {
+			logf(ctx(), logAttrs(logSite(site.name), logErr(err)), "loadSite: openSiteZip() failed")
+		}
+	}
+	buildSiteFilesIndex(site)
+	calcSiteFilesETags(ctx(), site)
+	loadSiteConfig(ctx(), site)
+	return site
+}
+
+// saveSite persists site in the store, must be called after changing the site
+func saveSite(ctx context.Context, site *Site) error {
+	site.updatedOn = time.Now()
+	err := metaStore.PutSite(siteToMeta(site))
+	if err != nil {
+		logf(ctx, logAttrs(logSite(site.name), logErr(err)), "saveSite: metaStore.PutSite() failed")
+		return err
+	}
+	muSites.Lock()
+	site.checkedOn = time.Now()
+	sites[site.name] = site
+	muSites.Unlock()
+	return nil
+}
+
+func uncacheSite(name string) {
+	muSites.Lock()
+	site := sites[name]
+	delete(sites, name)
+	muSites.Unlock()
+	if site != nil {
+		removeSiteCompressedCache(ctx(), site)
+	}
+}
+
+// getSite returns a site with a given name or nil if doesn't exist
+func getSite(name string) *Site {
+	muSites.RLock()
+	site := sites[name]
+	fresh := site != nil && time.Since(site.checkedOn) < siteCacheTTL
+	muSites.RUnlock()
+	if fresh {
+		return site
+	}
+	m, err := metaStore.GetSite(name)
+	if err != nil {
+		// better to serve possibly stale site than nothing
+		logf(ctx(), logAttrs(logSite(name), logErr(err)), "getSite: metaStore.GetSite() failed")
+		return site
+	}
+	if m == nil {
+		if site != nil {
+			uncacheSite(name)
+		}
+		return nil
+	}
+	if site == nil || !m.UpdatedOn.Equal(site.updatedOn) {
+		if site != nil {
+			removeSiteCompressedCache(ctx(), site)
+		}
+		site = loadSite(m)
+	}
+	muSites.Lock()
+	site.checkedOn = time.Now()
+	sites[name] = site
+	muSites.Unlock()
+	return site
+}
+
+// returns all sites from the store, not ready for serving
+func listSites() []*Site {
+	metas, err := metaStore.ListSites()
+	if err != nil {
+		logf(ctx(), logAttrs(logErr(err)), "listSites: metaStore.ListSites() failed")
+		return nil
+	}
+	var res []*Site
+	for _, m := range metas {
+		res = append(res, siteFromMeta(m))
+	}
+	return res
+}
+
+// returns sites ordered by creation time
+func getSitesSorted() []*Site {
+	res := listSites()
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].createdOn.Before(res[j].createdOn)
+	})
+	return res
+}
+
+// upgradeUploadPasswords replaces plain text upload passwords
+// stored by older versions with hashes
+func upgradeUploadPasswords() {
+	metas, err := metaStore.ListSites()
+	if err != nil {
+		logf(ctx(), logAttrs(logErr(err)), "upgradeUploadPasswords: metaStore.ListSites() failed")
+		return
+	}
+	for _, m := range metas {
+		if m.UploadPassword == "" {
+			continue
+		}
+		pwdHash, err := hashPassword(m.UploadPassword)
+		if err != nil {
+			logf(ctx(), logAttrs(logSite(m.Name), logErr(err)), "upgradeUploadPasswords: hashPassword() failed")
+			continue
+		}
+		m.UploadPasswordHash = pwdHash
+		m.UploadPassword = ""
+		m.UpdatedOn = time.Now()
+		if err = metaStore.PutSite(m); err != nil {
+			logf(ctx(), logAttrs(logSite(m.Name), logErr(err)), "upgradeUploadPasswords: metaStore.PutSite() failed")
+			continue
+		}
+		logf(ctx(), logAttrs(logSite(m.Name)), "upgradeUploadPasswords: hashed upload password")
+	}
+}
+
+// deleteSiteFiles deletes files of a site that is no longer in the store
+func deleteSiteFiles(site *Site) {
+	// cached site might have zip file open
+	muSites.RLock()
+	if cached := sites[site.name]; cached != nil {
+		site = cached
+	}
+	muSites.RUnlock()
+	if site.storage == nil {
+		site.storage = newSiteStorage(site)
+	}
+	if err := site.storage.RemoveAll(); err != nil {
+		logf(ctx(), logAttrs(logSite(site.name), logErr(err)), "deleteSiteFiles: site.storage.RemoveAll() failed")
+	}
+	if site.keepZip {
+		os.Remove(siteZipPath(site))
+	}
+	uncacheSite(site.name)
+}
+
+// siteExpiresOn returns when temporary site expires
+func siteExpiresOn(site *Site) time.Time {
+	if !site.expiresOn.IsZero() {
+		return site.expiresOn
+	}
+	return site.createdOn.Add(timeTwoHours)
+}
+
+// expireSites deletes temporary sites past their expiration time,
+// by default timeTwoHours after creation
+// with many instances, only one deletes a given site
+func expireSites() int {
+	nExpired := 0
+	inStore := map[string]bool{}
+	for _, site := range listSites() {
+		inStore[site.name] = true
+		// premium sites do not expire
+		if site.isPremium || time.Now().Before(siteExpiresOn(site)) {
+			continue
+		}
+		deleted, err := metaStore.DeleteSite(site.name)
+		if err != nil {
+			logf(ctx(), logAttrs(logSite(site.name), logErr(err)), "expireSites: metaStore.DeleteSite() failed")
+			continue
+		}
+		inStore[site.name] = false
+		if !deleted {
+			// another instance expired it
+			continue
+		}
+		deleteSiteFiles(site)
+		auditSite(nil, auditActionExpire, auditOutcomeOK, site, "")
+		countSiteExpired()
+		logf(ctx(), logAttrs(logSite(site.name)), "expireSites: expired site and deleted its files")
+		nExpired++
+	}
+	// drop sites deleted by other instances
+	var toUncache []string
+	muSites.RLock()
+	for name := range sites {
+		if !inStore[name] {
+			toUncache = append(toUncache, name)
+		}
+	}
+	muSites.RUnlock()
+	for _, name := range toUncache {
+		uncacheSite(name)
+	}
+	return nExpired
+}
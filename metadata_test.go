@@ -0,0 +1,219 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExpireSites(t *testing.T) {
+	setupTestSite(t, "new", map[string]string{"index.html": "hello"})
+	old := &Site{
+		name:      "old",
+		storage:   newMemStorage(),
+		createdOn: time.Now().Add(-timeTwoHours - time.Minute),
+	}
+	must(saveSite(ctx(), old))
+
+	if n := expireSites(); n != 1 {
+		t.Fatalf("exp 1 expired site, got %d\n", n)
+	}
+	// the same store used by another instance
+	if n := expireSites(); n != 0 {
+		t.Fatalf("exp 0 expired sites, got %d\n", n)
+	}
+	if getSite("old") != nil {
+		t.Fatalf("exp site 'old' to be deleted\n")
+	}
+	if getSite("new") == nil {
+		t.Fatalf("exp site 'new' to exist\n")
+	}
+}
+
+func TestGetSiteReloadsChangedSite(t *testing.T) {
+	site := setupTestSite(t, "foo", map[string]string{"index.html": "hello"})
+
+	// another instance toggles spa
+	m := siteToMeta(site)
+	m.IsSPA = true
+	m.UpdatedOn = time.Now()
+	must(metaStore.PutSite(m))
+
+	if getSite("foo").isSPA {
+		t.Fatalf("exp cached site to be used\n")
+	}
+	site.checkedOn = time.Now().Add(-siteCacheTTL)
+	got := getSite("foo")
+	if !got.isSPA {
+		t.Fatalf("exp site to be reloaded from the store\n")
+	}
+	if got.storage == nil || findSiteFile(got, "index.html") == nil {
+		t.Fatalf("exp reloaded site to be ready for serving\n")
+	}
+}
+
+func testMetadataStore(t *testing.T, store metadataStore) {
+	m := &siteMeta{
+		Name:      "foo",
+		CreatedOn: time.Now(),
+		UpdatedOn: time.Now(),
+		Files:     []*siteFileMeta{{Path: "index.html", Size: 5}},
+		TotalSize: 5,
+	}
+	must(store.PutSite(m))
+	got, err := store.GetSite("foo")
+	if err != nil || got == nil || len(got.Files) != 1 || got.Files[0].Path != "index.html" {
+		t.Fatalf("exp site 'foo' with index.html, got %+v, err: '%v'\n", got, err)
+	}
+	must(store.PutSite(&siteMeta{Name: "prem", IsPremium: true, TotalSize: 7}))
+	stats, err := store.GetSiteStats()
+	if err != nil || stats[false].Count != 1 || stats[false].TotalSize != 5 || stats[true].Count != 1 || stats[true].TotalSize != 7 {
+		t.Fatalf("exp 1 temporary and 1 premium site, got %+v %+v, err: '%v'\n", stats[false], stats[true], err)
+	}
+	store.DeleteSite("prem")
+	must(store.SetOwnerTokenHash("foo", "hash"))
+	must(store.AddDeploy(&deployInfo{SiteName: "foo", FileCount: 1}))
+	must(store.AddDeploy(&deployInfo{SiteName: "foo", FileCount: 2}))
+	must(store.AddSiteViews("foo", 2))
+	must(store.AddSiteViews("foo", 3))
+	if tokenHash, _ := store.GetOwnerTokenHash("foo"); tokenHash != "hash" {
+		t.Fatalf("exp owner token hash 'hash', got '%s'\n", tokenHash)
+	}
+	deploys, err := store.ListDeploys("foo")
+	if err != nil || len(deploys) != 2 || deploys[0].FileCount != 2 {
+		t.Fatalf("exp 2 deploys, most recent first, got %d, err: '%v'\n", len(deploys), err)
+	}
+	must(store.AddDeploy(&deployInfo{SiteName: "bar", FileCount: 3}))
+	lastDeploys, err := store.ListLastDeploys()
+	if err != nil || len(lastDeploys) != 2 || lastDeploys["foo"].FileCount != 2 || lastDeploys["bar"].FileCount != 3 {
+		t.Fatalf("exp last deploys of 'foo' and 'bar', got %d, err: '%v'\n", len(lastDeploys), err)
+	}
+	if views, _ := store.GetSiteViews("foo"); views != 5 {
+		t.Fatalf("exp 5 views, got %d\n", views)
+	}
+	must(store.AddSiteVisitors("foo", []string{"v1", "v2"}))
+	must(store.AddSiteVisitors("foo", []string{"v2", "v3"}))
+	if n, _ := store.GetSiteVisitorCount("foo"); n != 3 {
+		t.Fatalf("exp 3 visitors, got %d\n", n)
+	}
+	must(store.AddSiteCounters("foo", []*siteCounter{
+		{Kind: siteCounterPath, Key: "/a", Count: 1},
+		{Kind: siteCounterPath, Key: "/b", Count: 2},
+		{Kind: siteCounterNotFound, Key: "/c", Count: 5},
+	}))
+	must(store.AddSiteCounters("foo", []*siteCounter{{Kind: siteCounterPath, Key: "/a", Count: 3}}))
+	counters, err := store.ListTopSiteCounters("foo", siteCounterPath, 1)
+	if err != nil || len(counters) != 1 || counters[0].Key != "/a" || counters[0].Count != 4 {
+		t.Fatalf("exp top path '/a' with 4 views, got %+v, err: '%v'\n", counters, err)
+	}
+
+	tok := &apiToken{ID: "id1", Name: "ci", SiteName: "foo", Scopes: []string{scopeUpload}, CreatedOn: time.Now(), tokenHash: "th"}
+	must(store.AddAPIToken(tok))
+	must(store.SetAPITokenLastUsed("id1", time.Now()))
+	tok, err = store.GetAPIToken("th")
+	if err != nil || tok == nil || tok.ID != "id1" || !tok.hasScope(scopeUpload) || tok.LastUsedOn.IsZero() {
+		t.Fatalf("exp api token 'id1', got %+v, err: '%v'\n", tok, err)
+	}
+	if tok, _ = store.GetAPIToken("missing"); tok != nil {
+		t.Fatalf("exp nil for missing api token, got %+v\n", tok)
+	}
+	var many []*siteCounter
+	for i := 0; i <= maxSiteCounterKeys; i++ {
+		many = append(many, &siteCounter{Kind: siteCounterReferrer, Key: strconv.Itoa(i), Count: 1})
+	}
+	must(store.AddSiteCounters("foo", many))
+	must(store.AddSiteCounters("foo", []*siteCounter{{Kind: siteCounterReferrer, Key: "0", Count: 1}}))
+	counters, _ = store.ListTopSiteCounters("foo", siteCounterReferrer, maxSiteCounterKeys+1)
+	if len(counters) != maxSiteCounterKeys || counters[0].Key != "0" || counters[0].Count != 2 {
+		t.Fatalf("exp %d referrers with '0' counted twice, got %d\n", maxSiteCounterKeys, len(counters))
+	}
+
+	if salt, _ := store.GetVisitorSalt(1, "a"); salt != "a" {
+		t.Fatalf("exp salt 'a', got '%s'\n", salt)
+	}
+	if salt, _ := store.GetVisitorSalt(1, "b"); salt != "a" {
+		t.Fatalf("exp salt 'a' set first, got '%s'\n", salt)
+	}
+	if salt, _ := store.GetVisitorSalt(2, "c"); salt != "c" {
+		t.Fatalf("exp salt 'c' for next period, got '%s'\n", salt)
+	}
+
+	if revoked, _ := store.RevokeAPIToken("missing", time.Now()); revoked {
+		t.Fatalf("exp missing api token not to be revoked\n")
+	}
+	if revoked, _ := store.RevokeAPIToken("id1", time.Now()); !revoked {
+		t.Fatalf("exp api token to be revoked\n")
+	}
+	if tokens, _ := store.ListAPITokens(); len(tokens) != 1 || tokens[0].RevokedOn.IsZero() {
+		t.Fatalf("exp 1 revoked api token, got %d\n", len(tokens))
+	}
+
+	deleted, err := store.DeleteSite("foo")
+	if !deleted || err != nil {
+		t.Fatalf("exp site to be deleted, got %v, err: '%v'\n", deleted, err)
+	}
+	deleted, _ = store.DeleteSite("foo")
+	if deleted {
+		t.Fatalf("exp site to be deleted only once\n")
+	}
+	if got, _ = store.GetSite("foo"); got != nil {
+		t.Fatalf("exp nil for deleted site, got %+v\n", got)
+	}
+	if views, _ := store.GetSiteViews("foo"); views != 0 {
+		t.Fatalf("exp views of deleted site to be deleted, got %d\n", views)
+	}
+	if tokens, _ := store.ListAPITokens(); len(tokens) != 0 {
+		t.Fatalf("exp api tokens of deleted site to be deleted, got %d\n", len(tokens))
+	}
+	if n, _ := store.GetSiteVisitorCount("foo"); n != 0 {
+		t.Fatalf("exp visitors of deleted site to be deleted, got %d\n", n)
+	}
+	if counters, _ := store.ListTopSiteCounters("foo", siteCounterNotFound, 10); len(counters) != 0 {
+		t.Fatalf("exp counters of deleted site to be deleted, got %d\n", len(counters))
+	}
+
+	// renaming keeps data of the site
+	must(store.PutSite(&siteMeta{Name: "old"}))
+	must(store.PutSite(&siteMeta{Name: "other"}))
+	must(store.SetOwnerTokenHash("old", "hash"))
+	must(store.AddDeploy(&deployInfo{SiteName: "old", FileCount: 1}))
+	must(store.AddSiteViews("old", 2))
+	must(store.AddSiteVisitors("old", []string{"v1"}))
+	must(store.AddSiteCounters("old", []*siteCounter{{Kind: siteCounterPath, Key: "/a", Count: 1}}))
+	must(store.AddAPIToken(&apiToken{ID: "id2", SiteName: "old", tokenHash: "th2"}))
+	if err = store.RenameSite("old", &siteMeta{Name: "other"}); err == nil {
+		t.Fatalf("exp error renaming to existing site\n")
+	}
+	must(store.RenameSite("old", &siteMeta{Name: "new"}))
+	if err = store.RenameSite("old", &siteMeta{Name: "new2"}); err == nil {
+		t.Fatalf("exp error renaming missing site\n")
+	}
+	if got, _ = store.GetSite("old"); got != nil {
+		t.Fatalf("exp no site 'old' after rename\n")
+	}
+	if got, _ = store.GetSite("new"); got == nil {
+		t.Fatalf("exp site 'new' after rename\n")
+	}
+	if tokenHash, _ := store.GetOwnerTokenHash("new"); tokenHash != "hash" {
+		t.Fatalf("exp owner token to be renamed, got '%s'\n", tokenHash)
+	}
+	if deploys, _ := store.ListDeploys("new"); len(deploys) != 1 || deploys[0].SiteName != "new" {
+		t.Fatalf("exp deploy to be renamed, got %d\n", len(deploys))
+	}
+	if views, _ := store.GetSiteViews("new"); views != 2 {
+		t.Fatalf("exp views to be renamed, got %d\n", views)
+	}
+	if n, _ := store.GetSiteVisitorCount("new"); n != 1 {
+		t.Fatalf("exp visitors to be renamed, got %d\n", n)
+	}
+	if counters, _ := store.ListTopSiteCounters("new", siteCounterPath, 10); len(counters) != 1 {
+		t.Fatalf("exp counters to be renamed, got %d\n", len(counters))
+	}
+	if tok, _ = store.GetAPIToken("th2"); tok == nil || tok.SiteName != "new" {
+		t.Fatalf("exp api token to be renamed, got %+v\n", tok)
+	}
+}
+
+func TestMemMetadataStore(t *testing.T) {
+	testMetadataStore(t, newMemMetadataStore())
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GET /metrics on the main site, in Prometheus text format
+// if METRICS_TOKEN env variable is set, requires "Authorization: Bearer ${token}"
+// we write the format ourselves instead of depending on Prometheus client library
+
+const (
+	uploadTypeMultipart = "multipart"
+	uploadTypeRaw       = "raw"
+	uploadTypeZip       = "zip"
+)
+
+var (
+	metricsToken string
+
+	muMetrics sync.Mutex
+	// key is route and status
+	requestsTotal = map[[2]string]int64{}
+	// key is route
+	requestDurations  = map[string]*histogram{}
+	uploadsTotal      = map[string]int64{}
+	uploadBytesTotal  int64
+	sitesExpiredTotal int64
+	unzipErrorsTotal  int64
+
+	// in seconds
+	requestDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+type histogram struct {
+	counts []int64 // for each of requestDurationBuckets
+	count  int64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range requestDurationBuckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func parseMetricsToken() {
+	metricsToken = os.Getenv("METRICS_TOKEN")
+}
+
+// route for metrics, must have low cardinality so no paths or site names
+func metricsRoute(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case r.Method == http.MethodPost || r.Method == http.MethodPut:
+		if strings.HasPrefix(path, adminAPIPrefix) {
+			return "admin_api"
+		}
+		if path == siteLoginPath || path == adminLoginPath || path == adminLogoutPath {
+			return "login"
+		}
+		return "upload"
+	case r.Method == http.MethodDelete:
+		return "delete"
+	case strings.HasPrefix(path, "/__instantpreviewinternal/api/"):
+		return "internal_api"
+	case strings.HasPrefix(path, "/__instantpreviewinternal/"):
+		return "internal"
+	case isMain(r):
+		if path == "/metrics" {
+			return "metrics"
+		}
+		return "main"
+	}
+	return "site"
+}
+
+// withMetrics records count and duration of requests
+func withMetrics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeStart := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		route := metricsRoute(r)
+		defer func() {
+			status := rec.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			dur := time.Since(timeStart).Seconds()
+			muMetrics.Lock()
+			defer muMetrics.Unlock()
+			requestsTotal[[2]string{route, strconv.Itoa(status)}]++
+			hist := requestDurations[route]
+			if hist == nil {
+				hist = &histogram{counts: make([]int64, len(requestDurationBuckets))}
+				requestDurations[route] = hist
+			}
+			hist.observe(dur)
+		}()
+		h.ServeHTTP(rec, r)
+	})
+}
+
+func countUpload(uploadType string, size int64) {
+	muMetrics.Lock()
+	defer muMetrics.Unlock()
+	uploadsTotal[uploadType]++
+	uploadBytesTotal += size
+}
+
+func countSiteExpired() {
+	muMetrics.Lock()
+	defer muMetrics.Unlock()
+	sitesExpiredTotal++
+}
+
+func countUnzipError() {
+	muMetrics.Lock()
+	defer muMetrics.Unlock()
+	unzipErrorsTotal++
+}
+
+func fmtFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeMetrics(w io.Writer) {
+	// calculated before locking muMetrics
+	siteStats, err := metaStore.GetSiteStats()
+	if err != nil {
+		logf(ctx(), logAttrs(logErr(err)), "writeMetrics: metaStore.GetSiteStats() failed")
+	}
+
+	muMetrics.Lock()
+	defer muMetrics.Unlock()
+
+	header := func(name string, typ string, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	header("instaprev_http_requests_total", "counter", "Number of HTTP requests by route and status.")
+	var keys [][2]string
+	for k := range requestsTotal {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b [2]string) int {
+		return strings.Compare(a[0]+" "+a[1], b[0]+" "+b[1])
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "instaprev_http_requests_total{route=%q,status=%q} %d\n", k[0], k[1], requestsTotal[k])
+	}
+
+	header("instaprev_http_request_duration_seconds", "histogram", "Duration of HTTP requests by route.")
+	var routes []string
+	for route := range requestDurations {
+		routes = append(routes, route)
+	}
+	slices.Sort(routes)
+	for _, route := range routes {
+		h := requestDurations[route]
+		for i, b := range requestDurationBuckets {
+			fmt.Fprintf(w, "instaprev_http_request_duration_seconds_bucket{route=%q,le=%q} %d\n", route, fmtFloat(b), h.counts[i])
+		}
+		fmt.Fprintf(w, "instaprev_http_request_duration_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", route, h.count)
+		fmt.Fprintf(w, "instaprev_http_request_duration_seconds_sum{route=%q} %s\n", route, fmtFloat(h.sum))
+		fmt.Fprintf(w, "instaprev_http_request_duration_seconds_count{route=%q} %d\n", route, h.count)
+	}
+
+	header("instaprev_uploads_total", "counter", "Number of uploads by type.")
+	for _, typ := range []string{uploadTypeMultipart, uploadTypeRaw, uploadTypeZip} {
+		fmt.Fprintf(w, "instaprev_uploads_total{type=%q} %d\n", typ, uploadsTotal[typ])
+	}
+	header("instaprev_upload_bytes_total", "counter", "Number of uploaded bytes.")
+	fmt.Fprintf(w, "instaprev_upload_bytes_total %d\n", uploadBytesTotal)
+
+	// better to leave out than report wrong values
+	if siteStats != nil {
+		header("instaprev_sites", "gauge", "Number of sites by kind.")
+		fmt.Fprintf(w, "instaprev_sites{kind=\"premium\"} %d\n", siteStats[true].Count)
+		fmt.Fprintf(w, "instaprev_sites{kind=\"temporary\"} %d\n", siteStats[false].Count)
+		header("instaprev_site_storage_bytes", "gauge", "Size of site files by kind.")
+		fmt.Fprintf(w, "instaprev_site_storage_bytes{kind=\"premium\"} %d\n", siteStats[true].TotalSize)
+		fmt.Fprintf(w, "instaprev_site_storage_bytes{kind=\"temporary\"} %d\n", siteStats[false].TotalSize)
+	}
+
+	header("instaprev_sites_expired_total", "counter", "Number of expired temporary sites.")
+	fmt.Fprintf(w, "instaprev_sites_expired_total %d\n", sitesExpiredTotal)
+	header("instaprev_unzip_errors_total", "counter", "Number of errors unpacking uploaded zip files.")
+	fmt.Fprintf(w, "instaprev_unzip_errors_total %d\n", unzipErrorsTotal)
+}
+
+// GET /metrics
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if metricsToken != "" {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(metricsToken)) != 1 {
+			serveErrorStatus(w, r, http.StatusUnauthorized, "Error: not authorized\n")
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", cacheControlNoCache)
+	writeMetrics(w)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsRoute(t *testing.T) {
+	test := func(method string, host string, uri string, exp string) {
+		r := httptest.NewRequest(method, uri, nil)
+		r.Host = host
+		if got := metricsRoute(r); got != exp {
+			t.Fatalf("%s %s%s: exp '%s', got '%s'\n", method, host, uri, exp, got)
+		}
+	}
+	test("POST", "localhost", "/upload", "upload")
+	test("POST", "localhost", adminAPIPrefix+"sites/delete", "admin_api")
+	test("DELETE", "foo.localhost", "/", "delete")
+	test("GET", "foo.localhost", "/__instantpreviewinternal/api/site-info.json", "internal_api")
+	test("GET", "foo.localhost", "/index.html", "site")
+	test("GET", "localhost", "/metrics", "metrics")
+	test("GET", "localhost", "/", "main")
+}
+
+func TestMetrics(t *testing.T) {
+	setupTestSite(t, "foo", map[string]string{"index.html": "hello"})
+	h := withMetrics(http.HandlerFunc(handleIndex))
+	get := func(host string, uri string, hdrs ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", uri, nil)
+		r.Host = host
+		for i := 0; i < len(hdrs); i += 2 {
+			r.Header.Set(hdrs[i], hdrs[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	get("foo.localhost", "/")
+	get("foo.localhost", "/missing.txt")
+	countUpload(uploadTypeZip, 100)
+
+	w := get("localhost", "/metrics")
+	body := w.Body.String()
+	for _, exp := range []string{
+		`instaprev_http_requests_total{route="site",status="200"}`,
+		`instaprev_http_requests_total{route="site",status="404"}`,
+		`instaprev_http_request_duration_seconds_bucket{route="site",le="+Inf"}`,
+		`instaprev_uploads_total{type="zip"}`,
+		`instaprev_sites{kind="temporary"} 1`,
+		`instaprev_sites{kind="premium"} 0`,
+		`instaprev_site_storage_bytes{kind="temporary"}`,
+		`instaprev_sites_expired_total`,
+		`instaprev_unzip_errors_total`,
+	} {
+		if !strings.Contains(body, exp) {
+			t.Fatalf("exp '%s' in:\n%s\n", exp, body)
+		}
+	}
+
+	metricsToken = "secret"
+	defer func() {
+		metricsToken = ""
+	}()
+	if w = get("localhost", "/metrics"); w.Code != 401 {
+		t.Fatalf("exp 401 without token, got %d\n", w.Code)
+	}
+	if w = get("localhost", "/metrics", "Authorization", "Bearer secret"); w.Code != 200 {
+		t.Fatalf("exp 200 with token, got %d\n", w.Code)
+	}
+	// on site hosts /metrics is a regular path
+	if w = get("foo.localhost", "/metrics"); w.Code != 404 {
+		t.Fatalf("exp 404 for /metrics in a site, got %d\n", w.Code)
+	}
+}
+
+func TestAPISummary(t *testing.T) {
+	site := setupTestSite(t, "foo", map[string]string{"index.html": "hello"})
+	site.totalSize = 5
+	must(saveSite(ctx(), site))
+	bar := &Site{name: "bar", storage: newMemStorage(), isPremium: true, totalSize: 7}
+	must(saveSite(ctx(), bar))
+
+	w := mainRequest("GET", "/__instantpreviewinternal/api/summary.json", "", nil)
+	var summary struct {
+		SitesCount int
+		SitesSize  int64
+	}
+	must(json.Unmarshal(w.Body.Bytes(), &summary))
+	if summary.SitesCount != 2 || summary.SitesSize != 12 {
+		t.Fatalf("exp 2 sites of size 12, got %d sites of size %d\n", summary.SitesCount, summary.SitesSize)
+	}
+}
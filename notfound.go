@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// what to serve when there's no file for a path
+const (
+	// SPA fallback if isSPA, custom 404.html if exists, listing of files otherwise
+	notFoundAuto = ""
+	// custom 404.html with 404 status
+	notFoundCustom = "404"
+	// index.html with 200 status
+	notFoundSPA = "spa"
+	// listing of site files with 404 status
+	notFoundList = "list"
+)
+
+func isValidNotFoundMode(s string) bool {
+	switch s {
+	case notFoundAuto, notFoundCustom, notFoundSPA, notFoundList:
+		return true
+	}
+	return false
+}
+
+// returns value of ?notfound= upload option and true if provided and valid
+func getNotFoundMode(r *http.Request) (string, bool) {
+	q := r.URL.Query()
+	if !q.Has("notfound") {
+		return "", false
+	}
+	mode := strings.ToLower(q.Get("notfound"))
+	if mode == "auto" {
+		mode = notFoundAuto
+	}
+	if !isValidNotFoundMode(mode) {
+		logf(r.Context(), nil, "getNotFoundMode: invalid mode '%s'", mode)
+		return "", false
+	}
+	return mode, true
+}
+
+// find404File finds 404.html closest to the missing path
+// i.e. for "foo/bar/baz" tries "foo/bar/404.html", "foo/404.html", "404.html"
+func find404File(site *Site, toFind string) *siteFile {
+	dir := strings.Trim(toFind, "/")
+	for {
+		dir = filepath.ToSlash(filepath.Dir(dir))
+		if dir == "." || dir == "/" {
+			return findSiteFile(site, "404.html")
+		}
+		if f := findSiteFile(site, dir+"/404.html"); f != nil {
+			return f
+		}
+	}
+}
+
+func serveNotFoundInSite(w http.ResponseWriter, r *http.Request, site *Site, path string, toFind string) {
+	fileIndex := findSiteFile(site, "index.html")
+	file404 := find404File(site, toFind)
+
+	mode := site.notFound
+	if mode == notFoundAuto {
+		switch {
+		case site.isSPA && fileIndex != nil:
+			mode = notFoundSPA
+		case file404 != nil:
+			mode = notFoundCustom
+		default:
+			mode = notFoundList
+		}
+	}
+
+	switch mode {
+	case notFoundSPA:
+		if fileIndex != nil {
+			logf(r.Context(), logAttrs(logSite(site.name), logPath(toFind)), "serveNotFoundInSite: serving index.html because not found and isSPA")
+			applySiteHeaders(w, site, path)
+			countSiteView(r, site, fileIndex)
+			serveSiteFile(w, r, site, fileIndex, http.StatusOK)
+			return
+		}
+	case notFoundCustom:
+		if file404 != nil {
+			logf(r.Context(), logAttrs(logSite(site.name), logPath(toFind)), "serveNotFoundInSite: serving '%s' because not found", file404.Path)
+			applySiteHeaders(w, site, path)
+			countSiteNotFound(r, site)
+			serveSiteFile(w, r, site, file404, http.StatusNotFound)
+			return
+		}
+	}
+
+	pathList := filepath.Join("www", "listSiteFiles.html")
+	// site without index.html shows the list of files
+	if toFind == "" {
+		http.ServeFile(w, r, pathList)
+		return
+	}
+	logf(r.Context(), logAttrs(logSite(site.name), logPath(toFind)), "serveNotFoundInSite: serving listSiteFiles.html because not found")
+	countSiteNotFound(r, site)
+	serveFileWithStatus(w, r, pathList, http.StatusNotFound)
+}
+
+// change what is served for missing paths
+// GET /__instantpreviewinternal/api/set-not-found?mode=${mode}
+func handleAPISetNotFound(w http.ResponseWriter, r *http.Request, site *Site) {
+	mode := strings.ToLower(r.URL.Query().Get("mode"))
+	if mode == "auto" {
+		mode = notFoundAuto
+	}
+	if !isValidNotFoundMode(mode) {
+		serveBadRequestError(w, r, "Error: invalid mode '%s', must be one of: auto, 404, spa, list\n", mode)
+		return
+	}
+	// cached site is used by other requests
+	newSite := &Site{}
+	*newSite = *site
+	newSite.notFound = mode
+	saveSite(r.Context(), newSite)
+
+	redirectURL := r.Header.Get("referer")
+	if redirectURL == "" {
+		redirectURL = "/_dir"
+	}
+	http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
+}
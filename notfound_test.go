@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFind404File(t *testing.T) {
+	site := &Site{}
+	for _, path := range []string{"index.html", "404.html", "docs/404.html", "docs/api/index.html"} {
+		site.files = append(site.files, &siteFile{Path: path})
+	}
+	buildSiteFilesIndex(site)
+	test := func(toFind string, exp string) {
+		got := find404File(site, toFind)
+		if got == nil || got.Path != exp {
+			t.Fatalf("toFind: '%s', exp: '%s', got: %v\n", toFind, exp, got)
+		}
+	}
+	test("missing.html", "404.html")
+	test("blog/missing", "404.html")
+	test("docs/missing", "docs/404.html")
+	test("docs/api/v1/missing/", "docs/404.html")
+}
+
+func TestNotFoundStatus(t *testing.T) {
+	site := setupTestSite(t, "notfoundtest", map[string]string{
+		"index.html":      "index",
+		"404.html":        "root 404",
+		"docs/index.html": "docs index",
+		"docs/404.html":   "docs 404",
+	})
+	test := func(uri string, expStatus int, expBody string) {
+		w := testGet(site, uri)
+		if w.Code != expStatus {
+			t.Fatalf("%s: exp status %d got %d\n", uri, expStatus, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), expBody) {
+			t.Fatalf("%s: exp body with '%s' got '%s'\n", uri, expBody, w.Body.String())
+		}
+	}
+	listing := "not found on this site"
+
+	// auto mode uses the closest 404.html
+	test("/missing.html", http.StatusNotFound, "root 404")
+	test("/docs/missing", http.StatusNotFound, "docs 404")
+	test("/docs/api/missing", http.StatusNotFound, "docs 404")
+
+	site.notFound = notFoundCustom
+	test("/missing.html", http.StatusNotFound, "root 404")
+
+	site.notFound = notFoundList
+	test("/missing.html", http.StatusNotFound, listing)
+	test("/docs/missing", http.StatusNotFound, listing)
+
+	site.notFound = notFoundSPA
+	test("/missing.html", http.StatusOK, "index")
+
+	// without 404.html auto mode shows the listing
+	site = setupTestSite(t, "notfoundtest2", map[string]string{
+		"foo.txt": "foo",
+		"bar.txt": "bar",
+	})
+	test("/missing.html", http.StatusNotFound, listing)
+	// site without index.html shows the listing for /
+	test("/", http.StatusOK, listing)
+}
+
+func TestSetNotFoundChangesCopy(t *testing.T) {
+	site := setupTestSite(t, "setnotfound", map[string]string{"index.html": "index"})
+	w := testGet(site, "/__instantpreviewinternal/api/set-not-found?mode=spa")
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("exp %d, got %d\n", http.StatusTemporaryRedirect, w.Code)
+	}
+	// requests in flight might be using the cached site
+	if site.notFound != "" {
+		t.Fatalf("exp cached site not to change, got mode '%s'\n", site.notFound)
+	}
+	if got := getSite("setnotfound"); got.notFound != notFoundSPA {
+		t.Fatalf("exp mode '%s', got '%s'\n", notFoundSPA, got.notFound)
+	}
+}
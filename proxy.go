@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// hosts that sites are allowed to proxy to, from PROXY_ALLOWED_HOSTS env variable
+// comma-separated list of hosts like: staging.example.com,*.example.org
+var proxyAllowedHosts []string
+
+func parseProxyAllowedHosts() {
+	proxyAllowedHosts = nil
+	for _, s := range strings.Split(os.Getenv("PROXY_ALLOWED_HOSTS"), ",") {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s != "" {
+			proxyAllowedHosts = append(proxyAllowedHosts, s)
+		}
+	}
+	logf(ctx(), nil, "parseProxyAllowedHosts: %v", proxyAllowedHosts)
+}
+
+// "*.example.com" allows "api.example.com" but not "example.com"
+func isProxyHostAllowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range proxyAllowedHosts {
+		if strings.HasPrefix(allowed, "*.") {
+			if strings.HasSuffix(host, allowed[1:]) {
+				return true
+			}
+			continue
+		}
+		if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func isProxyRule(rule *redirectRule) bool {
+	return rule.status == http.StatusOK && isAbsoluteURL(rule.to)
+}
+
+// remove proxy rules whose upstream is not in proxyAllowedHosts
+func filterAllowedProxyRules(rules []*redirectRule) ([]*redirectRule, []string) {
+	var res []*redirectRule
+	var errors []string
+	for _, rule := range rules {
+		if !isProxyRule(rule) {
+			res = append(res, rule)
+			continue
+		}
+		u, err := url.Parse(rule.to)
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("proxy: invalid upstream url '%s'", rule.to))
+			continue
+		}
+		if !isProxyHostAllowed(u.Hostname()) {
+			errors = append(errors, fmt.Sprintf("proxy: upstream host '%s' is not allowed", u.Hostname()))
+			continue
+		}
+		res = append(res, rule)
+	}
+	return res, errors
+}
+
+// proxy rules can also be provided when uploading as:
+// ?proxy=/api/* https://staging.example.com/api/:splat
+// they are in the same format as _redirects file
+func getProxyOptions(r *http.Request) []string {
+	var res []string
+	for _, s := range r.URL.Query()["proxy"] {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			res = append(res, s+" 200")
+		}
+	}
+	return res
+}
+
+// paths that are always uploads, even if a proxy rule matches them
+var uploadPaths = []string{"/upload", "/api/upload"}
+
+// findProxyTarget returns upstream url if the request matches a proxy rule of
+// the site. Proxy rules are matched before POST, PUT and DELETE are treated as
+// uploads and deletes of the site, so that e.g. POST /api/login reaches upstream
+func findProxyTarget(site *Site, r *http.Request) (string, bool) {
+	if stringInSlice(uploadPaths, r.URL.Path) {
+		return "", false
+	}
+	rule, target := findRedirect(site, strings.TrimPrefix(r.URL.Path, "/"))
+	if rule == nil || !isProxyRule(rule) {
+		return "", false
+	}
+	return target, true
+}
+
+// headers with credentials for the preview site, not for upstream
+var proxyStrippedHeaders = []string{"Cookie", "Authorization", "Proxy-Authorization", "X-Owner-Token"}
+
+// proxyQuery returns query of the request without secrets like ?token=
+func proxyQuery(u *url.URL) string {
+	q := u.Query()
+	changed := false
+	for _, name := range secretQueryParams {
+		if q.Has(name) {
+			q.Del(name)
+			changed = true
+		}
+	}
+	if !changed {
+		return u.RawQuery
+	}
+	return q.Encode()
+}
+
+// forward the request to upstream url
+func proxyToUpstream(w http.ResponseWriter, r *http.Request, target string) {
+	if query := proxyQuery(r.URL); query != "" && !strings.Contains(target, "?") {
+		target += "?" + query
+	}
+	upstream, err := url.Parse(target)
+	if err != nil {
+		serveInternalError(w, r, "proxyToUpstream: url.Parse('%s') failed with '%s'\n", target, err)
+		return
+	}
+	// re-check in case the list of allowed hosts changed
+	if !isProxyHostAllowed(upstream.Hostname()) {
+		serveErrorStatus(w, r, http.StatusForbidden, "Error: proxying to '%s' is not allowed\n", upstream.Host)
+		return
+	}
+	logf(r.Context(), nil, "proxyToUpstream: '%s' => '%s'", r.URL, upstream)
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL = upstream
+			req.Host = upstream.Host
+			for _, name := range proxyStrippedHeaders {
+				req.Header.Del(name)
+			}
+			// upstream sees the request as coming from the preview site
+			req.Header.Set("X-Forwarded-Host", r.Host)
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			serveErrorStatus(w, req, http.StatusBadGateway, "Error: proxying to '%s' failed with '%s'\n", upstream, err)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func setProxyAllowedHosts(t *testing.T, hosts ...string) {
+	prev := proxyAllowedHosts
+	proxyAllowedHosts = hosts
+	t.Cleanup(func() {
+		proxyAllowedHosts = prev
+	})
+}
+
+func TestIsProxyHostAllowed(t *testing.T) {
+	setProxyAllowedHosts(t, "staging.example.com", "*.example.org")
+	test := func(host string, exp bool) {
+		got := isProxyHostAllowed(host)
+		if got != exp {
+			t.Fatalf("isProxyHostAllowed('%s'): exp %v got %v\n", host, exp, got)
+		}
+	}
+	test("staging.example.com", true)
+	test("Staging.Example.com", true)
+	test("api.example.com", false)
+	test("example.com", false)
+	test("api.example.org", true)
+	test("a.b.example.org", true)
+	test("example.org", false)
+	test("evilexample.org", false)
+}
+
+func TestFilterAllowedProxyRules(t *testing.T) {
+	setProxyAllowedHosts(t, "staging.example.com")
+	s := `/api/* https://staging.example.com/api/:splat 200
+/evil/* https://evil.com/:splat 200
+/old /new 301
+`
+	rules, _ := parseRedirectsFile([]byte(s))
+	rules, errors := filterAllowedProxyRules(rules)
+	if len(rules) != 2 || rules[0].from != "/api/*" || rules[1].from != "/old" {
+		t.Fatalf("exp rules for /api/* and /old, got %d rules\n", len(rules))
+	}
+	if len(errors) != 1 || !strings.Contains(errors[0], "evil.com") {
+		t.Fatalf("exp error about evil.com, got %v\n", errors)
+	}
+}
+
+func TestGetProxyOptions(t *testing.T) {
+	uri := "/upload?proxy=" + url.QueryEscape("/api/* https://staging.example.com/api/:splat") + "&proxy=+"
+	r := httptest.NewRequest("POST", uri, nil)
+	got := getProxyOptions(r)
+	if len(got) != 1 || got[0] != "/api/* https://staging.example.com/api/:splat 200" {
+		t.Fatalf("unexpected proxy options: %v\n", got)
+	}
+}
+
+// proxy rules to hosts not in the allowlist are dropped when the site is published
+func TestProxyRulesDroppedAtUpload(t *testing.T) {
+	setProxyAllowedHosts(t, "staging.example.com")
+	site := setupTestSite(t, "proxydrop", map[string]string{
+		"index.html": "<html></html>",
+		"_redirects": "/evil/* https://evil.com/:splat 200\n",
+	})
+	site.proxyOptions = []string{"/api/* https://staging.example.com/api/:splat 200", "/x/* https://x.com/:splat 200"}
+	errors := loadSiteConfig(ctx(), site)
+	if len(site.redirects) != 1 || site.redirects[0].from != "/api/*" {
+		t.Fatalf("exp only /api/* rule, got %d rules\n", len(site.redirects))
+	}
+	if len(errors) != 2 {
+		t.Fatalf("exp 2 errors, got %v\n", errors)
+	}
+}
+
+func TestProxyToUpstream(t *testing.T) {
+	var got *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		io.WriteString(w, "from upstream")
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	setProxyAllowedHosts(t, u.Hostname())
+	site := setupTestSite(t, "proxytest", map[string]string{
+		"index.html": "<html></html>",
+		"_redirects": "/api/* " + upstream.URL + "/v1/:splat 200\n",
+	})
+	w := testGet(site, "/api/users?id=5&token=secret&access-code=1234",
+		"Cookie", siteAccessCookie+"=x",
+		"Authorization", "Bearer ipt_secret",
+		"X-Owner-Token", "owner",
+		"X-Custom", "keep")
+	if w.Code != http.StatusOK || w.Body.String() != "from upstream" {
+		t.Fatalf("exp response from upstream, got %d '%s'\n", w.Code, w.Body.String())
+	}
+	if got.URL.Path != "/v1/users" {
+		t.Fatalf("exp path '/v1/users', got '%s'\n", got.URL.Path)
+	}
+	if got.URL.RawQuery != "id=5" {
+		t.Fatalf("exp query 'id=5', got '%s'\n", got.URL.RawQuery)
+	}
+	for _, name := range []string{"Cookie", "Authorization", "X-Owner-Token"} {
+		if v := got.Header.Get(name); v != "" {
+			t.Fatalf("exp header %s not to be forwarded, got '%s'\n", name, v)
+		}
+	}
+	if v := got.Header.Get("X-Custom"); v != "keep" {
+		t.Fatalf("exp X-Custom 'keep', got '%s'\n", v)
+	}
+	if v := got.Header.Get("X-Forwarded-Host"); v != "proxytest.localhost" {
+		t.Fatalf("exp X-Forwarded-Host 'proxytest.localhost', got '%s'\n", v)
+	}
+
+	// allowlist changed after the site was uploaded
+	setProxyAllowedHosts(t, "staging.example.com")
+	got = nil
+	w = testGet(site, "/api/users")
+	if w.Code != http.StatusForbidden || got != nil {
+		t.Fatalf("exp %d and no upstream request, got %d\n", http.StatusForbidden, w.Code)
+	}
+}
+
+func TestProxyPost(t *testing.T) {
+	var gotMethod, gotBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		d, _ := io.ReadAll(r.Body)
+		gotBody = string(d)
+		io.WriteString(w, "logged in")
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	setProxyAllowedHosts(t, u.Hostname())
+	site := setupTestSite(t, "proxypost", map[string]string{
+		"index.html": "<html></html>",
+		"_redirects": "/api/* " + upstream.URL + "/:splat 200\n",
+	})
+	test := func(method string, uri string, expCode int, expUpstream bool) {
+		t.Helper()
+		gotMethod = ""
+		r := httptest.NewRequest(method, uri, strings.NewReader("user=foo"))
+		r.Host = site.name + ".localhost"
+		w := httptest.NewRecorder()
+		handleIndex(w, r)
+		if w.Code != expCode || (gotMethod != "") != expUpstream {
+			t.Fatalf("%s %s: exp %d, upstream: %v, got %d, upstream method: '%s'\n", method, uri, expCode, expUpstream, w.Code, gotMethod)
+		}
+	}
+	test("POST", "/api/login", http.StatusOK, true)
+	if gotBody != "user=foo" {
+		t.Fatalf("exp body 'user=foo', got '%s'\n", gotBody)
+	}
+	test("DELETE", "/api/session", http.StatusOK, true)
+	// uploads without owner token still fail
+	test("POST", "/upload", http.StatusBadRequest, false)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// a rule from Netlify-style _redirects file:
+// /from /to [status][!]
+type redirectRule struct {
+	from   string
+	to     string
+	status int
+	// if false, the rule only applies if there's no file for the path
+	force bool
+}
+
+var rxPlaceholder = regexp.MustCompile(`:[a-zA-Z][a-zA-Z0-9_]*`)
+
+func isRedirectStatus(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// statuses that serve the target of the rule instead of redirecting
+func isRewriteStatus(status int) bool {
+	switch status {
+	case http.StatusOK, http.StatusNotFound, http.StatusGone:
+		return true
+	}
+	return false
+}
+
+func isAbsoluteURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// parseRedirectsFile parses Netlify-style _redirects file
+// returns rules and a description of each invalid line
+func parseRedirectsFile(d []byte) ([]*redirectRule, []string) {
+	var rules []*redirectRule
+	var errors []string
+	addError := func(lineNo int, format string, args ...interface{}) {
+		s := fmt.Sprintf("_redirects: line %d: ", lineNo) + fmt.Sprintf(format, args...)
+		errors = append(errors, s)
+	}
+	d = normalizeNewlines(d)
+	lines := strings.Split(string(d), "\n")
+	for i, l := range lines {
+		lineNo := i + 1
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		parts := strings.Fields(l)
+		if len(parts) > 3 && strings.Contains(l, "=") {
+			addError(lineNo, "query parameters and conditions are not supported in '%s'", l)
+			continue
+		}
+		if len(parts) < 2 || len(parts) > 3 {
+			addError(lineNo, "invalid rule '%s', expected '/from /to [status]'", l)
+			continue
+		}
+		rule := &redirectRule{
+			from:   parts[0],
+			to:     parts[1],
+			status: http.StatusMovedPermanently,
+		}
+		if !strings.HasPrefix(rule.from, "/") {
+			addError(lineNo, "path '%s' must start with '/'", rule.from)
+			continue
+		}
+		if !strings.HasPrefix(rule.to, "/") && !isAbsoluteURL(rule.to) {
+			addError(lineNo, "target '%s' must be a path or an absolute url", rule.to)
+			continue
+		}
+		if len(parts) == 3 {
+			s := parts[2]
+			if strings.HasSuffix(s, "!") {
+				rule.force = true
+				s = strings.TrimSuffix(s, "!")
+			}
+			status, err := strconv.Atoi(s)
+			if err != nil || !(isRedirectStatus(status) || isRewriteStatus(status)) {
+				addError(lineNo, "invalid status '%s'", parts[2])
+				continue
+			}
+			rule.status = status
+		}
+		// 200 with absolute url proxies to upstream, other rewrites must be local
+		if rule.status != http.StatusOK && isRewriteStatus(rule.status) && isAbsoluteURL(rule.to) {
+			addError(lineNo, "status %d requires a path, not '%s'", rule.status, rule.to)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, errors
+}
+
+// replace :splat and :name placeholders in s with values
+func expandPlaceholders(s string, vals map[string]string) string {
+	return rxPlaceholder.ReplaceAllStringFunc(s, func(placeholder string) string {
+		if v, ok := vals[placeholder[1:]]; ok {
+			return v
+		}
+		return placeholder
+	})
+}
+
+// findRedirect returns the first rule from _redirects matching path and its
+// target with placeholders expanded. Rules that are not forced don't apply to
+// paths for which there is a file
+func findRedirect(site *Site, path string) (*redirectRule, string) {
+	if len(site.redirects) == 0 {
+		return nil, ""
+	}
+	fileExists := findFileForPath(site, path) != nil
+	for _, rule := range site.redirects {
+		if fileExists && !rule.force {
+			continue
+		}
+		vals, ok := matchPathPattern(rule.from, path)
+		if !ok {
+			continue
+		}
+		return rule, expandPlaceholders(rule.to, vals)
+	}
+	return nil, ""
+}
+
+// rules come from _redirects file and proxy rules provided at upload time
+func loadRedirectsConfig(site *Site) []string {
+	site.redirects = nil
+	var errors []string
+	var d []byte
+	f := findSiteFile(site, "_redirects")
+	if f != nil {
+		var err error
+		d, err = readSiteFile(site, f)
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("_redirects: failed to read: %s", err))
+		}
+	}
+	rules, parseErrors := parseRedirectsFile(d)
+	errors = append(errors, parseErrors...)
+	if len(site.proxyOptions) > 0 {
+		opts := []byte(strings.Join(site.proxyOptions, "\n"))
+		proxyRules, proxyErrors := parseRedirectsFile(opts)
+		for _, s := range proxyErrors {
+			errors = append(errors, "proxy option"+strings.TrimPrefix(s, "_redirects"))
+		}
+		// proxy rules from upload options take precedence over _redirects
+		rules = append(proxyRules, rules...)
+	}
+	rules, proxyErrors := filterAllowedProxyRules(rules)
+	errors = append(errors, proxyErrors...)
+	site.redirects = rules
+	return errors
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseRedirectsFile(t *testing.T) {
+	s := `# comment
+/old /new
+/blog/:year/* /posts/:year/:splat 302
+/app/* /index.html 200!
+/bad
+/store id=:id /blog/:id 301
+/x /y 999
+`
+	rules, errors := parseRedirectsFile([]byte(s))
+	if len(rules) != 3 {
+		t.Fatalf("exp 3 rules, got %d\n", len(rules))
+	}
+	if len(errors) != 3 {
+		t.Fatalf("exp 3 errors, got %v\n", errors)
+	}
+	if rules[0].status != 301 || rules[0].force {
+		t.Fatalf("unexpected rule: %#v\n", rules[0])
+	}
+	if rules[2].status != 200 || !rules[2].force {
+		t.Fatalf("unexpected rule: %#v\n", rules[2])
+	}
+
+	vals, ok := matchPathPattern(rules[1].from, "/blog/2022/03/hello")
+	if !ok {
+		t.Fatalf("'%s' should match\n", rules[1].from)
+	}
+	got := expandPlaceholders(rules[1].to, vals)
+	if got != "/posts/2022/03/hello" {
+		t.Fatalf("exp: '/posts/2022/03/hello', got: '%s'\n", got)
+	}
+}
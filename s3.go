@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// optional storage of site files in S3-compatible bucket (AWS S3, MinIO,
+// Cloudflare R2, Backblaze B2), so that multiple instances can share files
+// configured with env variables:
+// S3_ENDPOINT e.g. https://s3.us-east-1.amazonaws.com or http://localhost:9000
+// S3_BUCKET, S3_ACCESS_KEY, S3_SECRET_KEY, S3_REGION (defaults to us-east-1)
+// objects are addressed path-style i.e. ${endpoint}/${bucket}/${key}
+
+type s3Client struct {
+	endpoint  string
+	bucket    string
+	accessKey string
+	secretKey string
+	region    string
+	client    *http.Client
+}
+
+// if set, site files are stored in S3
+var s3Bucket *s3Client
+
+func parseS3Config() {
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return
+	}
+	c := &s3Client{
+		endpoint:  strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/"),
+		bucket:    bucket,
+		accessKey: os.Getenv("S3_ACCESS_KEY"),
+		secretKey: os.Getenv("S3_SECRET_KEY"),
+		region:    os.Getenv("S3_REGION"),
+	}
+	if c.endpoint == "" {
+		c.endpoint = "https://s3.amazonaws.com"
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	s3Bucket = c
+	logf(ctx(), nil, "parseS3Config: storing site files in bucket '%s' at '%s'", c.bucket, c.endpoint)
+}
+
+// s3 uri encoding: everything except A-Za-z0-9-_.~ is %XX encoded
+func s3URIEncode(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		isUnreserved := (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~'
+		if isUnreserved || (b == '/' && !encodeSlash) {
+			sb.WriteByte(b)
+			continue
+		}
+		fmt.Fprintf(&sb, "%%%02X", b)
+	}
+	return sb.String()
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// s3CanonicalQuery encodes query the way it's signed: sorted, with spaces
+// as %20. url.Values.Encode() uses + for spaces, so we must send the query
+// encoded this way or the signature won't match
+func s3CanonicalQuery(query url.Values) string {
+	var queryParts []string
+	for k, vals := range query {
+		for _, v := range vals {
+			queryParts = append(queryParts, s3URIEncode(k, true)+"="+s3URIEncode(v, true))
+		}
+	}
+	sort.Strings(queryParts)
+	return strings.Join(queryParts, "&")
+}
+
+// signRequest adds AWS Signature Version 4 Authorization header
+// unless x-amz-content-sha256 is already set, payload is not signed,
+// which is allowed by S3
+func (c *s3Client) signRequest(r *http.Request, now time.Time) {
+	payloadHash := r.Header.Get("x-amz-content-sha256")
+	if payloadHash == "" {
+		payloadHash = "UNSIGNED-PAYLOAD"
+	}
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	r.Header.Set("x-amz-date", amzDate)
+	r.Header.Set("x-amz-content-sha256", payloadHash)
+
+	canonicalHeaders := "host:" + r.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		s3URIEncode(r.URL.Path, false),
+		s3CanonicalQuery(r.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	h := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(h[:])
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), day)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	auth := fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.accessKey, scope, signedHeaders, sig)
+	r.Header.Set("Authorization", auth)
+}
+
+// do sends a signed request for an object with a given key
+// returns an error for non-2xx responses
+func (c *s3Client) do(method string, key string, query url.Values, body io.Reader, size int64, hdrs http.Header) (*http.Response, error) {
+	uri := c.endpoint + "/" + c.bucket
+	if key != "" {
+		uri += "/" + key
+	}
+	r, err := http.NewRequest(method, uri, body)
+	if err != nil {
+		return nil, err
+	}
+	r.URL.RawPath = s3URIEncode(r.URL.Path, false)
+	r.URL.RawQuery = s3CanonicalQuery(query)
+	if body != nil {
+		r.ContentLength = size
+	}
+	for k, v := range hdrs {
+		r.Header[k] = v
+	}
+	c.signRequest(r, time.Now())
+	client := c.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	rsp, err := client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode >= 200 && rsp.StatusCode < 300 {
+		return rsp, nil
+	}
+	d, _ := io.ReadAll(io.LimitReader(rsp.Body, 1024))
+	rsp.Body.Close()
+	if rsp.StatusCode == http.StatusNotFound {
+		return nil, fs.ErrNotExist
+	}
+	return nil, fmt.Errorf("s3: %s '%s' failed with status %d: '%s'", method, key, rsp.StatusCode, strings.TrimSpace(string(d)))
+}
+
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+}
+
+// s3ObjectInfo is fs.FileInfo for an object in s3
+type s3ObjectInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi *s3ObjectInfo) Name() string       { return path.Base(fi.name) }
+func (fi *s3ObjectInfo) Size() int64        { return fi.size }
+func (fi *s3ObjectInfo) Mode() fs.FileMode  { return 0444 }
+func (fi *s3ObjectInfo) ModTime() time.Time { return fi.modTime }
+func (fi *s3ObjectInfo) IsDir() bool        { return false }
+func (fi *s3ObjectInfo) Sys() interface{}   { return nil }
+
+// listObjects returns all objects whose keys start with prefix
+func (c *s3Client) listObjects(prefix string) ([]*s3ObjectInfo, error) {
+	var res []*s3ObjectInfo
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		rsp, err := c.do(http.MethodGet, "", q, nil, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+		var lr s3ListResult
+		err = xml.NewDecoder(rsp.Body).Decode(&lr)
+		rsp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range lr.Contents {
+			fi := &s3ObjectInfo{
+				name:    o.Key,
+				size:    o.Size,
+				modTime: o.LastModified,
+			}
+			res = append(res, fi)
+		}
+		if !lr.IsTruncated || lr.NextContinuationToken == "" {
+			return res, nil
+		}
+		token = lr.NextContinuationToken
+	}
+}
+
+// s3SiteStorage stores files of a site as objects under a key prefix
+type s3SiteStorage struct {
+	c      *s3Client
+	prefix string // e.g. "sites/foo/"
+}
+
+func newS3SiteStorage(c *s3Client, prefix string) *s3SiteStorage {
+	return &s3SiteStorage{c: c, prefix: prefix}
+}
+
+// s3File streams object content with GET requests. Seeking issues a new
+// request with Range header, which is needed for http.ServeContent
+type s3File struct {
+	c    *s3Client
+	key  string
+	fi   *s3ObjectInfo
+	body io.ReadCloser
+	pos  int64 // position in body
+	off  int64 // position set by Seek
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) {
+	return f.fi, nil
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.off >= f.fi.size {
+		return 0, io.EOF
+	}
+	if f.body != nil && f.off != f.pos {
+		f.body.Close()
+		f.body = nil
+	}
+	if f.body == nil {
+		hdrs := http.Header{}
+		hdrs.Set("Range", fmt.Sprintf("bytes=%d-", f.off))
+		rsp, err := f.c.do(http.MethodGet, f.key, nil, nil, 0, hdrs)
+		if err != nil {
+			return 0, err
+		}
+		f.body = rsp.Body
+		f.pos = f.off
+	}
+	n, err := f.body.Read(p)
+	f.pos += int64(n)
+	f.off = f.pos
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		// no-op
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.fi.size
+	default:
+		return 0, errors.New("s3File.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("s3File.Seek: negative position")
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body == nil {
+		return nil
+	}
+	err := f.body.Close()
+	f.body = nil
+	return err
+}
+
+func (s *s3SiteStorage) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	key := s.prefix + name
+	rsp, err := s.c.do(http.MethodGet, key, nil, nil, 0, nil)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	fi := &s3ObjectInfo{
+		name:    name,
+		size:    rsp.ContentLength,
+		modTime: time.Now(),
+	}
+	if t, err := http.ParseTime(rsp.Header.Get("Last-Modified")); err == nil {
+		fi.modTime = t
+	}
+	if fi.size < 0 {
+		fi.size, _ = strconv.ParseInt(rsp.Header.Get("Content-Length"), 10, 64)
+	}
+	f := &s3File{
+		c:    s.c,
+		key:  key,
+		fi:   fi,
+		body: rsp.Body,
+	}
+	return f, nil
+}
+
+// files up to s3PartSize are uploaded with a single PUT on Close, bigger
+// files are streamed with a multipart upload, one part at a time, so that
+// we only keep one part in memory. S3 requires parts of at least 5 MB
+const s3PartSize = 8 * 1024 * 1024
+
+// s3FileWriter uploads content written to it to an object in S3
+type s3FileWriter struct {
+	s        *s3SiteStorage
+	key      string
+	buf      bytes.Buffer
+	uploadID string
+	parts    []s3CompletedPart
+	err      error
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (w *s3FileWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, _ := w.buf.Write(p)
+	if w.buf.Len() >= s3PartSize {
+		w.err = w.uploadPart()
+	}
+	return n, w.err
+}
+
+// uploadPart uploads buffered content as the next part of multipart upload
+func (w *s3FileWriter) uploadPart() error {
+	c := w.s.c
+	if w.uploadID == "" {
+		q := url.Values{}
+		q.Set("uploads", "")
+		rsp, err := c.do(http.MethodPost, w.key, q, nil, 0, nil)
+		if err != nil {
+			return err
+		}
+		var res struct {
+			UploadId string
+		}
+		err = xml.NewDecoder(rsp.Body).Decode(&res)
+		rsp.Body.Close()
+		if err != nil {
+			return err
+		}
+		w.uploadID = res.UploadId
+	}
+	partNumber := len(w.parts) + 1
+	q := url.Values{}
+	q.Set("partNumber", strconv.Itoa(partNumber))
+	q.Set("uploadId", w.uploadID)
+	rsp, err := c.do(http.MethodPut, w.key, q, bytes.NewReader(w.buf.Bytes()), int64(w.buf.Len()), nil)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	w.parts = append(w.parts, s3CompletedPart{PartNumber: partNumber, ETag: rsp.Header.Get("ETag")})
+	w.buf.Reset()
+	return nil
+}
+
+func (w *s3FileWriter) Close() error {
+	err := w.err
+	if err == nil {
+		err = w.finish()
+	}
+	if err != nil && w.uploadID != "" {
+		// otherwise uploaded parts are stored (and billed) until aborted
+		q := url.Values{}
+		q.Set("uploadId", w.uploadID)
+		if rsp, err := w.s.c.do(http.MethodDelete, w.key, q, nil, 0, nil); err == nil {
+			rsp.Body.Close()
+		}
+	}
+	w.buf = bytes.Buffer{}
+	return err
+}
+
+func (w *s3FileWriter) finish() error {
+	c := w.s.c
+	if w.uploadID == "" {
+		rsp, err := c.do(http.MethodPut, w.key, nil, bytes.NewReader(w.buf.Bytes()), int64(w.buf.Len()), nil)
+		if err != nil {
+			return err
+		}
+		rsp.Body.Close()
+		return nil
+	}
+	// last part can be smaller than 5 MB
+	if w.buf.Len() > 0 {
+		if err := w.uploadPart(); err != nil {
+			return err
+		}
+	}
+	d, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+	q := url.Values{}
+	q.Set("uploadId", w.uploadID)
+	rsp, err := c.do(http.MethodPost, w.key, q, bytes.NewReader(d), int64(len(d)), nil)
+	if err != nil {
+		return err
+	}
+	// S3 can report an error with status 200 after it started responding
+	body, err := io.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(body, []byte("<Error>")) {
+		return fmt.Errorf("s3: completing upload of '%s' failed: '%s'", w.key, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (s *s3SiteStorage) Create(name string) (io.WriteCloser, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	return &s3FileWriter{s: s, key: s.prefix + name}, nil
+}
+
+func (s *s3SiteStorage) RemoveAll() error {
+	objects, err := s.c.listObjects(s.prefix)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, o := range objects {
+		rsp, err := s.c.do(http.MethodDelete, o.name, nil, nil, 0, nil)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		rsp.Body.Close()
+	}
+	return lastErr
+}
+
+func (s *s3SiteStorage) listFiles() ([]*siteFile, int64, error) {
+	objects, err := s.c.listObjects(s.prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+	var res []*siteFile
+	var totalSize int64
+	for _, o := range objects {
+		name := strings.TrimPrefix(o.name, s.prefix)
+		f := &siteFile{
+			Path:       name,
+			Size:       o.size,
+			pathInForm: name,
+		}
+		res = append(res, f)
+		totalSize += o.size
+	}
+	return res, totalSize, nil
+}
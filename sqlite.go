@@ -0,0 +1,513 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMetadataStore keeps sites in SQLite database. Many instances
+// on the same machine can share it
+type sqliteMetadataStore struct {
+	db *sql.DB
+}
+
+// schema changes, applied in order at startup. Never change an existing
+// migration, add a new one. PRAGMA user_version is the number of applied migrations
+var sqliteMigrations = []string{
+	`CREATE TABLE sites (
+		name TEXT PRIMARY KEY,
+		is_premium INTEGER NOT NULL,
+		created_on INTEGER NOT NULL,
+		updated_on INTEGER NOT NULL,
+		meta TEXT NOT NULL
+	);
+	CREATE TABLE owner_tokens (
+		site_name TEXT PRIMARY KEY,
+		token_hash TEXT NOT NULL
+	);
+	CREATE TABLE deploys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		site_name TEXT NOT NULL,
+		created_on INTEGER NOT NULL,
+		file_count INTEGER NOT NULL,
+		total_size INTEGER NOT NULL,
+		ip TEXT NOT NULL,
+		user_agent TEXT NOT NULL
+	);
+	CREATE INDEX deploys_site_name ON deploys(site_name);`,
+	`CREATE TABLE api_tokens (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		site_name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		created_on INTEGER NOT NULL,
+		expires_on INTEGER NOT NULL,
+		last_used_on INTEGER NOT NULL,
+		revoked_on INTEGER NOT NULL
+	);`,
+	`CREATE TABLE site_views (
+		site_name TEXT PRIMARY KEY,
+		views INTEGER NOT NULL
+	);
+	CREATE TABLE site_visitors (
+		site_name TEXT NOT NULL,
+		visitor_hash TEXT NOT NULL,
+		PRIMARY KEY (site_name, visitor_hash)
+	);
+	CREATE TABLE site_counters (
+		site_name TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		key TEXT NOT NULL,
+		count INTEGER NOT NULL,
+		PRIMARY KEY (site_name, kind, key)
+	);`,
+	// so that metrics don't have to read meta of all sites
+	`ALTER TABLE sites ADD COLUMN total_size INTEGER NOT NULL DEFAULT 0;
+	UPDATE sites SET total_size = COALESCE(json_extract(meta, '$.TotalSize'), 0);`,
+	`CREATE TABLE visitor_salts (
+		period INTEGER PRIMARY KEY,
+		salt TEXT NOT NULL
+	);`,
+}
+
+func getMetadataDBPath() string {
+	return filepath.Join(getStateDir(), "instaprev.db")
+}
+
+func openSQLiteMetadataStore(path string) (*sqliteMetadataStore, error) {
+	// busy_timeout because other instances might be writing
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := &sqliteMetadataStore{db: db}
+	err = s.migrate()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *sqliteMetadataStore) migrate() error {
+	var version int
+	err := s.db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+	for ; version < len(sqliteMigrations); version++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(sqliteMigrations[version])
+		if err == nil {
+			// PRAGMA doesn't support parameters
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1))
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+		if err != nil {
+			return fmt.Errorf("migration %d failed with '%w'", version+1, err)
+		}
+		logf(ctx(), nil, "sqliteMetadataStore.migrate: applied migration %d", version+1)
+	}
+	return nil
+}
+
+func (s *sqliteMetadataStore) PutSite(m *siteMeta) error {
+	d, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	q := `INSERT INTO sites (name, is_premium, created_on, updated_on, total_size, meta) VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT(name) DO UPDATE SET is_premium=excluded.is_premium, created_on=excluded.created_on, updated_on=excluded.updated_on, total_size=excluded.total_size, meta=excluded.meta`
+	_, err = s.db.Exec(q, m.Name, m.IsPremium, m.CreatedOn.UnixNano(), m.UpdatedOn.UnixNano(), m.TotalSize, string(d))
+	return err
+}
+
+func (s *sqliteMetadataStore) GetSite(name string) (*siteMeta, error) {
+	var d string
+	err := s.db.QueryRow(`SELECT meta FROM sites WHERE name = ?`, name).Scan(&d)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m siteMeta
+	err = json.Unmarshal([]byte(d), &m)
+	return &m, err
+}
+
+func (s *sqliteMetadataStore) ListSites() ([]*siteMeta, error) {
+	rows, err := s.db.Query(`SELECT meta FROM sites`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*siteMeta
+	for rows.Next() {
+		var d string
+		if err := rows.Scan(&d); err != nil {
+			return nil, err
+		}
+		var m siteMeta
+		if err := json.Unmarshal([]byte(d), &m); err != nil {
+			return nil, err
+		}
+		res = append(res, &m)
+	}
+	return res, rows.Err()
+}
+
+func (s *sqliteMetadataStore) DeleteSite(name string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`DELETE FROM sites WHERE name = ?`, name)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	for _, table := range sqliteSiteTables {
+		if _, err = tx.Exec(`DELETE FROM `+table+` WHERE site_name = ?`, name); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// tables with data of a site, other than sites
+var sqliteSiteTables = []string{"owner_tokens", "deploys", "site_views", "api_tokens", "site_visitors", "site_counters"}
+
+func (s *sqliteMetadataStore) RenameSite(oldName string, m *siteMeta) error {
+	d, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`DELETE FROM sites WHERE name = ?`, oldName)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return fmt.Errorf("site '%s' doesn't exist", oldName)
+	}
+	q := `INSERT INTO sites (name, is_premium, created_on, updated_on, total_size, meta) VALUES (?, ?, ?, ?, ?, ?)`
+	_, err = tx.Exec(q, m.Name, m.IsPremium, m.CreatedOn.UnixNano(), m.UpdatedOn.UnixNano(), m.TotalSize, string(d))
+	if err != nil {
+		return err
+	}
+	for _, table := range sqliteSiteTables {
+		// left by a deleted site with the new name
+		if _, err = tx.Exec(`DELETE FROM `+table+` WHERE site_name = ?`, m.Name); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`UPDATE `+table+` SET site_name = ? WHERE site_name = ?`, m.Name, oldName); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteMetadataStore) GetSiteStats() (map[bool]*siteStats, error) {
+	rows, err := s.db.Query(`SELECT is_premium, COUNT(*), SUM(total_size) FROM sites GROUP BY is_premium`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := map[bool]*siteStats{true: {}, false: {}}
+	for rows.Next() {
+		var isPremium bool
+		var st siteStats
+		if err := rows.Scan(&isPremium, &st.Count, &st.TotalSize); err != nil {
+			return nil, err
+		}
+		res[isPremium] = &st
+	}
+	return res, rows.Err()
+}
+
+func (s *sqliteMetadataStore) SetOwnerTokenHash(name string, tokenHash string) error {
+	q := `INSERT INTO owner_tokens (site_name, token_hash) VALUES (?, ?)
+	ON CONFLICT(site_name) DO UPDATE SET token_hash=excluded.token_hash`
+	_, err := s.db.Exec(q, name, tokenHash)
+	return err
+}
+
+func (s *sqliteMetadataStore) GetOwnerTokenHash(name string) (string, error) {
+	var res string
+	err := s.db.QueryRow(`SELECT token_hash FROM owner_tokens WHERE site_name = ?`, name).Scan(&res)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return res, err
+}
+
+func (s *sqliteMetadataStore) AddDeploy(d *deployInfo) error {
+	q := `INSERT INTO deploys (site_name, created_on, file_count, total_size, ip, user_agent) VALUES (?, ?, ?, ?, ?, ?)`
+	_, err := s.db.Exec(q, d.SiteName, d.CreatedOn.UnixNano(), d.FileCount, d.TotalSize, d.IP, d.UserAgent)
+	return err
+}
+
+func (s *sqliteMetadataStore) ListDeploys(name string) ([]*deployInfo, error) {
+	q := `SELECT created_on, file_count, total_size, ip, user_agent FROM deploys WHERE site_name = ? ORDER BY id DESC`
+	rows, err := s.db.Query(q, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*deployInfo
+	for rows.Next() {
+		d := &deployInfo{SiteName: name}
+		var createdOn int64
+		if err := rows.Scan(&createdOn, &d.FileCount, &d.TotalSize, &d.IP, &d.UserAgent); err != nil {
+			return nil, err
+		}
+		d.CreatedOn = time.Unix(0, createdOn)
+		res = append(res, d)
+	}
+	return res, rows.Err()
+}
+
+func (s *sqliteMetadataStore) ListLastDeploys() (map[string]*deployInfo, error) {
+	q := `SELECT site_name, created_on, file_count, total_size, ip, user_agent FROM deploys
+	WHERE id IN (SELECT MAX(id) FROM deploys GROUP BY site_name)`
+	rows, err := s.db.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := map[string]*deployInfo{}
+	for rows.Next() {
+		d := &deployInfo{}
+		var createdOn int64
+		if err := rows.Scan(&d.SiteName, &createdOn, &d.FileCount, &d.TotalSize, &d.IP, &d.UserAgent); err != nil {
+			return nil, err
+		}
+		d.CreatedOn = time.Unix(0, createdOn)
+		res[d.SiteName] = d
+	}
+	return res, rows.Err()
+}
+
+func (s *sqliteMetadataStore) AddSiteViews(name string, n int64) error {
+	q := `INSERT INTO site_views (site_name, views) VALUES (?, ?)
+	ON CONFLICT(site_name) DO UPDATE SET views = views + excluded.views`
+	_, err := s.db.Exec(q, name, n)
+	return err
+}
+
+func (s *sqliteMetadataStore) GetSiteViews(name string) (int64, error) {
+	var res int64
+	err := s.db.QueryRow(`SELECT views FROM site_views WHERE site_name = ?`, name).Scan(&res)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return res, err
+}
+
+func (s *sqliteMetadataStore) AddSiteVisitors(name string, visitorHashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var n int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM site_visitors WHERE site_name = ?`, name).Scan(&n)
+	if err != nil {
+		return err
+	}
+	for _, h := range visitorHashes {
+		if n >= maxSiteVisitors {
+			break
+		}
+		res, err := tx.Exec(`INSERT OR IGNORE INTO site_visitors (site_name, visitor_hash) VALUES (?, ?)`, name, h)
+		if err != nil {
+			return err
+		}
+		added, _ := res.RowsAffected()
+		n += int(added)
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteMetadataStore) GetVisitorSalt(period int64, newSalt string) (string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(`DELETE FROM visitor_salts WHERE period < ?`, period); err != nil {
+		return "", err
+	}
+	// another instance might have set it first
+	if _, err = tx.Exec(`INSERT OR IGNORE INTO visitor_salts (period, salt) VALUES (?, ?)`, period, newSalt); err != nil {
+		return "", err
+	}
+	var salt string
+	if err = tx.QueryRow(`SELECT salt FROM visitor_salts WHERE period = ?`, period).Scan(&salt); err != nil {
+		return "", err
+	}
+	return salt, tx.Commit()
+}
+
+func (s *sqliteMetadataStore) GetSiteVisitorCount(name string) (int64, error) {
+	var res int64
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM site_visitors WHERE site_name = ?`, name).Scan(&res)
+	return res, err
+}
+
+func (s *sqliteMetadataStore) AddSiteCounters(name string, counters []*siteCounter) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// number of stored keys of kinds in counters
+	nKeys := map[string]int{}
+	for _, c := range counters {
+		if _, ok := nKeys[c.Kind]; ok {
+			continue
+		}
+		var n int
+		err = tx.QueryRow(`SELECT COUNT(*) FROM site_counters WHERE site_name = ? AND kind = ?`, name, c.Kind).Scan(&n)
+		if err != nil {
+			return err
+		}
+		nKeys[c.Kind] = n
+	}
+	for _, c := range counters {
+		res, err := tx.Exec(`UPDATE site_counters SET count = count + ? WHERE site_name = ? AND kind = ? AND key = ?`, c.Count, name, c.Kind, c.Key)
+		if err != nil {
+			return err
+		}
+		if updated, _ := res.RowsAffected(); updated > 0 || nKeys[c.Kind] >= maxSiteCounterKeys {
+			continue
+		}
+		_, err = tx.Exec(`INSERT INTO site_counters (site_name, kind, key, count) VALUES (?, ?, ?, ?)`, name, c.Kind, c.Key, c.Count)
+		if err != nil {
+			return err
+		}
+		nKeys[c.Kind]++
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteMetadataStore) ListTopSiteCounters(name string, kind string, limit int) ([]*siteCounter, error) {
+	q := `SELECT key, count FROM site_counters WHERE site_name = ? AND kind = ? ORDER BY count DESC, key LIMIT ?`
+	rows, err := s.db.Query(q, name, kind, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*siteCounter
+	for rows.Next() {
+		c := &siteCounter{Kind: kind}
+		if err := rows.Scan(&c.Key, &c.Count); err != nil {
+			return nil, err
+		}
+		res = append(res, c)
+	}
+	return res, rows.Err()
+}
+
+// times are stored as unix nano, 0 for zero time
+func timeToSQL(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func timeFromSQL(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+func (s *sqliteMetadataStore) AddAPIToken(t *apiToken) error {
+	q := `INSERT INTO api_tokens (id, name, site_name, token_hash, scopes, created_on, expires_on, last_used_on, revoked_on) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := s.db.Exec(q, t.ID, t.Name, t.SiteName, t.tokenHash, strings.Join(t.Scopes, ","), timeToSQL(t.CreatedOn), timeToSQL(t.ExpiresOn), timeToSQL(t.LastUsedOn), timeToSQL(t.RevokedOn))
+	return err
+}
+
+const sqlAPITokenColumns = `id, name, site_name, token_hash, scopes, created_on, expires_on, last_used_on, revoked_on`
+
+func scanAPIToken(row interface{ Scan(...any) error }) (*apiToken, error) {
+	t := &apiToken{}
+	var scopes string
+	var createdOn, expiresOn, lastUsedOn, revokedOn int64
+	err := row.Scan(&t.ID, &t.Name, &t.SiteName, &t.tokenHash, &scopes, &createdOn, &expiresOn, &lastUsedOn, &revokedOn)
+	if err != nil {
+		return nil, err
+	}
+	t.Scopes = strings.Split(scopes, ",")
+	t.CreatedOn = timeFromSQL(createdOn)
+	t.ExpiresOn = timeFromSQL(expiresOn)
+	t.LastUsedOn = timeFromSQL(lastUsedOn)
+	t.RevokedOn = timeFromSQL(revokedOn)
+	return t, nil
+}
+
+func (s *sqliteMetadataStore) GetAPIToken(tokenHash string) (*apiToken, error) {
+	row := s.db.QueryRow(`SELECT `+sqlAPITokenColumns+` FROM api_tokens WHERE token_hash = ?`, tokenHash)
+	t, err := scanAPIToken(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return t, err
+}
+
+func (s *sqliteMetadataStore) ListAPITokens() ([]*apiToken, error) {
+	rows, err := s.db.Query(`SELECT ` + sqlAPITokenColumns + ` FROM api_tokens ORDER BY created_on`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*apiToken
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, t)
+	}
+	return res, rows.Err()
+}
+
+func (s *sqliteMetadataStore) SetAPITokenLastUsed(id string, lastUsedOn time.Time) error {
+	_, err := s.db.Exec(`UPDATE api_tokens SET last_used_on = ? WHERE id = ?`, timeToSQL(lastUsedOn), id)
+	return err
+}
+
+func (s *sqliteMetadataStore) RevokeAPIToken(id string, revokedOn time.Time) (bool, error) {
+	res, err := s.db.Exec(`UPDATE api_tokens SET revoked_on = ? WHERE id = ?`, timeToSQL(revokedOn), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
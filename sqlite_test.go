@@ -0,0 +1,46 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteMetadataStore(t *testing.T) {
+	silenceLogs(t)
+	path := filepath.Join(t.TempDir(), "test.db")
+	store, err := openSQLiteMetadataStore(path)
+	must(err)
+	testMetadataStore(t, store)
+	must(store.PutSite(&siteMeta{Name: "bar"}))
+	store.db.Close()
+
+	// migrations are only applied once
+	store, err = openSQLiteMetadataStore(path)
+	must(err)
+	defer store.db.Close()
+	m, err := store.GetSite("bar")
+	if err != nil || m == nil {
+		t.Fatalf("exp site 'bar' after re-opening, got err: '%v'\n", err)
+	}
+}
+
+func TestSQLiteSiteSizeMigration(t *testing.T) {
+	silenceLogs(t)
+	path := filepath.Join(t.TempDir(), "test.db")
+	prev := sqliteMigrations
+	sqliteMigrations = prev[:3]
+	store, err := openSQLiteMetadataStore(path)
+	sqliteMigrations = prev
+	must(err)
+	_, err = store.db.Exec(`INSERT INTO sites (name, is_premium, created_on, updated_on, meta) VALUES ('foo', 1, 0, 0, '{"TotalSize":9}')`)
+	must(err)
+	store.db.Close()
+
+	store, err = openSQLiteMetadataStore(path)
+	must(err)
+	defer store.db.Close()
+	stats, err := store.GetSiteStats()
+	if err != nil || stats[true].Count != 1 || stats[true].TotalSize != 9 {
+		t.Fatalf("exp premium site of size 9 after migration, got %+v, err: '%v'\n", stats[true], err)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// siteStorage stores files of a site. Files are read with fs.FS
+// interface, names are siteFile.Path i.e. "foo/bar.html"
+type siteStorage interface {
+	fs.FS
+	// Create creates or truncates a file for writing
+	Create(name string) (io.WriteCloser, error)
+	// RemoveAll deletes all files of the site
+	RemoveAll() error
+}
+
+var errReadOnlyStorage = errors.New("storage is read-only")
+
+// siteStorageName returns name of the directory or key prefix with files of the site
+func siteStorageName(site *Site) string {
+	if site.storageID == "" {
+		return site.name
+	}
+	return site.name + "@" + site.storageID
+}
+
+// useNewSiteStorage switches the site to a new, empty storage. Re-uploads are
+// written there so that files of the site are only replaced if upload succeeds
+func useNewSiteStorage(site *Site) {
+	site.storageID = generateRandomHex(4)
+	site.dir = filepath.Join(filepath.Dir(site.dir), siteStorageName(site))
+	site.storage = newSiteStorage(site)
+	site.files = nil
+	site.totalSize = 0
+}
+
+// newSiteStorage returns storage for files of the site, in S3 if configured
+func newSiteStorage(site *Site) siteStorage {
+	if s3Bucket != nil {
+		prefix := "sites/" + siteStorageName(site) + "/"
+		if site.isPremium {
+			prefix = "premium/" + siteStorageName(site) + "/"
+		}
+		return newS3SiteStorage(s3Bucket, prefix)
+	}
+	return newDiskStorage(site.dir)
+}
+
+// listStorageFiles returns all files in the storage, used to load
+// premium sites at startup
+func listStorageFiles(storage siteStorage) ([]*siteFile, int64, error) {
+	if lister, ok := storage.(interface {
+		listFiles() ([]*siteFile, int64, error)
+	}); ok {
+		return lister.listFiles()
+	}
+	return nil, 0, errors.New("storage doesn't support listing files")
+}
+
+// diskStorage stores files of a site in a directory
+type diskStorage struct {
+	dir string
+}
+
+func newDiskStorage(dir string) *diskStorage {
+	return &diskStorage{dir: dir}
+}
+
+func (s *diskStorage) listFiles() ([]*siteFile, int64, error) {
+	files, totalSize := getSiteFilesFromDir(s.dir)
+	return files, totalSize, nil
+}
+
+func (s *diskStorage) path(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", fs.ErrInvalid
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(name)), nil
+}
+
+func (s *diskStorage) Open(name string) (fs.File, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return os.Open(path)
+}
+
+func (s *diskStorage) Create(name string) (io.WriteCloser, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: err}
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(path)
+}
+
+func (s *diskStorage) RemoveAll() error {
+	return os.RemoveAll(s.dir)
+}
+
+// memStorage stores files in memory, used in tests
+type memStorage struct {
+	mu    sync.Mutex
+	files map[string]*memFileInfo
+}
+
+type memFileInfo struct {
+	name    string
+	data    []byte
+	modTime time.Time
+}
+
+func (fi *memFileInfo) Name() string       { return filepath.Base(fi.name) }
+func (fi *memFileInfo) Size() int64        { return int64(len(fi.data)) }
+func (fi *memFileInfo) Mode() fs.FileMode  { return 0444 }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return false }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
+
+type memFile struct {
+	*bytes.Reader
+	fi *memFileInfo
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.fi, nil }
+func (f *memFile) Close() error               { return nil }
+
+type memFileWriter struct {
+	bytes.Buffer
+	s    *memStorage
+	name string
+}
+
+func (w *memFileWriter) Close() error {
+	w.s.mu.Lock()
+	w.s.files[w.name] = &memFileInfo{
+		name:    w.name,
+		data:    w.Bytes(),
+		modTime: time.Now(),
+	}
+	w.s.mu.Unlock()
+	return nil
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{files: map[string]*memFileInfo{}}
+}
+
+func (s *memStorage) Open(name string) (fs.File, error) {
+	s.mu.Lock()
+	fi := s.files[name]
+	s.mu.Unlock()
+	if fi == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memFile{Reader: bytes.NewReader(fi.data), fi: fi}, nil
+}
+
+func (s *memStorage) Create(name string) (io.WriteCloser, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	return &memFileWriter{s: s, name: name}, nil
+}
+
+func (s *memStorage) RemoveAll() error {
+	s.mu.Lock()
+	s.files = map[string]*memFileInfo{}
+	s.mu.Unlock()
+	return nil
+}
+
+// writeSiteFile saves content of r as a file in site storage
+func writeSiteFile(site *Site, name string, r io.Reader) (int64, error) {
+	w, err := site.storage.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, r)
+	err2 := w.Close()
+	if err == nil {
+		err = err2
+	}
+	return n, err
+}
+
+// openSiteFile opens a file from site storage for reading and seeking
+func openSiteFile(site *Site, f *siteFile) (io.ReadSeekCloser, time.Time, error) {
+	file, err := site.storage.Open(f.Path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	st, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, time.Time{}, err
+	}
+	if rs, ok := file.(io.ReadSeekCloser); ok {
+		return rs, st.ModTime(), nil
+	}
+	// storage doesn't support seeking, so read into memory
+	d, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return nopCloser{bytes.NewReader(d)}, st.ModTime(), nil
+}
+
+func readSiteFile(site *Site, f *siteFile) ([]byte, error) {
+	return fs.ReadFile(site.storage, f.Path)
+}
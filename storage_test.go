@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSiteStorage(t *testing.T, storage siteStorage) {
+	site := &Site{storage: storage}
+	_, err := writeSiteFile(site, "foo/bar.txt", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("exp no error, got '%s'\n", err)
+	}
+	d, err := fs.ReadFile(storage, "foo/bar.txt")
+	if err != nil || string(d) != "hello" {
+		t.Fatalf("exp 'hello', got '%s', err: '%v'\n", d, err)
+	}
+	// must not write outside of the site
+	_, err = writeSiteFile(site, "../bar.txt", strings.NewReader("hello"))
+	if err == nil {
+		t.Fatalf("exp error for '../bar.txt', got nil\n")
+	}
+	must(storage.RemoveAll())
+	_, err = storage.Open("foo/bar.txt")
+	if err == nil {
+		t.Fatalf("exp error after RemoveAll(), got nil\n")
+	}
+}
+
+func TestSiteStorage(t *testing.T) {
+	testSiteStorage(t, newDiskStorage(t.TempDir()))
+	testSiteStorage(t, newMemStorage())
+}
+
+// re-uploads are written to a new storage that replaces site's files
+// only if the upload succeeds
+func TestReuploadReplacesStorage(t *testing.T) {
+	site := setupTestSite(t, "foo", nil)
+	site.dir = filepath.Join(getDataDir(), "foo")
+	site.storage = newSiteStorage(site)
+	_, err := writeSiteFile(site, "index.html", strings.NewReader("v1"))
+	must(err)
+	site.files = []*siteFile{{Path: "index.html", Size: 2}}
+	buildSiteFilesIndex(site)
+	calcSiteFilesETags(ctx(), site)
+	pwdHash, err := hashPassword("pwd")
+	must(err)
+	site.isPremium = true
+	site.uploadPasswordHash = pwdHash
+	site.updatedOn = time.Now()
+	must(saveSite(ctx(), site))
+
+	upload := func(files map[string]string) int {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for path, content := range files {
+			fw, err := mw.CreateFormFile(path, path)
+			must(err)
+			_, err = fw.Write([]byte(content))
+			must(err)
+		}
+		must(mw.WriteField("foo", "bar"))
+		must(mw.Close())
+		r := httptest.NewRequest("POST", "/upload", &body)
+		r.Host = "foo.localhost"
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		r.Header.Set("Authorization", "Bearer pwd")
+		w := httptest.NewRecorder()
+		handleIndex(w, r)
+		return w.Code
+	}
+	expContent := func(exp string) {
+		w := testGet(getSite("foo"), "/index.html")
+		if got := w.Body.String(); got != exp {
+			t.Fatalf("exp '%s', got '%s'\n", exp, got)
+		}
+	}
+
+	if code := upload(nil); code != http.StatusBadRequest {
+		t.Fatalf("exp %d, got %d\n", http.StatusBadRequest, code)
+	}
+	expContent("v1")
+
+	if code := upload(map[string]string{"index.html": "v2"}); code != http.StatusOK {
+		t.Fatalf("exp %d, got %d\n", http.StatusOK, code)
+	}
+	expContent("v2")
+	if pathExists(site.dir) {
+		t.Fatalf("exp '%s' to be removed\n", site.dir)
+	}
+	entries, err := os.ReadDir(getDataDir())
+	must(err)
+	for _, e := range entries {
+		if e.IsDir() && e.Name() != filepath.Base(getSite("foo").dir) {
+			t.Fatalf("exp only files of the new upload, got '%s'\n", e.Name())
+		}
+	}
+}
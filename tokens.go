@@ -0,0 +1,212 @@
+package main
+
+import (
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// api tokens are used by CI pipelines instead of sharing site password
+// a token is for a single premium site or global (for all sites)
+// sent as "Authorization: Bearer ${token}" or ?token=${token}
+
+const (
+	// upload files to the site. A global token can also create temporary sites
+	scopeUpload = "upload"
+	// delete the site
+	scopeDelete = "delete"
+	// view private (password-protected) site
+	scopeReadPrivate = "read-private"
+
+	apiTokenPrefix = "ipt_"
+
+	// LastUsedOn is updated at most this often so that we don't write
+	// to the database on every request
+	apiTokenLastUsedResolution = time.Minute
+)
+
+var apiTokenScopes = []string{scopeUpload, scopeDelete, scopeReadPrivate}
+
+// if true, creating temporary sites requires a global api token with upload scope
+// set with REQUIRE_UPLOAD_TOKEN env variable
+var requireUploadToken bool
+
+type apiToken struct {
+	ID         string
+	Name       string
+	SiteName   string // "" for global token
+	Scopes     []string
+	CreatedOn  time.Time
+	ExpiresOn  time.Time `json:",omitzero"` // zero if doesn't expire
+	LastUsedOn time.Time `json:",omitzero"`
+	RevokedOn  time.Time `json:",omitzero"`
+
+	// we only store sha256 of token
+	tokenHash string
+}
+
+func (t *apiToken) hasScope(scope string) bool {
+	return stringInSlice(t.Scopes, scope)
+}
+
+func (t *apiToken) isActive() bool {
+	if !t.RevokedOn.IsZero() {
+		return false
+	}
+	return t.ExpiresOn.IsZero() || time.Now().Before(t.ExpiresOn)
+}
+
+func generateRandomHex(n int) string {
+	d := make([]byte, n)
+	_, err := cryptorand.Read(d)
+	must(err)
+	return hex.EncodeToString(d)
+}
+
+// newAPIToken creates a token and returns it together with its secret value
+// which is only shown once
+func newAPIToken(name string, siteName string, scopes []string, expiresOn time.Time) (*apiToken, string) {
+	t := &apiToken{
+		ID:        generateRandomHex(8),
+		Name:      name,
+		SiteName:  siteName,
+		Scopes:    scopes,
+		CreatedOn: time.Now(),
+		ExpiresOn: expiresOn,
+	}
+	token := apiTokenPrefix + generateRandomHex(24)
+	t.tokenHash = hashOwnerToken(token)
+	return t, token
+}
+
+// getRequestAPIToken returns api token sent with the request or ""
+func getRequestAPIToken(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("token")
+	}
+	token = strings.TrimSpace(token)
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return ""
+	}
+	return token
+}
+
+// isAuthorizedWithAPIToken returns true if request has an active api token
+// with a given scope for the site. site is nil when creating temporary site
+func isAuthorizedWithAPIToken(r *http.Request, site *Site, scope string) bool {
+	token := getRequestAPIToken(r)
+	if token == "" {
+		return false
+	}
+	t, err := metaStore.GetAPIToken(hashOwnerToken(token))
+	if err != nil {
+		logf(r.Context(), logAttrs(logErr(err)), "isAuthorizedWithAPIToken: metaStore.GetAPIToken() failed")
+		return false
+	}
+	if t == nil || !t.isActive() || !t.hasScope(scope) {
+		return false
+	}
+	if t.SiteName != "" && (site == nil || site.name != t.SiteName) {
+		return false
+	}
+	if time.Since(t.LastUsedOn) >= apiTokenLastUsedResolution {
+		if err = metaStore.SetAPITokenLastUsed(t.ID, time.Now()); err != nil {
+			logf(r.Context(), logAttrs(logErr(err)), "isAuthorizedWithAPIToken: metaStore.SetAPITokenLastUsed('%s') failed", t.ID)
+		}
+	}
+	logf(r.Context(), nil, "isAuthorizedWithAPIToken: authorized with token '%s' (%s) for scope '%s'", t.Name, t.ID, scope)
+	return true
+}
+
+func parseRequireUploadToken() {
+	requireUploadToken = os.Getenv("REQUIRE_UPLOAD_TOKEN") == "1"
+}
+
+// parses scopes in "upload,delete" format
+func parseAPITokenScopes(s string) ([]string, bool) {
+	var res []string
+	for _, scope := range strings.Split(s, ",") {
+		scope = strings.TrimSpace(scope)
+		if !stringInSlice(apiTokenScopes, scope) {
+			return nil, false
+		}
+		res = append(res, scope)
+	}
+	return res, len(res) > 0
+}
+
+// POST /__instantpreviewinternal/api/admin/tokens/create?name=${name}&site=${site}&scopes=upload,delete&expires=2030-01-01
+// site is optional, no site creates a global token
+func handleAdminCreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		serveBadRequestError(w, r, "Error: missing name\n")
+		return
+	}
+	siteName := strings.ToLower(r.FormValue("site"))
+	if siteName != "" {
+		site := getSite(siteName)
+		if site == nil || !site.isPremium {
+			serveErrorStatus(w, r, http.StatusNotFound, "Error: no premium site '%s'\n", siteName)
+			return
+		}
+		auditAdminSite(r, siteName, false)
+	}
+	scopes, ok := parseAPITokenScopes(r.FormValue("scopes"))
+	if !ok {
+		serveBadRequestError(w, r, "Error: invalid scopes '%s', must be one or more of: %s\n", r.FormValue("scopes"), strings.Join(apiTokenScopes, ","))
+		return
+	}
+	expiresOn, ok := parseExpiration(r.FormValue("expires"))
+	if !ok {
+		serveBadRequestError(w, r, "Error: invalid expires '%s', must be a date like 2030-01-31 or duration like 720h\n", r.FormValue("expires"))
+		return
+	}
+	t, token := newAPIToken(name, siteName, scopes, expiresOn)
+	if err := metaStore.AddAPIToken(t); err != nil {
+		serveInternalError(w, r, "handleAdminCreateAPIToken: metaStore.AddAPIToken() failed with '%s'\n", err)
+		return
+	}
+	logf(r.Context(), logAttrs(logSite(siteName)), "handleAdminCreateAPIToken: created token '%s' (%s), scopes: %v", t.Name, t.ID, scopes)
+	v := struct {
+		*apiToken
+		Token string
+	}{
+		apiToken: t,
+		Token:    token,
+	}
+	serveJSON(w, r, v)
+}
+
+// POST /__instantpreviewinternal/api/admin/tokens/list
+func handleAdminListAPITokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := metaStore.ListAPITokens()
+	if err != nil {
+		serveInternalError(w, r, "handleAdminListAPITokens: metaStore.ListAPITokens() failed with '%s'\n", err)
+		return
+	}
+	if tokens == nil {
+		tokens = []*apiToken{}
+	}
+	serveJSON(w, r, tokens)
+}
+
+// POST /__instantpreviewinternal/api/admin/tokens/revoke?id=${id}
+func handleAdminRevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	id := r.FormValue("id")
+	ok, err := metaStore.RevokeAPIToken(id, time.Now())
+	if err != nil {
+		serveInternalError(w, r, "handleAdminRevokeAPIToken: metaStore.RevokeAPIToken('%s') failed with '%s'\n", id, err)
+		return
+	}
+	if !ok {
+		serveErrorStatus(w, r, http.StatusNotFound, "Error: no token with id '%s'\n", id)
+		return
+	}
+	logf(r.Context(), nil, "handleAdminRevokeAPIToken: revoked token '%s'", id)
+	serveJSON(w, r, struct{ ID string }{ID: id})
+}
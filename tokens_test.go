@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseAPITokenScopes(t *testing.T) {
+	test := func(s string, expOk bool, exp ...string) {
+		got, ok := parseAPITokenScopes(s)
+		if ok != expOk || len(got) != len(exp) {
+			t.Fatalf("s: '%s', exp %v %v, got %v %v\n", s, exp, expOk, got, ok)
+		}
+		for i := range exp {
+			if got[i] != exp[i] {
+				t.Fatalf("s: '%s', exp %v, got %v\n", s, exp, got)
+			}
+		}
+	}
+	test("upload", true, "upload")
+	test("upload, delete", true, "upload", "delete")
+	test("read-private", true, "read-private")
+	test("", false)
+	test("upload,admin", false)
+}
+
+func TestAPITokens(t *testing.T) {
+	site := setupTestSite(t, "foo", map[string]string{"index.html": "hello"})
+	site.isPremium = true
+	must(saveSite(ctx(), site))
+	sitesPassword = "admin"
+	defer func() {
+		sitesPassword = ""
+	}()
+
+	createToken := func(uri string) string {
+		w := adminPost(uri, "admin")
+		if w.Code != 200 {
+			t.Fatalf("uri: '%s', exp 200, got %d, body: '%s'\n", uri, w.Code, w.Body.String())
+		}
+		var v struct {
+			ID    string
+			Token string
+		}
+		must(json.Unmarshal(w.Body.Bytes(), &v))
+		return v.Token
+	}
+	if w := adminPost("tokens/create?name=ci&site=bar&scopes=upload", "admin"); w.Code != 404 {
+		t.Fatalf("exp 404 for token of missing site, got %d\n", w.Code)
+	}
+	if w := adminPost("tokens/create?name=ci&scopes=upload&expires=soon", "admin"); w.Code != 400 {
+		t.Fatalf("exp 400 for invalid expires, got %d\n", w.Code)
+	}
+	uploadToken := createToken("tokens/create?name=ci&site=foo&scopes=upload")
+	deleteToken := createToken("tokens/create?name=cleanup&site=foo&scopes=delete&expires=1h")
+	expiredToken := createToken("tokens/create?name=old&scopes=upload,delete&expires=2001-01-01")
+
+	test := func(method string, token string, scope string, exp bool) {
+		r := httptest.NewRequest(method, "/", nil)
+		r.Host = "foo.localhost"
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		if got := isAuthorizedWithAPIToken(r, site, scope); got != exp {
+			t.Fatalf("token: '%s', scope: '%s', exp %v, got %v\n", token, scope, exp, got)
+		}
+	}
+	test("POST", "", scopeUpload, false)
+	test("POST", "ipt_invalid", scopeUpload, false)
+	test("POST", uploadToken, scopeUpload, true)
+	test("POST", uploadToken, scopeDelete, false)
+	test("POST", expiredToken, scopeUpload, false)
+	if isAuthorizedWithAPIToken(httptest.NewRequest("POST", "/?token="+uploadToken, nil), &Site{name: "bar"}, scopeUpload) {
+		t.Fatalf("exp site token not to work for other sites\n")
+	}
+
+	tokens, err := metaStore.ListAPITokens()
+	if err != nil || len(tokens) != 3 || tokens[0].LastUsedOn.IsZero() {
+		t.Fatalf("exp 3 tokens, first one used, got %d, err: '%v'\n", len(tokens), err)
+	}
+	// last used time is not updated on every request
+	lastUsedOn := tokens[0].LastUsedOn
+	test("POST", uploadToken, scopeUpload, true)
+	tokens, _ = metaStore.ListAPITokens()
+	if !tokens[0].LastUsedOn.Equal(lastUsedOn) {
+		t.Fatalf("exp last used time not to change within %s\n", apiTokenLastUsedResolution)
+	}
+	if w := adminPost("tokens/revoke?id="+tokens[0].ID, "admin"); w.Code != 200 {
+		t.Fatalf("exp 200 for revoke, got %d\n", w.Code)
+	}
+	test("POST", uploadToken, scopeUpload, false)
+
+	del := func(token string, expCode int) {
+		r := httptest.NewRequest("DELETE", "/", nil)
+		r.Host = "foo.localhost"
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handleIndex(w, r)
+		if w.Code != expCode {
+			t.Fatalf("exp %d, got %d\n", expCode, w.Code)
+		}
+	}
+	del(uploadToken, 401)
+	// would come back at next start
+	site.fromEnv = true
+	must(saveSite(ctx(), site))
+	del(deleteToken, 409)
+	site.fromEnv = false
+	must(saveSite(ctx(), site))
+	del(deleteToken, 204)
+	if getSite("foo") != nil {
+		t.Fatalf("exp site 'foo' to be deleted\n")
+	}
+}
@@ -2,8 +2,15 @@ package main
 
 import (
 	"archive/zip"
+	"bytes"
+	"context"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"io"
 	"math/rand"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -57,107 +64,90 @@ func canonicalPath(path string) string {
 	return strings.TrimPrefix(path, "/")
 }
 
-// updates info in site
-func unpackZipFiles(zipFiles []string, site *Site) error {
+// unpackZipFile extracts files from zip into site storage, updates info in site
+func unpackZipFile(ctx context.Context, site *Site, ra io.ReaderAt, size int64, zipName string) error {
 	var lastErr error
 
 	timeStart := time.Now()
-	dir := site.dir
-	nUnpacked := 0
-	for _, zipFile := range zipFiles {
-		logf(ctx(), "unpackZipFiles: unpacking '%s'\n", zipFile)
-		st, err := os.Lstat(zipFile)
+	logf(ctx, logAttrs(logSite(site.name)), "unpackZipFile: unpacking '%s'", zipName)
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		logf(ctx, logAttrs(logSite(site.name), logErr(err)), "unpackZipFile: zip.NewReader() for '%s' failed", zipName)
+		countUnzipError()
+		return err
+	}
+
+	// trim common prefix. if files inside zip files are all under foo/,
+	// we want to remove foo/ from the paths and host the files under root
+	// TODO: possible that files extract from zip will over-write other files
+	fileNames := zipEntryNames(zr)
+
+	// now extract using fixed-up file names
+	for i, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			//logf(ctx, logAttrs(logPath(f.Name)), "unpackZipFile: skipping directory")
+			continue
+		}
+		if isBlacklistedFileType(f.Name) {
+			logf(ctx, logAttrs(logSite(site.name), logPath(f.Name)), "unpackZipFile: skipping blacklisted file in '%s'", zipName)
+			continue
+		}
+
+		fr, err := f.Open()
 		if err != nil {
 			lastErr = err
-			logf(ctx(), "unpackZipFile: os.Lstat('%s') failed with '%s'\n", zipFile, err)
+			logf(ctx, logAttrs(logSite(site.name), logPath(f.Name), logErr(err)), "unpackZipFile: f.Open() in '%s' failed", zipName)
 			continue
 		}
-		size := st.Size()
-		f, err := os.Open(zipFile)
+		path := fileNames[i]
+		//logf(ctx, logAttrs(logPath(path)), "unpackZipFile: unpacking")
+		_, err = writeSiteFile(site, path, fr)
+		fr.Close()
 		if err != nil {
 			lastErr = err
-			logf(ctx(), "unpackZipFile: os.Open('%s') failed with '%s'\n", zipFile, err)
+			logf(ctx, logAttrs(logSite(site.name), logPath(path), logErr(err)), "unpackZipFile: writeSiteFile() for '%s' failed", zipName)
 			continue
 		}
-		zr, err := zip.NewReader(f, size)
+		sf := &siteFile{
+			Path:       path,
+			Size:       int64(f.UncompressedSize64),
+			pathInForm: path,
+		}
+		site.files = append(site.files, sf)
+		site.totalSize += int64(f.UncompressedSize64)
+	}
+	logf(ctx, logAttrs(logSite(site.name)), "unpackZipFile: unpacked %d files, total size: %s, in %s", len(fileNames), u.FormatSize(site.totalSize), time.Since(timeStart))
+	if lastErr != nil {
+		countUnzipError()
+	}
+	return lastErr
+}
+
+// unpackZipFiles extracts zip files that are part of the site
+func unpackZipFiles(ctx context.Context, zipFiles []*siteFile, site *Site) error {
+	var lastErr error
+	for _, zf := range zipFiles {
+		f, err := site.storage.Open(zf.Path)
 		if err != nil {
 			lastErr = err
-			logf(ctx(), "unpackZipFile: zip.NewReader() for '%s' failed with '%s'\n", zipFile, err)
-			f.Close()
+			logf(ctx, logAttrs(logSite(site.name), logPath(zf.Path), logErr(err)), "unpackZipFiles: site.storage.Open() failed")
 			continue
 		}
-
-		// trim common prefix. if files inside zip files are all under foo/,
-		// we want to remove foo/ from the paths and host the files under root
-		// TODO: possible that files extract from zip will over-write other files
-		fileNames := []string{}
-		for _, f := range zr.File {
-			path := canonicalPath(f.Name)
-			fileNames = append(fileNames, path)
+		ra, ok := f.(io.ReaderAt)
+		if !ok {
+			// storage doesn't support random access, so read into memory
+			var d []byte
+			d, err = io.ReadAll(f)
+			ra = bytes.NewReader(d)
 		}
-		stringsTrimSlashPrefix(fileNames)
-		trimCommonDirPrefix(fileNames)
-
-		// now extract using fixed-up file names
-		for i, f := range zr.File {
-			if f.FileInfo().IsDir() {
-				//logf(ctx(), "unpackZipFile: skipping directory '%s' in '%s'\n", f.Name, zipFile)
-				continue
-			}
-			if isBlacklistedFileType(f.Name) {
-				logf(ctx(), "unpackZipFile: skipping blacklisted file '%s' in '%s'\n", f.Name, zipFile)
-				continue
-			}
-
-			fr, err := f.Open()
-			if err != nil {
-				lastErr = err
-				logf(ctx(), "unpackZipFile: f.Open() of '%s' in '%s' failed with '%s'\n", f.Name, zipFile, err)
-				continue
-			}
-			path := filepath.Join(dir, fileNames[i])
-			//logf(ctx(), "  unpacking '%s' => '%s'\n", f.Name, path)
-			nUnpacked++
-
-			err = os.MkdirAll(filepath.Dir(path), 755)
-			if err != nil {
-				fr.Close()
-				lastErr = err
-				logf(ctx(), "unpackZipFile: os.MkdirAll('%s') for '%s' failed with '%s'\n", filepath.Dir(path), zipFile, err)
-				continue
-			}
-
-			w, err := os.Create(path)
-			if err != nil {
-				fr.Close()
-				lastErr = err
-				logf(ctx(), "unpackZipFile: os.Create('%s') for '%s' failed with '%s'\n", path, zipFile, err)
-				continue
-			}
-			_, err = io.Copy(w, fr)
-			fr.Close()
-			err2 := w.Close()
-
-			if err != nil || err2 != nil {
-				lastErr = err
-				if err == nil {
-					lastErr = err2
-				}
-				logf(ctx(), "unpackZipFile: io.Copy() to '%s' for '%s' failed with '%s'\n", path, zipFile, err)
-			}
-			sf := &siteFile{
-				Path:       fileNames[i],
-				Size:       int64(f.UncompressedSize64),
-				pathOnDisk: filepath.Join(dir, fileNames[i]),
-				pathInForm: fileNames[i],
-			}
-			site.files = append(site.files, sf)
-			site.totalSize += int64(f.UncompressedSize64)
+		if err == nil {
+			err = unpackZipFile(ctx, site, ra, zf.Size, zf.Path)
 		}
 		f.Close()
-		logf(ctx(), "unpackZipFiles: unpacked %d files, total size: %s, in %s\n", len(fileNames), u.FormatSize(site.totalSize), time.Since(timeStart))
+		if err != nil {
+			lastErr = err
+		}
 	}
-
 	return lastErr
 }
 
@@ -165,50 +155,55 @@ func isSPA(r *http.Request) bool {
 	q := r.URL.RawQuery
 	q = strings.ToLower(q)
 	if strings.Contains(q, "spa") {
-		logf(r.Context(), "isSPA: '%s' is SPA\n", r.URL)
+		logf(r.Context(), nil, "isSPA: '%s' is SPA", redactURL(r.URL))
 		return true
 	}
 	return false
 }
 
 // this is an upload of a raw file. try to auto-detect what it is
-func handleUploadMaybeRaw(w http.ResponseWriter, r *http.Request, site *Site) {
+func handleUploadMaybeRaw(w http.ResponseWriter, r *http.Request, site *Site) bool {
 	name := site.name
 	tmpPath := filepath.Join(getDataDir(), name+".dat")
 	ctx := r.Context()
 	defer func() {
+		// with ?keepzip it's moved to siteZipPath()
+		if !pathExists(tmpPath) {
+			return
+		}
 		err := os.Remove(tmpPath)
 		if err != nil {
-			logf(ctx, "handleUploadMaybeRaw: failed to remove '%s', error: '%s'\n", tmpPath, err)
+			logf(ctx, logAttrs(logPath(tmpPath), logErr(err)), "handleUploadMaybeRaw: os.Remove() failed")
 		} else {
-			logf(ctx, "handleUploadMaybeRaw: removed '%s'\n", tmpPath)
+			logf(ctx, logAttrs(logPath(tmpPath)), "handleUploadMaybeRaw: removed")
 		}
 	}()
-	logf(ctx, "handleUploadMaybeRaw: '%s', name: '%s', tmpPath: '%s'\n", r.URL, name, tmpPath)
+	logf(ctx, logAttrs(logSite(site.name), logPath(tmpPath)), "handleUploadMaybeRaw: '%s', name: '%s'", redactURL(r.URL), name)
 
+	var uploadSize int64
 	{
 		timeStart := time.Now()
 
 		f, err := os.Create(tmpPath)
 		if err != nil {
-			logf(ctx, "handleUploadMaybeRaw: os.Create('%s') failed with '%s'\n", tmpPath, err)
+			logf(ctx, logAttrs(logPath(tmpPath), logErr(err)), "handleUploadMaybeRaw: os.Create() failed")
 			http.NotFound(w, r)
-			return
+			return false
 		}
-		_, err = io.Copy(f, r.Body)
+		uploadSize, err = io.Copy(f, r.Body)
 		if err != nil {
-			logf(ctx, "handleUploadMaybeRaw: io.Copy() for '%s' failed with '%s'\n", tmpPath, err)
+			logf(ctx, logAttrs(logPath(tmpPath), logErr(err)), "handleUploadMaybeRaw: io.Copy() failed")
 			http.NotFound(w, r)
-			return
+			return false
 		}
 		err = f.Close()
 		if err != nil {
-			logf(ctx, "handleUploadMaybeRaw: f.Close() failed with '%s'\n", err)
+			logf(ctx, logAttrs(logPath(tmpPath), logErr(err)), "handleUploadMaybeRaw: f.Close() failed")
 			http.NotFound(w, r)
-			return
+			return false
 		}
 		r.Body.Close()
-		logf(ctx, "Wrote '%s' in %s\n", tmpPath, time.Since(timeStart))
+		logf(ctx, logAttrs(logPath(tmpPath)), "handleUploadMaybeRaw: wrote in %s", time.Since(timeStart))
 	}
 
 	path := r.URL.Path
@@ -217,32 +212,32 @@ func handleUploadMaybeRaw(w http.ResponseWriter, r *http.Request, site *Site) {
 		// assume that uploads to /upload are .zip files
 		// because that's what tutorial says
 		// TODO: should try to auto-detect name of the file
-		zipFiles := []string{tmpPath}
-		// TODO: decide if I should delete the zip file after unpacking
-		_ = unpackZipFiles(zipFiles, site)
+		countUpload(uploadTypeZip, uploadSize)
+		if site.keepZip {
+			_ = keepZipFile(ctx, tmpPath, site)
+		} else {
+			_ = unpackTmpZipFile(ctx, site, tmpPath)
+		}
 	} else {
 		// otherwise save upload to /foo.txt as foo.txt
+		countUpload(uploadTypeRaw, uploadSize)
 
 		if !isBlacklistedFileType(path) {
 			path = canonicalPath(path)
-			pathOnDisk := filepath.Join(getDataDir(), name, path)
-			err := os.MkdirAll(filepath.Dir(pathOnDisk), 0755)
+			f, err := os.Open(tmpPath)
 			if err != nil {
-				serveInternalError(w, r, "Error: handleUploadMaybeRaw: os.MkdirAll('%s') failed with '%s'", filepath.Dir(pathOnDisk), err)
-				return
+				serveInternalError(w, r, "Error: handleUploadMaybeRaw: os.Open('%s') failed with '%s'", tmpPath, err)
+				return false
 			}
-			err = os.Rename(tmpPath, pathOnDisk)
+			size, err := writeSiteFile(site, path, f)
+			f.Close()
 			if err != nil {
-				serveInternalError(w, r, "Error: handleUploadMaybeRaw: os.Rename('%s', '%s') failed with '%s'", tmpPath, pathOnDisk, err)
-				return
+				serveInternalError(w, r, "Error: handleUploadMaybeRaw: writeSiteFile('%s') failed with '%s'", path, err)
+				return false
 			}
-			st, err := os.Lstat(pathOnDisk)
-			must(err)
-			size := st.Size()
 			sf := &siteFile{
 				Path:       path,
 				Size:       size,
-				pathOnDisk: pathOnDisk,
 				pathInForm: path,
 			}
 			site.files = append(site.files, sf)
@@ -252,39 +247,122 @@ func handleUploadMaybeRaw(w http.ResponseWriter, r *http.Request, site *Site) {
 
 	if len(site.files) == 0 {
 		http.NotFound(w, r)
-		return
+		return false
 	}
 
-	muSites.Lock()
-	// premium sites are created at startup
-	if !site.isPremium {
-		sites = append(sites, site)
+	return publishSite(w, r, site)
+}
+
+func unpackTmpZipFile(ctx context.Context, site *Site, tmpPath string) error {
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		logf(ctx, logAttrs(logSite(site.name), logPath(tmpPath), logErr(err)), "unpackTmpZipFile: os.Open() failed")
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return unpackZipFile(ctx, site, f, st.Size(), tmpPath)
+}
+
+// publishSite makes uploaded site available and responds with its url
+// problems with site's configuration files are reported in subsequent lines
+// returns false if the site couldn't be published
+func publishSite(w http.ResponseWriter, r *http.Request, site *Site) bool {
+	accessMode, accessUser, accessPwd, hasAccess, _ := getAccessOptions(r)
+	if hasAccess {
+		if err := setSiteAccess(site, accessMode, accessUser, accessPwd); err != nil {
+			serveInternalError(w, r, "publishSite: setSiteAccess() failed with '%s'\n", err)
+			return false
+		}
+		if accessMode == accessModeAccessCode && !r.URL.Query().Has("access-code") {
+			// the only time we know generated access code
+			w.Header().Set("X-Access-Code", accessPwd)
+		}
+	}
+	buildSiteFilesIndex(site)
+	calcSiteFilesETags(r.Context(), site)
+	configErrors := loadSiteConfig(r.Context(), site)
+
+	isNew := site.updatedOn.IsZero()
+	if err := saveSite(r.Context(), site); err != nil {
+		serveInternalError(w, r, "publishSite: saveSite() failed with '%s'\n", err)
+		return false
+	}
+	recordDeploy(r, site)
+	auditSite(r, auditActionUpload, auditOutcomeOK, site, "")
+	if isNew && !site.isPremium {
+		// allows re-uploading the site with ?token=
+		token := generateOwnerToken()
+		err := metaStore.SetOwnerTokenHash(site.name, hashOwnerToken(token))
+		if err != nil {
+			logf(r.Context(), logAttrs(logSite(site.name), logErr(err)), "publishSite: metaStore.SetOwnerTokenHash() failed")
+		} else {
+			w.Header().Set("X-Owner-Token", token)
+		}
 	}
-	muSites.Unlock()
 
 	uri := siteURL(r, site)
 	if len(site.files) == 1 {
 		uri += site.files[0].Path
 	}
-	servePlainText(w, r, uri)
+	lines := append([]string{uri}, configErrors...)
+	servePlainText(w, r, strings.Join(lines, "\n"))
+	return true
+}
+
+func recordDeploy(r *http.Request, site *Site) {
+	d := &deployInfo{
+		SiteName:  site.name,
+		CreatedOn: time.Now(),
+		FileCount: len(site.files),
+		TotalSize: site.totalSize,
+		IP:        getClientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+	if err := metaStore.AddDeploy(d); err != nil {
+		logf(r.Context(), logAttrs(logSite(site.name), logErr(err)), "recordDeploy: metaStore.AddDeploy() failed")
+	}
+}
+
+func generateOwnerToken() string {
+	var d [16]byte
+	_, err := cryptorand.Read(d[:])
+	must(err)
+	return hex.EncodeToString(d[:])
+}
+
+func hashOwnerToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
 }
 
-func findSiteFromHost(host string) *Site {
+func isValidOwnerToken(site *Site, token string) bool {
+	if token == "" {
+		return false
+	}
+	tokenHash, err := metaStore.GetOwnerTokenHash(site.name)
+	if err != nil || tokenHash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashOwnerToken(token)), []byte(tokenHash)) == 1
+}
+
+func findSiteFromHost(ctx context.Context, host string) *Site {
 	name := strings.Split(host, ".")[0]
 	name = strings.ToLower(name)
 	if name == "www" {
 		return nil
 	}
-	muSites.Lock()
-	defer muSites.Unlock()
-	for _, site := range sites {
-		if site.name == name {
-			logf(ctx(), "findSiteFromHost: found site for host '%s', name: '%s'\n", host, site.name)
-			return site
-		}
+	site := getSite(name)
+	if site == nil {
+		logDebugf(ctx, logAttrs(logSite(name)), "findSiteFromHost: no site for host '%s'", host)
+		return nil
 	}
-	logf(ctx(), "findSiteFromHost: no site for host '%s', name: '%s'\n", host, name)
-	return nil
+	logDebugf(ctx, logAttrs(logSite(site.name)), "findSiteFromHost: found site for host '%s'", host)
+	return site
 }
 
 func generateRandomName() string {
@@ -306,11 +384,16 @@ func generateRandomName() string {
 func handleUpload(w http.ResponseWriter, r *http.Request) {
 	ct := r.Header.Get("content-type")
 	ctx := r.Context()
-	logf(ctx, "handleUpload, ct='%s'\n", ct)
+	logf(ctx, nil, "handleUpload, ct='%s'", ct)
 
 	findOrCreateSite := func() *Site {
-		site := findSiteFromHost(r.Host)
+		site := findSiteFromHost(r.Context(), r.Host)
 		if site == nil {
+			if requireUploadToken && !isAuthorizedWithAPIToken(r, nil, scopeUpload) {
+				auditSite(r, auditActionUpload, auditOutcomeDenied, nil, "missing api token")
+				serveErrorStatus(w, r, http.StatusUnauthorized, "Error: creating sites requires an api token with '%s' scope\n", scopeUpload)
+				return nil
+			}
 			// create new, temporary site
 			name := generateRandomName()
 			site = &Site{
@@ -320,14 +403,26 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 				isSPA:     isSPA(r),
 				isPremium: false,
 			}
-			logf(ctx, "findOrCreateSite: created site with name '%s'\n", name)
+			site.storage = newSiteStorage(site)
+			logf(ctx, logAttrs(logSite(name)), "findOrCreateSite: created site")
 			return site
 		}
-		if !strings.Contains(r.URL.RawQuery, site.uploadPassword) {
+		if isAuthorizedWithAPIToken(r, site, scopeUpload) {
+			logf(ctx, logAttrs(logSite(site.name)), "findOrCreateSite: found existing site")
+			return site
+		}
+		if !site.isPremium {
+			if !isValidOwnerToken(site, r.URL.Query().Get("token")) {
+				auditSite(r, auditActionUpload, auditOutcomeDenied, site, "invalid owner token")
+				serveErrorStatus(w, r, http.StatusBadRequest, "Error: invalid owner token for site '%s'\n", r.Host)
+				return nil
+			}
+		} else if !isValidUploadPassword(site, r) {
+			auditSite(r, auditActionUpload, auditOutcomeDenied, site, "invalid password")
 			serveErrorStatus(w, r, http.StatusBadRequest, "Error: invalid password for premium site '%s'\n", r.Host)
 			return nil
 		}
-		logf(ctx, "findOrCreateSite: found existing site '%s'\n", site.name)
+		logf(ctx, logAttrs(logSite(site.name)), "findOrCreateSite: found existing site")
 		return site
 	}
 
@@ -335,24 +430,55 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 	if site == nil {
 		return
 	}
+	// changes are made to a copy that replaces cached site in publishSite
+	// so that a failed upload doesn't change the site
+	prev := site
+	siteCopy := *site
+	site = &siteCopy
+	// access options are applied in publishSite
+	_, _, _, _, err := getAccessOptions(r)
+	if err != nil {
+		serveBadRequestError(w, r, "Error: %s\n", err)
+		return
+	}
+	site.proxyOptions = getProxyOptions(r)
+	site.cacheControl = getCacheControlOption(r)
+	site.autoIndex = r.URL.Query().Has("autoindex")
+	site.keepZip = r.URL.Query().Has("keepzip")
+	if site.keepZip && s3Bucket != nil {
+		// the zip would only be on the disk of this instance
+		serveBadRequestError(w, r, "Error: ?keepzip is not supported when files are stored in S3\n")
+		return
+	}
+	if mode, ok := getNotFoundMode(r); ok {
+		site.notFound = mode
+	}
 
-	if site.isPremium {
-		// remove existing files for premium site
-		if err := os.RemoveAll(site.dir); err != nil {
-			logf(ctx, "unpackZipFiles: site: '%s', os.RemoveAll('%s') failed with '%s'\n", site.name, site.dir, err)
-		} else {
-			logf(ctx, "unpackZipFiles: site: '%s', os.RemoveAll('%s')\n", site.name, site.dir)
-		}
-		site.files = nil
-		site.totalSize = 0
+	// re-uploading premium site or temporary site with owner token
+	isReupload := !site.updatedOn.IsZero()
+	if isReupload {
+		useNewSiteStorage(site)
 	}
+	published := false
+	defer func() {
+		if !published {
+			// partially uploaded files
+			if err := site.storage.RemoveAll(); err != nil {
+				logf(ctx, logAttrs(logSite(site.name), logErr(err)), "handleUpload: site.storage.RemoveAll() failed")
+			}
+			return
+		}
+		if isReupload {
+			removeReplacedSiteFiles(ctx, prev)
+		}
+	}()
 
 	if ct == "" {
-		handleUploadMaybeRaw(w, r, site)
+		published = handleUploadMaybeRaw(w, r, site)
 		return
 	}
-	logf(ctx, "handleUpload: '%s', Content-Type: '%s', name: '%s', dir: '%s', premium?: %v\n", r.URL, ct, site.name, site.dir, site.isPremium)
-	err := r.ParseMultipartForm(maxSize20Mb)
+	logf(ctx, logAttrs(logSite(site.name)), "handleUpload: '%s', Content-Type: '%s', dir: '%s', premium?: %v", redactURL(r.URL), ct, site.dir, site.isPremium)
+	err = r.ParseMultipartForm(maxSize20Mb)
 	if err != nil {
 		serveBadRequestError(w, r, "Error: handleUpload: r.ParseMultipartForm() failed with '%s'\n", err)
 		return
@@ -388,17 +514,28 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 	stringsTrimSlashPrefix(paths)
 	trimCommonDirPrefix(paths)
 
-	dir := site.dir
-	var zipFiles []string
+	var zipFiles []*siteFile
 	for i := 0; i < len(files); i++ {
-		pathOnDisk := filepath.Join(dir, files[i].Path)
 		files[i].Path = paths[i]
-		files[i].pathOnDisk = pathOnDisk
-		if isZipFile(pathOnDisk) {
-			zipFiles = append(zipFiles, pathOnDisk)
+		if isZipFile(files[i].Path) {
+			zipFiles = append(zipFiles, files[i])
 		}
 	}
 
+	if site.keepZip && len(files) == 1 && len(zipFiles) == 1 {
+		fh := form.File[files[0].pathInForm][0]
+		err = keepUploadedZipFile(ctx, site, fh)
+		if err != nil {
+			serveInternalError(w, r, "handleUpload: keepUploadedZipFile() failed with '%s'\n", err)
+			return
+		}
+		published = publishSite(w, r, site)
+		return
+	}
+	if site.keepZip {
+		logf(ctx, logAttrs(logSite(site.name)), "handleUpload: can only keep a single zip file, got %d files, unpacking", len(files))
+	}
+
 	for _, file := range files {
 		fh := form.File[file.pathInForm][0]
 		fr, err := fh.Open()
@@ -406,51 +543,91 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 			serveInternalError(w, r, "Error: fh.Open() on '%s' failed with '%s'\n", file.pathInForm, err)
 			return
 		}
-		pathOnDisk := file.pathOnDisk
-		if err != nil {
-			serveInternalError(w, r, "handleUpload: os.MkdirAll('%s') failed with '%s'\n", filepath.Dir(pathOnDisk), err)
-			fr.Close()
-			return
-		}
-		err = os.MkdirAll(filepath.Dir(pathOnDisk), 0755)
-		if err != nil {
-			serveInternalError(w, r, "handleUpload: os.MkdirAll('%s') failed with '%s'\n", filepath.Dir(pathOnDisk), err)
-			fr.Close()
-			return
-		}
-		fw, err := os.Create(pathOnDisk)
-		if err != nil {
-			serveInternalError(w, r, "handleUpload: os.Create('%s') failed with '%s'\n", pathOnDisk, err)
-			fr.Close()
-			return
-		}
-		_, err = io.Copy(fw, fr)
+		_, err = writeSiteFile(site, file.Path, fr)
+		fr.Close()
 		if err != nil {
-			serveInternalError(w, r, "handleUpload: io.Copy() on '%s' failed with '%s'\n", pathOnDisk, err)
+			serveInternalError(w, r, "handleUpload: writeSiteFile('%s') failed with '%s'\n", file.Path, err)
 			return
 		}
-		fr.Close()
 		totalSize += fh.Size
-		logf(ctx, "handleUpload: file '%s' (canonical: '%s'), name: '%s' of size %s saved as '%s'\n", file.pathInForm, file.Path, fh.Filename, formatSize(fh.Size), pathOnDisk)
+		logf(ctx, logAttrs(logSite(site.name), logPath(file.Path)), "handleUpload: file '%s', name: '%s' of size %s saved", file.pathInForm, fh.Filename, formatSize(fh.Size))
 	}
-	logf(ctx, "handleUpload: %d files of total size %s\n", len(files), formatSize(totalSize))
+	logf(ctx, logAttrs(logSite(site.name)), "handleUpload: %d files of total size %s", len(files), formatSize(totalSize))
+	countUpload(uploadTypeMultipart, totalSize)
 
 	site.files = files
 	site.totalSize = totalSize
 
 	// TODO: decide if I should delete the zip file after unpacking
-	_ = unpackZipFiles(zipFiles, site)
+	_ = unpackZipFiles(ctx, zipFiles, site)
 
-	muSites.Lock()
-	// premium sites are created at startup
-	if !site.isPremium {
-		sites = append(sites, site)
+	published = publishSite(w, r, site)
+}
+
+// removeReplacedSiteFiles deletes files of the site replaced by a re-upload
+func removeReplacedSiteFiles(ctx context.Context, site *Site) {
+	if err := site.storage.RemoveAll(); err != nil {
+		logf(ctx, logAttrs(logSite(site.name), logErr(err)), "removeReplacedSiteFiles: site.storage.RemoveAll() failed")
+	} else {
+		logf(ctx, logAttrs(logSite(site.name), logPath(site.dir)), "removeReplacedSiteFiles: removed files")
 	}
-	muSites.Unlock()
+	removeSiteCompressedCache(ctx, site)
+}
 
-	uri := siteURL(r, site)
-	if len(site.files) == 1 {
-		uri += site.files[0].Path
+// keepUploadedZipFile saves zip file from multipart form and serves the site from it
+func keepUploadedZipFile(ctx context.Context, site *Site, fh *multipart.FileHeader) error {
+	fr, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+	tmpPath := filepath.Join(getDataDir(), site.name+".dat")
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, fr)
+	err2 := f.Close()
+	if err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = keepZipFile(ctx, tmpPath, site)
+	}
+	if pathExists(tmpPath) {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// DELETE on site's host, requires api token with delete scope
+// sites defined in INSTA_PREV_SITES must be removed from there first
+func handleDeleteSite(w http.ResponseWriter, r *http.Request) {
+	site := findSiteFromHost(r.Context(), r.Host)
+	if site == nil {
+		serveErrorStatus(w, r, http.StatusNotFound, "Error: no site for host '%s'\n", r.Host)
+		return
+	}
+	if !isAuthorizedWithAPIToken(r, site, scopeDelete) {
+		auditSite(r, auditActionDelete, auditOutcomeDenied, site, "")
+		serveErrorStatus(w, r, http.StatusUnauthorized, "Error: deleting site requires an api token with '%s' scope\n", scopeDelete)
+		return
+	}
+	// it would be re-created at next start
+	if site.fromEnv {
+		auditSite(r, auditActionDelete, auditOutcomeFailed, site, "defined in env")
+		serveErrorStatus(w, r, http.StatusConflict, "Error: site '%s' is defined in INSTA_PREV_SITES, remove it from there first\n", site.name)
+		return
+	}
+	deleted, err := metaStore.DeleteSite(site.name)
+	if err != nil {
+		serveInternalError(w, r, "handleDeleteSite: metaStore.DeleteSite('%s') failed with '%s'\n", site.name, err)
+		return
+	}
+	if deleted {
+		deleteSiteFiles(site)
 	}
-	servePlainText(w, r, uri)
+	auditSite(r, auditActionDelete, auditOutcomeOK, site, "")
+	logf(r.Context(), logAttrs(logSite(site.name)), "handleDeleteSite: deleted")
+	w.WriteHeader(http.StatusNoContent)
 }
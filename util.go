@@ -2,11 +2,12 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"io/fs"
+	"net"
 	"net/http"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/kjk/common/httputil"
 	"github.com/kjk/common/u"
@@ -20,21 +21,16 @@ var (
 	formatSize        = u.FormatSize
 	pathExists        = u.PathExists
 	dirExists         = u.DirExists
+	copyFile          = u.CopyFile
 	httpGet           = httputil.Get
 )
 
+// ctx is for code that doesn't run as part of a request
+// in http handlers use r.Context(), which has request id
 func ctx() context.Context {
 	return context.Background()
 }
 
-func logf(ctx context.Context, format string, args ...interface{}) {
-	s := format
-	if len(args) > 0 {
-		s = fmt.Sprintf(format, args...)
-	}
-	fmt.Print(s)
-}
-
 func stringsTrimSlashPrefix(a []string) {
 	for i, s := range a {
 		a[i] = strings.TrimLeft(s, `\/`)
@@ -48,11 +44,10 @@ func trimCommonDirPrefix(a []string) {
 		return
 	}
 	if false {
-		logf(ctx(), "trimCommonDirPrefix:\n")
+		logf(ctx(), nil, "trimCommonDirPrefix:")
 		for _, s := range a {
-			logf(ctx(), "%s\n", s)
+			logf(ctx(), nil, "%s", s)
 		}
-		logf(ctx(), "\n")
 	}
 
 	isSameCharAt := func(idx int) bool {
@@ -94,7 +89,7 @@ func trimCommonDirPrefix(a []string) {
 	if idx == 0 {
 		return
 	}
-	// logf(ctx(), "removing common prefix '%s'\n", a[0][:i])
+	// logf(ctx(), nil, "removing common prefix '%s'\n", a[0][:i])
 	for i, s := range a {
 		a[i] = s[idx:]
 	}
@@ -102,13 +97,13 @@ func trimCommonDirPrefix(a []string) {
 }
 
 func dumpHeaders(r *http.Request) {
-	logf(ctx(), "dumpHeaders:\n")
+	logf(ctx(), nil, "dumpHeaders:")
 	for key, a := range r.Header {
 		if len(a) == 1 {
-			logf(ctx(), "%s: '%s'\n", key, a[0])
+			logf(ctx(), nil, "%s: '%s'", key, a[0])
 			continue
 		}
-		logf(ctx(), "%s: '%#v'\n", key, a)
+		logf(ctx(), nil, "%s: '%#v'", key, a)
 	}
 }
 
@@ -129,3 +124,64 @@ func getDirectorySize(dir string) int64 {
 	})
 	return totalSize
 }
+
+// getClientIP returns ip address of the client, using X-Forwarded-For
+// set by proxies like render.com's load balancer. Clients can send
+// X-Forwarded-For too, so we use the last address, added by the proxy
+func getClientIP(r *http.Request) string {
+	if s := r.Header.Get("X-Forwarded-For"); s != "" {
+		parts := strings.Split(s, ",")
+		return strings.TrimSpace(parts[len(parts)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// isHTTPS returns true if the client used https, also when
+// TLS is terminated by a proxy
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// statusRecorder remembers status code of the response, for audit log and metrics
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(d []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(d)
+}
+
+// for http.ResponseController e.g. flushing in reverse proxy
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// parses expiration of api tokens and sites in "2006-01-02" format
+// or as duration from now e.g. "720h". "" means no expiration
+func parseExpiration(s string) (time.Time, bool) {
+	if s == "" {
+		return time.Time{}, true
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, true
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return time.Now().Add(d), true
+	}
+	return time.Time{}, false
+}
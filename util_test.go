@@ -1,7 +1,9 @@
 package main
 
 import (
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestTrimCommonDirPrefix(t *testing.T) {
@@ -26,3 +28,32 @@ func TestTrimCommonDirPrefix(t *testing.T) {
 	test([]string{"/abc.txt", "/ab.txt"}, []string{"abc.txt", "ab.txt"})
 	test([]string{"foo/", "foo"}, nil)
 }
+
+func TestGetClientIP(t *testing.T) {
+	test := func(xff string, exp string) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		if xff != "" {
+			r.Header.Set("X-Forwarded-For", xff)
+		}
+		if got := getClientIP(r); got != exp {
+			t.Fatalf("X-Forwarded-For: '%s', exp '%s', got '%s'\n", xff, exp, got)
+		}
+	}
+	test("", "10.0.0.1")
+	test("1.2.3.4", "1.2.3.4")
+	// first address is sent by the client, the proxy appends the real one
+	test("6.6.6.6, 1.2.3.4", "1.2.3.4")
+}
+
+func TestParseExpiration(t *testing.T) {
+	if got, ok := parseExpiration(""); !ok || !got.IsZero() {
+		t.Fatalf("exp no expiration, got %v %v\n", got, ok)
+	}
+	if got, ok := parseExpiration("24h"); !ok || got.Before(time.Now()) {
+		t.Fatalf("exp expiration in the future, got %v %v\n", got, ok)
+	}
+	if _, ok := parseExpiration("-1h"); ok {
+		t.Fatalf("exp negative duration to be invalid\n")
+	}
+}
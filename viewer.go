@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// bigger files are served raw because rendering them would be slow
+	maxViewerFileSize = 2 * 1024 * 1024
+	maxViewerCSVRows  = 10000
+)
+
+// kinds of files we have a viewer for
+const (
+	viewerImage  = "image"
+	viewerPDF    = "pdf"
+	viewerJSON   = "json"
+	viewerCSV    = "csv"
+	viewerText   = "text"
+	viewerSource = "source"
+)
+
+var viewerImageExt = []string{"png", "jpg", "jpeg", "gif", "webp", "avif", "svg", "bmp", "ico"}
+var viewerTextExt = []string{"txt", "log", "out"}
+var viewerSourceExt = []string{
+	"go", "js", "mjs", "ts", "tsx", "jsx", "py", "rb", "rs", "c", "h", "cc", "cpp", "hpp",
+	"java", "kt", "swift", "cs", "php", "sh", "bash", "ps1", "sql", "yaml", "yml", "toml",
+	"ini", "xml", "css", "scss", "lua", "zig", "diff", "patch",
+}
+
+func stringInSlice(a []string, s string) bool {
+	for _, s2 := range a {
+		if s == s2 {
+			return true
+		}
+	}
+	return false
+}
+
+// returns kind of viewer for a file or "" if we don't have a viewer
+func getViewerKind(path string) string {
+	ext := getExt(path)
+	switch {
+	case stringInSlice(viewerImageExt, ext):
+		return viewerImage
+	case ext == "pdf":
+		return viewerPDF
+	case ext == "json":
+		return viewerJSON
+	case ext == "csv":
+		return viewerCSV
+	case stringInSlice(viewerTextExt, ext):
+		return viewerText
+	case stringInSlice(viewerSourceExt, ext):
+		return viewerSource
+	}
+	return ""
+}
+
+// viewer is only for sites with a single uploaded file, files of
+// multi-file sites are used by the site and served as-is
+func canShowViewer(r *http.Request, site *Site, file *siteFile) bool {
+	return len(site.files) == 1 && !isRawRequested(r) && getViewerKind(file.Path) != ""
+}
+
+// we only show the viewer when browser navigates to the file, not
+// when e.g. <img> tag or fetch() requests it.
+// ?view=1 forces the viewer for browsers that don't send Sec-Fetch-Dest
+func wantsViewer(r *http.Request) bool {
+	if r.URL.Query().Get("view") == "1" {
+		return true
+	}
+	return r.Header.Get("Sec-Fetch-Dest") == "document"
+}
+
+// renderJSONValue renders JSON as nested, collapsible html. Uses token
+// stream to preserve the order of keys in objects
+func renderJSONValue(w *bytes.Buffer, dec *json.Decoder, key string) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	keyHTML := ""
+	if key != "" {
+		keyHTML = `<span class="json-key">` + template.HTMLEscapeString(key) + `</span>: `
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		cls := "json-value"
+		s := ""
+		switch v := tok.(type) {
+		case string:
+			cls = "json-string"
+			d, _ := json.Marshal(v)
+			s = string(d)
+		case nil:
+			s = "null"
+		default:
+			s = fmt.Sprintf("%v", v)
+		}
+		fmt.Fprintf(w, `<div>%s<span class="%s">%s</span></div>`, keyHTML, cls, template.HTMLEscapeString(s))
+		return nil
+	}
+	isObject := delim == '{'
+	open, close := "[", "]"
+	if isObject {
+		open, close = "{", "}"
+	}
+	fmt.Fprintf(w, `<details open><summary>%s%s</summary><div class="json-children">`, keyHTML, open)
+	for i := 0; dec.More(); i++ {
+		childKey := ""
+		if isObject {
+			tok, err = dec.Token()
+			if err != nil {
+				return err
+			}
+			childKey = fmt.Sprintf("%v", tok)
+		}
+		if err = renderJSONValue(w, dec, childKey); err != nil {
+			return err
+		}
+	}
+	// consume closing delimiter
+	if _, err = dec.Token(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, `</div>%s</details>`, close)
+	return nil
+}
+
+func renderJSON(d []byte) (template.HTML, error) {
+	var buf bytes.Buffer
+	dec := json.NewDecoder(bytes.NewReader(d))
+	dec.UseNumber()
+	if err := renderJSONValue(&buf, dec, ""); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
+
+func renderCSV(d []byte) (template.HTML, error) {
+	r := csv.NewReader(bytes.NewReader(d))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	var buf bytes.Buffer
+	buf.WriteString(`<table class="csv">`)
+	for i := 0; i < maxViewerCSVRows; i++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		tag := "td"
+		if i == 0 {
+			tag = "th"
+		}
+		buf.WriteString("<tr>")
+		for _, s := range rec {
+			fmt.Fprintf(&buf, "<%s>%s</%s>", tag, template.HTMLEscapeString(s), tag)
+		}
+		buf.WriteString("</tr>\n")
+	}
+	buf.WriteString("</table>")
+	return template.HTML(buf.String()), nil
+}
+
+func renderCode(d []byte, lang string) (template.HTML, error) {
+	var buf bytes.Buffer
+	err := highlightCode(&buf, string(normalizeNewlines(d)), lang, true)
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// renderViewerContent returns html for a given kind of viewer
+func renderViewerContent(ctx context.Context, site *Site, file *siteFile, kind string, rawURL string) (template.HTML, error) {
+	switch kind {
+	case viewerImage:
+		s := fmt.Sprintf(`<img src="%s" alt="%s">`, template.HTMLEscapeString(rawURL), template.HTMLEscapeString(file.Path))
+		return template.HTML(s), nil
+	case viewerPDF:
+		s := fmt.Sprintf(`<iframe class="pdf" src="%s"></iframe>`, template.HTMLEscapeString(rawURL))
+		return template.HTML(s), nil
+	}
+
+	d, err := readSiteFile(site, file)
+	if err != nil {
+		return "", err
+	}
+	switch kind {
+	case viewerJSON:
+		res, err := renderJSON(d)
+		if err == nil {
+			return res, nil
+		}
+		// show invalid json as text
+		logf(ctx, logAttrs(logSite(site.name), logPath(file.Path), logErr(err)), "renderViewerContent: invalid json")
+		return renderCode(d, "plaintext")
+	case viewerCSV:
+		return renderCSV(d)
+	case viewerText:
+		return renderCode(d, "plaintext")
+	}
+	return renderCode(d, filepath.Base(file.Path))
+}
+
+// serveViewer serves a page that shows file in a readable form
+// e.g. pretty-printed json or csv as a table
+func serveViewer(w http.ResponseWriter, r *http.Request, site *Site, file *siteFile, status int) {
+	kind := getViewerKind(file.Path)
+	rawURL := rawFileURL(file.Path)
+	if kind != viewerImage && kind != viewerPDF && file.Size > maxViewerFileSize {
+		logf(r.Context(), logAttrs(logSite(site.name), logPath(file.Path)), "serveViewer: too big (%s), serving raw", formatSize(file.Size))
+		http.Redirect(w, r, rawURL, http.StatusTemporaryRedirect)
+		return
+	}
+	content, err := renderViewerContent(r.Context(), site, file, kind, rawURL)
+	if err != nil {
+		logf(r.Context(), logAttrs(logSite(site.name), logPath(file.Path), logErr(err)), "serveViewer: rendering as %s failed, serving raw", kind)
+		http.Redirect(w, r, rawURL, http.StatusTemporaryRedirect)
+		return
+	}
+	tmpl, err := template.ParseFiles(filepath.Join("www", "viewer.html"))
+	if err != nil {
+		serveInternalError(w, r, "serveViewer: template.ParseFiles() failed with '%s'\n", err)
+		return
+	}
+	v := struct {
+		Title   string
+		Kind    string
+		RawURL  string
+		Size    string
+		Content template.HTML
+	}{
+		Title:   file.Path,
+		Kind:    kind,
+		RawURL:  rawURL,
+		Size:    formatSize(file.Size),
+		Content: content,
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, v)
+	if err != nil {
+		serveInternalError(w, r, "serveViewer: tmpl.Execute() failed with '%s'\n", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		w.Write(buf.Bytes())
+		return
+	}
+	var zeroTime time.Time
+	http.ServeContent(w, r, file.Path, zeroTime, bytes.NewReader(buf.Bytes()))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderJSON(t *testing.T) {
+	s, err := renderJSON([]byte(`{"b": 1, "a": ["<x>", null]}`))
+	if err != nil {
+		t.Fatalf("renderJSON() failed with '%s'\n", err)
+	}
+	got := string(s)
+	// preserves order of keys
+	if strings.Index(got, ">b<") > strings.Index(got, ">a<") {
+		t.Fatalf("keys out of order in:\n%s\n", got)
+	}
+	if strings.Contains(got, "<x>") || !strings.Contains(got, "null") {
+		t.Fatalf("unexpected html:\n%s\n", got)
+	}
+	_, err = renderJSON([]byte(`{"a": `))
+	if err == nil {
+		t.Fatalf("expected error for invalid json\n")
+	}
+}
+
+func TestGetViewerKind(t *testing.T) {
+	test := func(path string, exp string) {
+		if got := getViewerKind(path); got != exp {
+			t.Fatalf("path: '%s', exp: '%s', got: '%s'\n", path, exp, got)
+		}
+	}
+	test("a.PNG", viewerImage)
+	test("report.pdf", viewerPDF)
+	test("data.json", viewerJSON)
+	test("build.log", viewerText)
+	test("main.go", viewerSource)
+	test("index.html", "")
+}
+
+func TestViewerOnlyForSingleFileSites(t *testing.T) {
+	json := `{"a": 1}`
+	site := setupTestSite(t, "viewertest", map[string]string{
+		"my data.json": json,
+	})
+	site.cacheControl = cacheControlImmutable
+	w := testGet(site, "/my%20data.json", "Sec-Fetch-Dest", "document")
+	body := w.Body.String()
+	if !strings.Contains(body, `json-key`) || !strings.Contains(body, `/my%20data.json?raw=1`) {
+		t.Fatalf("exp viewer with escaped raw url, got:\n%s\n", body)
+	}
+	if vary := w.Header().Get("Vary"); vary != "Sec-Fetch-Dest" {
+		t.Fatalf("exp Vary 'Sec-Fetch-Dest', got '%s'\n", vary)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != cacheControlNoCache {
+		t.Fatalf("exp Cache-Control '%s' for viewer, got '%s'\n", cacheControlNoCache, cc)
+	}
+
+	// e.g. fetch() of the same url gets the file
+	w = testGet(site, "/my%20data.json", "Sec-Fetch-Dest", "empty")
+	if w.Body.String() != json {
+		t.Fatalf("exp raw file, got:\n%s\n", w.Body.String())
+	}
+	if vary := w.Header().Get("Vary"); vary != "Sec-Fetch-Dest" {
+		t.Fatalf("exp Vary 'Sec-Fetch-Dest' for raw file, got '%s'\n", vary)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != cacheControlImmutable {
+		t.Fatalf("exp Cache-Control '%s' for raw file, got '%s'\n", cacheControlImmutable, cc)
+	}
+
+	site = setupTestSite(t, "viewertest2", map[string]string{
+		"index.html": "<html></html>",
+		"data.json":  json,
+	})
+	w = testGet(site, "/data.json", "Sec-Fetch-Dest", "document")
+	if w.Body.String() != json {
+		t.Fatalf("exp raw file in multi-file site, got:\n%s\n", w.Body.String())
+	}
+	if vary := w.Header().Get("Vary"); strings.Contains(vary, "Sec-Fetch-Dest") {
+		t.Fatalf("exp no Vary on Sec-Fetch-Dest in multi-file site, got '%s'\n", vary)
+	}
+}
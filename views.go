@@ -0,0 +1,264 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// page views are counted in memory and periodically added to metaStore
+// so that we don't write to the database on every request
+// besides views we count unique visitors, paths, referrers and 404s
+// visitors are identified by a hash of ip address, we don't set cookies
+// the hash uses a secret salt that changes every visitorSaltPeriod, so a visitor
+// who comes back after that counts as a new unique visitor
+
+const (
+	siteCounterPath     = "path"
+	siteCounterReferrer = "referrer"
+	siteCounterNotFound = "404"
+
+	// to limit size of the database
+	maxSiteCounterKeyLen = 200
+	// per site and kind
+	maxSiteCounterKeys = 1000
+	// per site
+	maxSiteVisitors      = 100000
+	topSiteCountersLimit = 10
+
+	visitorSaltPeriod = 24 * time.Hour
+)
+
+type siteCounter struct {
+	Kind  string `json:"-"`
+	Key   string
+	Count int64
+}
+
+type pendingSiteViews struct {
+	views    int64
+	visitors map[string]bool
+	counters map[[2]string]int64 // kind, key => count
+}
+
+type siteAnalytics struct {
+	Views          int64
+	UniqueVisitors int64
+	TopPaths       []*siteCounter
+	TopReferrers   []*siteCounter
+	TopNotFound    []*siteCounter
+}
+
+var (
+	muViews      sync.Mutex
+	pendingViews = map[string]*pendingSiteViews{} // site name => views
+
+	muVisitorSalt       sync.Mutex
+	visitorSalt         string
+	visitorSaltPeriodNo int64
+)
+
+func isPageView(f *siteFile) bool {
+	return isHTMLFile(f.Path) || isMarkdownFile(f.Path)
+}
+
+// sorted by count, most first
+func sortSiteCounters(a []*siteCounter) {
+	slices.SortFunc(a, func(c1, c2 *siteCounter) int {
+		if c1.Count != c2.Count {
+			return cmp.Compare(c2.Count, c1.Count)
+		}
+		return strings.Compare(c1.Key, c2.Key)
+	})
+}
+
+// getVisitorSalt returns the salt for the current visitorSaltPeriod,
+// shared by all instances
+func getVisitorSalt() string {
+	period := time.Now().Unix() / int64(visitorSaltPeriod/time.Second)
+	muVisitorSalt.Lock()
+	defer muVisitorSalt.Unlock()
+	if visitorSalt != "" && period == visitorSaltPeriodNo {
+		return visitorSalt
+	}
+	salt, err := metaStore.GetVisitorSalt(period, generateRandomHex(32))
+	if err != nil {
+		logf(ctx(), logAttrs(logErr(err)), "getVisitorSalt: metaStore.GetVisitorSalt() failed")
+		// still secret but visitors of other instances will be counted again
+		salt = generateRandomHex(32)
+	}
+	visitorSalt = salt
+	visitorSaltPeriodNo = period
+	return salt
+}
+
+// keyed with a secret salt so that ip addresses can't be recovered by
+// hashing all of them, includes site name so that visitors can't be
+// tracked across sites
+func visitorHash(siteName string, ip string) string {
+	mac := hmac.New(sha256.New, []byte(getVisitorSalt()))
+	mac.Write([]byte(siteName + "\x00" + ip))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+func truncateCounterKey(s string) string {
+	if len(s) > maxSiteCounterKeyLen {
+		s = s[:maxSiteCounterKeyLen]
+	}
+	return s
+}
+
+// returns host of the referrer or "" if there's none or it's the site itself
+func getReferrerHost(r *http.Request) string {
+	ref := r.Referer()
+	if ref == "" {
+		return ""
+	}
+	u, err := url.Parse(ref)
+	if err != nil || u.Host == "" || strings.EqualFold(u.Host, r.Host) {
+		return ""
+	}
+	return truncateCounterKey(strings.ToLower(u.Host))
+}
+
+// must be called with muViews locked
+func getPendingSiteViews(name string) *pendingSiteViews {
+	p := pendingViews[name]
+	if p == nil {
+		p = &pendingSiteViews{
+			visitors: map[string]bool{},
+			counters: map[[2]string]int64{},
+		}
+		pendingViews[name] = p
+	}
+	return p
+}
+
+func countSiteView(r *http.Request, site *Site, f *siteFile) {
+	if !isPageView(f) {
+		return
+	}
+	visitor := visitorHash(site.name, getClientIP(r))
+	path := truncateCounterKey(r.URL.Path)
+	referrer := getReferrerHost(r)
+
+	muViews.Lock()
+	defer muViews.Unlock()
+	p := getPendingSiteViews(site.name)
+	p.views++
+	if len(p.visitors) < maxSiteVisitors {
+		p.visitors[visitor] = true
+	}
+	incPendingSiteCounter(p, siteCounterPath, path)
+	if referrer != "" {
+		incPendingSiteCounter(p, siteCounterReferrer, referrer)
+	}
+}
+
+// must be called with muViews locked
+func incPendingSiteCounter(p *pendingSiteViews, kind string, key string) {
+	k := [2]string{kind, key}
+	if _, ok := p.counters[k]; ok || len(p.counters) < maxSiteCounterKeys {
+		p.counters[k]++
+	}
+}
+
+func countSiteNotFound(r *http.Request, site *Site) {
+	path := truncateCounterKey(r.URL.Path)
+	muViews.Lock()
+	defer muViews.Unlock()
+	p := getPendingSiteViews(site.name)
+	incPendingSiteCounter(p, siteCounterNotFound, path)
+}
+
+func flushPendingSiteViews(name string, p *pendingSiteViews) {
+	if p.views > 0 {
+		if err := metaStore.AddSiteViews(name, p.views); err != nil {
+			logf(ctx(), logAttrs(logSite(name), logErr(err)), "flushSiteViews: metaStore.AddSiteViews() failed")
+		}
+	}
+	if len(p.visitors) > 0 {
+		var hashes []string
+		for h := range p.visitors {
+			hashes = append(hashes, h)
+		}
+		if err := metaStore.AddSiteVisitors(name, hashes); err != nil {
+			logf(ctx(), logAttrs(logSite(name), logErr(err)), "flushSiteViews: metaStore.AddSiteVisitors() failed")
+		}
+	}
+	if len(p.counters) > 0 {
+		var counters []*siteCounter
+		for k, n := range p.counters {
+			counters = append(counters, &siteCounter{Kind: k[0], Key: k[1], Count: n})
+		}
+		if err := metaStore.AddSiteCounters(name, counters); err != nil {
+			logf(ctx(), logAttrs(logSite(name), logErr(err)), "flushSiteViews: metaStore.AddSiteCounters() failed")
+		}
+	}
+}
+
+func flushSiteViews() {
+	muViews.Lock()
+	pending := pendingViews
+	pendingViews = map[string]*pendingSiteViews{}
+	muViews.Unlock()
+	for name, p := range pending {
+		flushPendingSiteViews(name, p)
+	}
+}
+
+func flushSiteViewsFor(name string) {
+	muViews.Lock()
+	p := pendingViews[name]
+	delete(pendingViews, name)
+	muViews.Unlock()
+	if p != nil {
+		flushPendingSiteViews(name, p)
+	}
+}
+
+func getTopSiteCounters(ctx context.Context, site *Site, kind string) []*siteCounter {
+	res, err := metaStore.ListTopSiteCounters(site.name, kind, topSiteCountersLimit)
+	if err != nil {
+		logf(ctx, logAttrs(logSite(site.name), logErr(err)), "getTopSiteCounters: metaStore.ListTopSiteCounters('%s') failed", kind)
+	}
+	if res == nil {
+		res = []*siteCounter{}
+	}
+	return res
+}
+
+func getSiteAnalytics(ctx context.Context, site *Site) *siteAnalytics {
+	// so that what we show is up to date
+	flushSiteViewsFor(site.name)
+	res := &siteAnalytics{
+		TopPaths:     getTopSiteCounters(ctx, site, siteCounterPath),
+		TopReferrers: getTopSiteCounters(ctx, site, siteCounterReferrer),
+		TopNotFound:  getTopSiteCounters(ctx, site, siteCounterNotFound),
+	}
+	var err error
+	res.Views, err = metaStore.GetSiteViews(site.name)
+	if err != nil {
+		logf(ctx, logAttrs(logSite(site.name), logErr(err)), "getSiteAnalytics: metaStore.GetSiteViews() failed")
+	}
+	res.UniqueVisitors, err = metaStore.GetSiteVisitorCount(site.name)
+	if err != nil {
+		logf(ctx, logAttrs(logSite(site.name), logErr(err)), "getSiteAnalytics: metaStore.GetSiteVisitorCount() failed")
+	}
+	return res
+}
+
+func siteViewsLoop() {
+	for {
+		time.Sleep(time.Minute)
+		flushSiteViews()
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSiteAnalytics(t *testing.T) {
+	site := setupTestSite(t, "viewstest", map[string]string{
+		"index.html": "<html>hello</html>",
+		"about.html": "<html>about</html>",
+		"main.css":   "body {}",
+	})
+	testGet(site, "/", "X-Forwarded-For", "1.1.1.1")
+	testGet(site, "/", "X-Forwarded-For", "1.1.1.1", "Referer", "https://www.google.com/search?q=foo")
+	testGet(site, "/about.html", "X-Forwarded-For", "2.2.2.2", "Referer", "http://viewstest.localhost/")
+	testGet(site, "/main.css", "X-Forwarded-For", "3.3.3.3")
+	testGet(site, "/missing.html", "X-Forwarded-For", "3.3.3.3")
+
+	w := testGet(site, "/__instantpreviewinternal/api/site-info.json")
+	var res siteFilesResult
+	must(json.Unmarshal(w.Body.Bytes(), &res))
+	a := res.Analytics
+	if a == nil {
+		t.Fatalf("exp analytics in site-info.json, got none\n")
+	}
+	if a.Views != 3 || res.Views != 3 {
+		t.Fatalf("exp 3 views, got %d and %d\n", a.Views, res.Views)
+	}
+	if a.UniqueVisitors != 2 {
+		t.Fatalf("exp 2 unique visitors, got %d\n", a.UniqueVisitors)
+	}
+	if len(a.TopPaths) != 2 || a.TopPaths[0].Key != "/" || a.TopPaths[0].Count != 2 {
+		t.Fatalf("exp top path '/' with 2 views, got %+v\n", a.TopPaths)
+	}
+	// referrer from the site itself is not counted
+	if len(a.TopReferrers) != 1 || a.TopReferrers[0].Key != "www.google.com" {
+		t.Fatalf("exp referrer 'www.google.com', got %+v\n", a.TopReferrers)
+	}
+	if len(a.TopNotFound) != 1 || a.TopNotFound[0].Key != "/missing.html" {
+		t.Fatalf("exp 404 '/missing.html', got %+v\n", a.TopNotFound)
+	}
+}
+
+func TestVisitorHash(t *testing.T) {
+	setupTestSite(t, "foo", nil)
+	visitorSalt = ""
+	h := visitorHash("foo", "1.1.1.1")
+	if h == visitorHash("bar", "1.1.1.1") || h == visitorHash("foo", "2.2.2.2") {
+		t.Fatalf("exp different hashes for different sites and ips\n")
+	}
+	// other instances get the same salt from the store
+	visitorSalt = ""
+	if h2 := visitorHash("foo", "1.1.1.1"); h2 != h {
+		t.Fatalf("exp the same hash with salt from the store, got '%s' and '%s'\n", h, h2)
+	}
+	// salt cached in the previous period is replaced
+	visitorSaltPeriodNo--
+	visitorSalt = "old"
+	if h2 := visitorHash("foo", "1.1.1.1"); h2 != h {
+		t.Fatalf("exp salt of the current period, got '%s' and '%s'\n", h, h2)
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// with ?keepzip upload option a site uploaded as a single .zip file is served
+// directly from the zip file instead of unpacking it
+// the zip is stored as ${site.dir}.zip
+
+func siteZipPath(site *Site) string {
+	return site.dir + ".zip"
+}
+
+// returns names of files in zip, with common directory prefix removed
+func zipEntryNames(zr *zip.Reader) []string {
+	// if files inside zip files are all under foo/,
+	// we want to remove foo/ from the paths and host the files under root
+	var res []string
+	for _, f := range zr.File {
+		path := canonicalPath(f.Name)
+		res = append(res, path)
+	}
+	stringsTrimSlashPrefix(res)
+	trimCommonDirPrefix(res)
+	return res
+}
+
+// zipArchive is an open zip file shared by readers of its entries. It's
+// closed only after it's released and all readers are closed, so that
+// re-uploading or moving a site doesn't break requests in flight
+type zipArchive struct {
+	f        *os.File
+	mu       sync.Mutex
+	readers  int
+	released bool
+}
+
+func (a *zipArchive) ReadAt(p []byte, off int64) (int, error) {
+	return a.f.ReadAt(p, off)
+}
+
+func (a *zipArchive) acquire() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.released {
+		return false
+	}
+	a.readers++
+	return true
+}
+
+func (a *zipArchive) releaseReader() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.readers--
+	if a.released && a.readers == 0 {
+		a.f.Close()
+	}
+}
+
+// release closes the file once there are no readers
+func (a *zipArchive) release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.released {
+		return
+	}
+	a.released = true
+	if a.readers == 0 {
+		a.f.Close()
+	}
+}
+
+// zipFS is a read-only fs.FS with files inside a zip file. Names are
+// paths of site files, i.e. without the common directory prefix
+type zipFS struct {
+	archive *zipArchive
+	// site file path => entry in zip
+	entries map[string]*zip.File
+	// directory => its entries, "." is the root
+	dirs map[string][]fs.DirEntry
+}
+
+func newZipFS(archive *zipArchive) *zipFS {
+	return &zipFS{
+		archive: archive,
+		entries: map[string]*zip.File{},
+		dirs:    map[string][]fs.DirEntry{".": nil},
+	}
+}
+
+// addFile adds entry as file with a given path and its parent directories
+func (z *zipFS) addFile(name string, entry *zip.File) {
+	if _, ok := z.entries[name]; ok {
+		z.entries[name] = entry
+		return
+	}
+	z.entries[name] = entry
+	var de fs.DirEntry = fs.FileInfoToDirEntry(&zipFileInfo{FileInfo: entry.FileInfo(), name: path.Base(name)})
+	for {
+		dir := path.Dir(name)
+		_, exists := z.dirs[dir]
+		z.dirs[dir] = append(z.dirs[dir], de)
+		if exists || dir == "." {
+			break
+		}
+		de = fs.FileInfoToDirEntry(zipDirInfo(dir))
+		name = dir
+	}
+}
+
+func (z *zipFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if entry := z.entries[name]; entry != nil {
+		if !z.archive.acquire() {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrClosed}
+		}
+		rc, err := openZipEntry(z.archive, entry)
+		if err != nil {
+			z.archive.releaseReader()
+			return nil, err
+		}
+		f := &zipFSFile{
+			ReadSeekCloser: rc,
+			info:           &zipFileInfo{FileInfo: entry.FileInfo(), name: path.Base(name)},
+			archive:        z.archive,
+		}
+		return f, nil
+	}
+	if entries, ok := z.dirs[name]; ok {
+		slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+			return strings.Compare(a.Name(), b.Name())
+		})
+		return &zipFSDir{info: zipDirInfo(name), entries: entries}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// name in zip can have a directory prefix or backslashes
+type zipFileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (fi *zipFileInfo) Name() string {
+	return fi.name
+}
+
+type zipFSFile struct {
+	io.ReadSeekCloser
+	info    *zipFileInfo
+	archive *zipArchive
+	closed  bool
+}
+
+func (f *zipFSFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *zipFSFile) Close() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	err := f.ReadSeekCloser.Close()
+	f.archive.releaseReader()
+	return err
+}
+
+// directories are not stored in zip, we derive them from paths of files
+type zipDirInfo string
+
+func (d zipDirInfo) Name() string       { return path.Base(string(d)) }
+func (d zipDirInfo) Size() int64        { return 0 }
+func (d zipDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (d zipDirInfo) ModTime() time.Time { return time.Time{} }
+func (d zipDirInfo) IsDir() bool        { return true }
+func (d zipDirInfo) Sys() interface{}   { return nil }
+
+type zipFSDir struct {
+	info    zipDirInfo
+	entries []fs.DirEntry
+	off     int
+}
+
+func (d *zipFSDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *zipFSDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: string(d.info), Err: errors.New("is a directory")}
+}
+
+func (d *zipFSDir) Close() error {
+	return nil
+}
+
+func (d *zipFSDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.off:]
+	if n <= 0 {
+		d.off = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(rest))
+	d.off += n
+	return rest[:n], nil
+}
+
+// zipStorage is a read-only siteStorage that serves files from a zip file
+type zipStorage struct {
+	*zipFS
+	zipPath string
+}
+
+func (s *zipStorage) Create(name string) (io.WriteCloser, error) {
+	return nil, errReadOnlyStorage
+}
+
+// RemoveAll deletes the zip file. Files being read can still be read
+// because we keep the file open until they are closed
+func (s *zipStorage) RemoveAll() error {
+	s.archive.release()
+	err := os.Remove(s.zipPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// keepZipFile moves uploaded zipFile to siteZipPath() and serves the site from it
+func keepZipFile(ctx context.Context, zipFile string, site *Site) error {
+	zipPath := siteZipPath(site)
+	err := os.Rename(zipFile, zipPath)
+	if err != nil {
+		// can fail if data dir and premium sites dir are on different disks
+		err = copyFile(zipPath, zipFile)
+		if err == nil {
+			err = os.Remove(zipFile)
+		}
+	}
+	if err != nil {
+		logf(ctx, logAttrs(logSite(site.name), logPath(zipPath), logErr(err)), "keepZipFile: moving '%s' failed", zipFile)
+		return err
+	}
+	return openSiteZip(ctx, site)
+}
+
+// openSiteZip opens siteZipPath() and switches the site to zipStorage
+func openSiteZip(ctx context.Context, site *Site) error {
+	timeStart := time.Now()
+	zipPath := siteZipPath(site)
+	f, err := os.Open(zipPath)
+	if err != nil {
+		logf(ctx, logAttrs(logSite(site.name), logPath(zipPath), logErr(err)), "openSiteZip: os.Open() failed")
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	archive := &zipArchive{f: f}
+	zr, err := zip.NewReader(archive, st.Size())
+	if err != nil {
+		logf(ctx, logAttrs(logSite(site.name), logPath(zipPath), logErr(err)), "openSiteZip: zip.NewReader() failed")
+		countUnzipError()
+		f.Close()
+		return err
+	}
+	storage := &zipStorage{
+		zipFS:   newZipFS(archive),
+		zipPath: zipPath,
+	}
+	fileNames := zipEntryNames(zr)
+	site.files = nil
+	site.totalSize = 0
+	for i, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		if isBlacklistedFileType(zf.Name) {
+			logf(ctx, logAttrs(logSite(site.name), logPath(zipPath)), "openSiteZip: skipping blacklisted file '%s'", zf.Name)
+			continue
+		}
+		sf := &siteFile{
+			Path:       fileNames[i],
+			Size:       int64(zf.UncompressedSize64),
+			pathInForm: zf.Name,
+		}
+		storage.addFile(sf.Path, zf)
+		site.files = append(site.files, sf)
+		site.totalSize += sf.Size
+	}
+	site.storage = storage
+	logf(ctx, logAttrs(logSite(site.name), logPath(zipPath)), "openSiteZip: %d files, total size: %s, in %s", len(site.files), formatSize(site.totalSize), time.Since(timeStart))
+	return nil
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// zipEntryReader provides io.ReadSeeker for a compressed file inside zip,
+// needed for http.ServeContent and range requests. Seeking forward
+// skips decompressed data, seeking backwards decompresses from the start
+type zipEntryReader struct {
+	entry *zip.File
+	rc    io.ReadCloser
+	pos   int64 // position in rc
+	off   int64 // position set by Seek
+}
+
+func (r *zipEntryReader) Read(p []byte) (int, error) {
+	if r.rc != nil && r.off < r.pos {
+		r.rc.Close()
+		r.rc = nil
+	}
+	if r.rc == nil {
+		rc, err := r.entry.Open()
+		if err != nil {
+			return 0, err
+		}
+		r.rc = rc
+		r.pos = 0
+	}
+	if r.off > r.pos {
+		n, err := io.CopyN(io.Discard, r.rc, r.off-r.pos)
+		r.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.rc.Read(p)
+	r.pos += int64(n)
+	r.off = r.pos
+	return n, err
+}
+
+func (r *zipEntryReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		// no-op
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += int64(r.entry.UncompressedSize64)
+	default:
+		return 0, errors.New("zipEntryReader.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("zipEntryReader.Seek: negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *zipEntryReader) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+	err := r.rc.Close()
+	r.rc = nil
+	return err
+}
+
+// openZipEntry opens a file inside zip for reading and seeking
+// uncompressed files are read directly from the zip file
+func openZipEntry(archive io.ReaderAt, entry *zip.File) (io.ReadSeekCloser, error) {
+	if entry.Method == zip.Store {
+		off, err := entry.DataOffset()
+		if err != nil {
+			return nil, err
+		}
+		sr := io.NewSectionReader(archive, off, int64(entry.UncompressedSize64))
+		return nopCloser{sr}, nil
+	}
+	return &zipEntryReader{entry: entry}, nil
+}
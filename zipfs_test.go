@@ -0,0 +1,114 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestOpenZipEntry(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		name := "stored.txt"
+		if method == zip.Deflate {
+			name = "deflated.txt"
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		must(err)
+		_, err = io.WriteString(w, content)
+		must(err)
+	}
+	must(zw.Close())
+	archive := bytes.NewReader(buf.Bytes())
+	zr, err := zip.NewReader(archive, int64(buf.Len()))
+	must(err)
+
+	for _, entry := range zr.File {
+		rs, err := openZipEntry(archive, entry)
+		must(err)
+		size, err := rs.Seek(0, io.SeekEnd)
+		if err != nil || size != int64(len(content)) {
+			t.Fatalf("%s: exp size %d, got %d, err: %v\n", entry.Name, len(content), size, err)
+		}
+		// seek forward, then backward
+		for _, off := range []int64{5003, 17, 9990} {
+			_, err = rs.Seek(off, io.SeekStart)
+			must(err)
+			d := make([]byte, 10)
+			_, err = io.ReadFull(rs, d)
+			must(err)
+			exp := content[off : off+10]
+			if string(d) != exp {
+				t.Fatalf("%s: at %d exp '%s', got '%s'\n", entry.Name, off, exp, string(d))
+			}
+		}
+		rs.Close()
+	}
+}
+
+func writeTestZip(t *testing.T, path string, files map[string]string) {
+	f, err := os.Create(path)
+	must(err)
+	zw := zip.NewWriter(f)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		must(err)
+		_, err = io.WriteString(w, content)
+		must(err)
+	}
+	must(zw.Close())
+	must(f.Close())
+}
+
+func openTestSiteZip(t *testing.T, files map[string]string) *Site {
+	silenceLogs(t)
+	site := &Site{dir: filepath.Join(t.TempDir(), "site")}
+	writeTestZip(t, siteZipPath(site), files)
+	must(openSiteZip(ctx(), site))
+	return site
+}
+
+func TestZipStorageFS(t *testing.T) {
+	site := openTestSiteZip(t, map[string]string{
+		"mysite/index.html":       "<html></html>",
+		"mysite/css/main.css":     "body {}",
+		"mysite/css/print/a.css":  "a {}",
+		"mysite/docs/readme.md":   "# readme",
+		"mysite/docs/img/foo.png": "png",
+	})
+	defer site.storage.RemoveAll()
+	err := fstest.TestFS(site.storage, "index.html", "css/main.css", "css/print/a.css", "docs/readme.md", "docs/img/foo.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// re-uploading a site removes the zip while files might be served
+func TestZipStorageRemoveWhileReading(t *testing.T) {
+	site := openTestSiteZip(t, map[string]string{
+		"index.html": "<html></html>",
+	})
+	f, err := site.storage.Open("index.html")
+	must(err)
+	must(site.storage.RemoveAll())
+	d, err := io.ReadAll(f)
+	if err != nil || string(d) != "<html></html>" {
+		t.Fatalf("exp to read the file after RemoveAll(), got '%s', err: %v\n", string(d), err)
+	}
+	must(f.Close())
+	if _, err = site.storage.Open("index.html"); !errors.Is(err, fs.ErrClosed) {
+		t.Fatalf("exp fs.ErrClosed after RemoveAll(), got %v\n", err)
+	}
+	if _, err = os.Stat(siteZipPath(site)); !os.IsNotExist(err) {
+		t.Fatalf("exp zip file to be deleted, got %v\n", err)
+	}
+}